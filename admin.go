@@ -0,0 +1,144 @@
+// admin.go holds the operational /admin routes. They're all wrapped in requireAdmin.
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxWarmIDs bounds one cache warm request
+const maxWarmIDs = 1000
+
+// requireAdmin only lets requests with "Authorization: Bearer <ADMIN_TOKEN>" through.
+// With no ADMIN_TOKEN configured the admin routes are disabled entirely.
+func (a *api) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.cfg.adminToken == "" {
+			writeError(w, &APIError{Status: http.StatusForbidden, Code: "forbidden", Message: "admin endpoints are disabled"})
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, &APIError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "unauthorized"})
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// warmCacheHandler loads {"ids":[...]} in one query and caches every user found
+func (a *api) warmCacheHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	var payload struct {
+		IDs []string `json:"ids"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&payload); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	if len(payload.IDs) == 0 || len(payload.IDs) > maxWarmIDs {
+		writeError(w, &ValidationError{Field: "ids", Message: fmt.Sprintf("ids must have 1-%d entries", maxWarmIDs)})
+		return
+	}
+
+	ids := make([]string, 0, len(payload.IDs))
+	for _, raw := range payload.IDs {
+		id, err := parseUserID(raw)
+		if err != nil {
+			writeError(w, &ValidationError{Field: "ids", Message: fmt.Sprintf("invalid id %q", raw)})
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	users, err := a.getUsersByIDs(ctx, ids)
+	if err != nil {
+		writeError(w, failed("failed to load users", err))
+		return
+	}
+
+	found := make(map[string]bool, len(users))
+	for _, u := range users {
+		a.setUserCache(ctx, u.ID, u, a.cfg.cacheTTL)
+		found[u.ID] = true
+	}
+
+	notFound := []string{}
+	for _, id := range ids {
+		if !found[id] {
+			notFound = append(notFound, id)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]any{"warmed": len(users), "notFound": notFound})
+}
+
+// cacheStatsHandler lists cached keys with their remaining TTL, no user data
+func (a *api) cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	stats, err := a.cache.Stats(ctx)
+	if err != nil {
+		writeError(w, failed("failed to read cache stats", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]any{"backend": a.cfg.cacheBackend, "stats": stats})
+}
+
+// flushCacheHandler drops every cached user, for every tenant
+func (a *api) flushCacheHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	if err := a.cache.Flush(ctx); err != nil {
+		writeError(w, failed("failed to flush cache", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireDev hides a diagnostic route (404) unless DEV_ROUTES is set
+func (a *api) requireDev(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.cfg.devRoutes {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// dbIndexesHandler reports how the users table is being read: sequential vs index scans and
+// per-index usage, so an index nothing uses or a climbing seq_scan count stands out
+func (a *api) dbIndexesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	report, err := a.indexUsage(ctx)
+	if err != nil {
+		writeError(w, failed("failed to read index stats", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+
+	tests := []struct {
+		name       string
+		token      string
+		auth       string
+		wantStatus int
+	}{
+		{"disabled", "", "Bearer anything", http.StatusForbidden},
+		{"missing header", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer nope", http.StatusUnauthorized},
+		{"wrong scheme", "s3cret", "Basic s3cret", http.StatusUnauthorized},
+		{"valid", "s3cret", "Bearer s3cret", http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.adminToken = tt.token
+			a := newAPI(cfg, nil, newMemoryCache())
+
+			r := httptest.NewRequest("POST", "/admin/cache/warm", nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			a.requireAdmin(ok)(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected %d, got %d", tt.wantStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestRequireDev(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+
+	for _, dev := range []bool{false, true} {
+		cfg := defaultConfig()
+		cfg.devRoutes = dev
+		a := newAPI(cfg, nil, newMemoryCache())
+
+		w := httptest.NewRecorder()
+		a.requireDev(ok)(w, httptest.NewRequest("GET", "/admin/db/indexes", nil))
+
+		want := http.StatusNotFound
+		if dev {
+			want = http.StatusNoContent
+		}
+		if w.Code != want {
+			t.Errorf("devRoutes=%v: expected %d, got %d", dev, want, w.Code)
+		}
+	}
+}
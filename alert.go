@@ -0,0 +1,62 @@
+// alert.go posts recovered panics to PANIC_WEBHOOK_URL so they can page someone.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// panicWebhookTimeout bounds each webhook call, it runs off the request path but shouldn't pile up
+const panicWebhookTimeout = 5 * time.Second
+
+// panicAlert is what recoverMiddleware hands to api.onPanic, and the webhook's JSON body
+type panicAlert struct {
+	Message   string    `json:"message"`
+	RequestID string    `json:"requestId"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Time      time.Time `json:"time"`
+}
+
+// panicWebhook returns an onPanic hook that POSTs each alert to url as JSON
+func panicWebhook(url string) func(panicAlert) {
+	client := &http.Client{Timeout: panicWebhookTimeout}
+	return func(alert panicAlert) {
+		// a panicking server shouldn't lose the alert to a slow endpoint, but mustn't block on it either
+		go func() {
+			if err := postPanicAlert(client, url, alert); err != nil {
+				log.Printf("panic webhook request_id=%s: %v", alert.RequestID, err)
+			}
+		}()
+	}
+}
+
+func postPanicAlert(client *http.Client, url string, alert panicAlert) error {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), panicWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
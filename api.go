@@ -1,23 +1,32 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
 )
 
+// healthHandler is the liveness probe: one DB ping bounded by cfg.pingTimeout, no retries
 func (a *api) healthHandler(w http.ResponseWriter, r *http.Request) {
-	if err := a.db.Ping(); err != nil {
-		http.Error(w, "db not reachable", http.StatusServiceUnavailable)
+	latency, err := pingWithRetry(r.Context(), a.pingShards, a.cfg.pingTimeout, 1)
+	if err != nil {
+		writeError(w, &APIError{Status: http.StatusServiceUnavailable, Code: "unavailable", Message: "db not reachable", Err: err})
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("ok"))
+	// maintenance only pauses writes, the process is healthy
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "ok", "dbLatencyMs": milliseconds(latency), "maintenance": a.maintenance.Load()})
 }
 
 // Previously used to insert users into a slice in memory (when still using local storage)
@@ -43,172 +52,493 @@ func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("hello from ServeHTTP\n"))
 }
 
-// getUsersHandler lists all users in the database
+// getUsersHandler lists a page of users from the database
 func (a *api) getUsersHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 500*time.Millisecond)
+	// ?ids= is a batch get rather than a page, see batch.go
+	if r.URL.Query().Has("ids") {
+		a.batchGetUsersHandler(w, r)
+		return
+	}
+
+	if !a.allowedParams(w, r, "limit", "offset", "active", "nulls", "fields", "pretty") {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
 	defer cancel()
 
-	users, err := a.listUsers(ctx)
+	fields, err := parseFields(r)
 	if err != nil {
-		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-			http.Error(w, "request timeout/canceled", http.StatusGatewayTimeout)
-			return
-		}
-		http.Error(w, "failed to list users", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(users)
+
+	params, err := a.parseListParams(r)
 	if err != nil {
-		http.Error(w, "failed to encode users", http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+
+	pretty, err := boolParam(r, "pretty")
+	if err != nil {
+		writeError(w, invalidParam("pretty"))
+		return
+	}
+
+	if wantsNDJSON(r) {
+		a.streamUsersNDJSON(ctx, w, params, fields)
+		return
+	}
+
+	users, err := a.listUsersDedupe(ctx, params)
+	if err != nil {
+		writeError(w, failed("failed to list users", err))
+		return
+	}
+
+	var body any = users
+	contentType := "application/json"
+	switch {
+	case wantsJSONAPI(r):
+		body, err = jsonAPIListDocument(users, fields, params)
+		contentType = jsonAPIMediaType
+	case fields != nil:
+		body, err = selectFieldsList(users, fields)
 	}
+	var b []byte
+	if err == nil {
+		b, err = encodeJSON(body, pretty)
+	}
+	if err != nil {
+		writeError(w, failed("failed to encode users", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	// the limit actually applied, which may be lower than what was asked for
+	w.Header().Set("X-Page-Limit", strconv.Itoa(params.limit))
+	// lists aren't cached server-side and go stale faster, so only allow a short client cache
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(a.cfg.listMaxAge.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b)
 }
 
 // getUserByIdHandler gets a user by id from the database
 func (a *api) getUserByIdHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 500*time.Millisecond)
+	// HEAD is dispatched here rather than via its own pattern: "HEAD /users/{id}" would conflict with "GET /users/events"
+	if r.Method == http.MethodHead {
+		a.headUserByIdHandler(w, r)
+		return
+	}
+
+	if !a.allowedParams(w, r, "fields", "pretty") {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
 	defer cancel()
 
-	userId := r.PathValue("id")
+	// reject bad ids up front instead of letting Postgres fail the cast (500)
+	userId, err := parseUserID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, invalidParam("id"))
+		return
+	}
 
-	u, src, err := a.getUserByIdDedupe(ctx, userId)
+	fields, err := parseFields(r)
 	if err != nil {
-		// 1) timeout / canceled
-		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-			http.Error(w, "request timeout/canceled", http.StatusGatewayTimeout)
-			return
-		}
+		writeError(w, err)
+		return
+	}
 
-		// 2) not found
-		if errors.Is(err, sql.ErrNoRows) {
-			http.Error(w, "user not found", http.StatusNotFound)
-			return
-		}
+	pretty, err := boolParam(r, "pretty")
+	if err != nil {
+		writeError(w, invalidParam("pretty"))
+		return
+	}
 
-		// 3) everything else
-		http.Error(w, "failed to get user", http.StatusInternalServerError)
+	res, err := a.getUserByIdDedupe(ctx, userId)
+	if err != nil {
+		writeError(w, failed("failed to get user", err))
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("X-Source", src)
+
+	var body any = res.user
+	contentType := "application/json"
+	switch {
+	case wantsJSONAPI(r):
+		body, err = jsonAPIDocument(res.user, fields)
+		contentType = jsonAPIMediaType
+	case fields != nil:
+		body, err = selectFields(res.user, fields)
+	}
+	var b []byte
+	if err == nil {
+		b, err = encodeJSON(body, pretty)
+	}
+	if err != nil {
+		writeError(w, failed("failed to encode response", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Source", res.source)
+	if res.source == "stale" {
+		w.Header().Set("X-Cache-Stale", "true")
+	}
+	setUserCacheHeaders(w, res)
 	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(u)
+	_, _ = w.Write(b)
+}
+
+// headUserByIdHandler checks whether a user exists without sending a body.
+// It goes through the same cache/dedupe path as GET so it stays cheap.
+func (a *api) headUserByIdHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r, "fields", "pretty") {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	userId, err := parseUserID(r.PathValue("id"))
 	if err != nil {
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		w.WriteHeader(httpStatusForError(invalidParam("id")))
+		return
 	}
+
+	res, err := a.getUserByIdDedupe(ctx, userId)
+	if err != nil {
+		// HEAD has no body, so only the status of the usual mapping is sent
+		w.WriteHeader(httpStatusForError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Source", res.source)
+	if res.source == "stale" {
+		w.Header().Set("X-Cache-Stale", "true")
+	}
+	setUserCacheHeaders(w, res)
+	w.WriteHeader(http.StatusOK)
 }
 
 // getUserByIdDedupe helps to prevent duplicate requests for the same resource
-func (a *api) getUserByIdDedupe(ctx context.Context, id string) (User, string, error) {
+func (a *api) getUserByIdDedupe(ctx context.Context, id string) (userLookup, error) {
 	// 1) cache first
-	if u, err := a.getUserFromCache(id); err == nil {
-		return u, "cache", nil
+	if e, err := a.getUserFromCache(ctx, id); err == nil {
+		if a.sampleStaleness() {
+			go a.checkStaleness(ctx, e.user)
+		}
+		userLookupsTotal.WithLabelValues("cache").Inc()
+		return userLookup{user: e.user, source: "cache", cachedAt: e.cachedAt, expiresAt: e.expiresAt}, nil
 	}
 
-	// 2) inflight gate
+	// 2) inflight gate, per tenant so one tenant never receives another's fetch
+	key := tenantKey(ctx, id)
 	a.inflightMu.Lock()
-	if ch, ok := a.inflight[id]; ok {
+	select {
+	case <-a.draining:
+		// shutting down: don't start fetches that Shutdown would have to wait for
+		a.inflightMu.Unlock()
+		return userLookup{source: "db"}, errShuttingDown
+	default:
+	}
+	if ch, ok := a.inflight[key]; ok {
 		// follower: someone else is fetching
 		a.inflightMu.Unlock()
+		userLookupsTotal.WithLabelValues("follower").Inc()
 
 		select {
 		case res := <-ch:
 			// leader already did DB work
 			if res.err == nil {
-				return res.user, "shared", nil
+				return a.freshLookup(res.user, "shared"), nil
 			}
-			return User{}, "shared", res.err
+			if errors.Is(res.err, context.Canceled) {
+				// the leader's client left, ours didn't: don't answer it as if it had disconnected
+				res.err = errLeaderCanceled
+			}
+			return a.serveStale(ctx, id, userLookup{source: "shared"}, res.err)
 		case <-ctx.Done():
-			return User{}, "shared", ctx.Err()
+			return userLookup{source: "shared"}, ctx.Err()
+		case <-a.draining:
+			return userLookup{source: "shared"}, errShuttingDown
 		}
 	}
 
 	// leader: create waiting room
 	ch := make(chan fetchResult, 1)
-	a.inflight[id] = ch
+	a.inflight[key] = ch
 	a.inflightMu.Unlock()
+	userLookupsTotal.WithLabelValues("leader").Inc()
+	userLookupsInflight.Inc()
 
 	// Ensure all followers are released no matter what
 	defer func() {
 		a.inflightMu.Lock()
-		delete(a.inflight, id)
+		delete(a.inflight, key)
 		a.inflightMu.Unlock()
+		userLookupsInflight.Dec()
 		close(ch)
 	}()
 
 	// 3) do DB work
 	u, err := a.getUserById(ctx, id)
 	if err == nil {
-		// fill cache (use your TTL)
-		a.setUserCache(id, u, 30*time.Second)
+		// fill cache
+		a.setUserCache(ctx, id, u, a.cfg.cacheTTL)
 	}
 
 	// 4) broadcast to followers
 	ch <- fetchResult{user: u, err: err}
 
 	if err != nil {
-		return User{}, "db", err
+		return a.serveStale(ctx, id, userLookup{source: "db"}, err)
+	}
+	return a.freshLookup(u, "db"), nil
+}
+
+// serveStale falls back to an expired cache entry when the DB read failed (SERVE_STALE_ON_ERROR).
+// A missing user is an answer rather than a failure, so sql.ErrNoRows is passed through.
+func (a *api) serveStale(ctx context.Context, id string, res userLookup, err error) (userLookup, error) {
+	if !a.cfg.serveStaleOnError || errors.Is(err, sql.ErrNoRows) {
+		return res, err
+	}
+
+	// the request's own context may be what failed (timeout), the cache lookup shouldn't inherit that
+	e, cerr := a.cache.GetStale(context.WithoutCancel(ctx), tenantKey(ctx, id))
+	if cerr != nil {
+		return res, err
+	}
+	log.Printf("serving stale user id=%s after db error: %v", id, err)
+	return userLookup{user: e.user, source: "stale", cachedAt: e.cachedAt, expiresAt: e.expiresAt}, nil
+}
+
+// drainInflight stops the dedupe layer for shutdown: new fetches are refused and every follower
+// still waiting on a leader is released with errShuttingDown (503). Safe to call more than once.
+func (a *api) drainInflight() {
+	a.drainOnce.Do(func() {
+		// under inflightMu so no leader is registered after the gate check saw it open
+		a.inflightMu.Lock()
+		close(a.draining)
+		a.inflightMu.Unlock()
+	})
+}
+
+// freshLookup describes a user that was just loaded from the DB (and cached for a full TTL)
+func (a *api) freshLookup(u User, source string) userLookup {
+	now := time.Now()
+	return userLookup{user: u, source: source, cachedAt: now, expiresAt: now.Add(a.cfg.cacheTTL)}
+}
+
+// setUserCacheHeaders lets clients and CDNs cache a user for as long as the server-side entry lives.
+// A user served from cache gets the remaining TTL as max-age plus an Age header.
+func setUserCacheHeaders(w http.ResponseWriter, res userLookup) {
+	now := time.Now()
+	maxAge := max(int(res.expiresAt.Sub(now).Seconds()), 0)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	if res.source == "cache" {
+		w.Header().Set("Age", strconv.Itoa(int(now.Sub(res.cachedAt).Seconds())))
+	}
+}
+
+// listUsersDedupe collapses concurrent identical list queries into a single DB call.
+// The leader's query runs on a context detached from any one caller, so a follower
+// (or the leader's own client) giving up doesn't abort the work for everyone else.
+func (a *api) listUsersDedupe(ctx context.Context, p listParams) ([]User, error) {
+	ch := a.listGroup.DoChan(tenantKey(ctx, p.key()), func() (any, error) {
+		// the shared query gets as long as the caller that started it
+		timeout := a.cfg.requestTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		dbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		defer cancel()
+		return a.listUsers(dbCtx, p)
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		// followers share the leader's slice, so it must be treated as read-only
+		return res.Val.([]User), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return u, "db", nil
 }
 
 // deleteUserByIdHandler deletes a user by id from the database
 func (a *api) deleteUserByIdHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 500*time.Millisecond)
+	if !a.allowedParams(w, r, "dryRun") {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
 	defer cancel()
 
-	userId := r.PathValue("id")
+	userId, err := parseUserID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, invalidParam("id"))
+		return
+	}
+
+	dryRun, err := boolParam(r, "dryRun")
+	if err != nil {
+		writeError(w, invalidParam("dryRun"))
+		return
+	}
 
-	deleted, err := a.deleteUserById(ctx, userId)
+	u, deleted, err := a.deleteUserById(ctx, userId, writeOptions{dryRun: dryRun, unmodifiedSince: ifUnmodifiedSince(r)})
 	if err != nil {
-		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-			http.Error(w, "request timeout/canceled", http.StatusGatewayTimeout)
-			return
-		}
-		http.Error(w, "failed to delete user", http.StatusInternalServerError)
+		writeError(w, failed("failed to delete user", err))
 		return
 	}
 	if !deleted {
-		http.Error(w, "user not found", http.StatusNotFound)
+		writeError(w, errUserNotFound)
+		return
+	}
+
+	// Dry run: nothing was deleted, show the user that would have been
+	if dryRun {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Dry-Run", "true")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]any{"wouldDelete": u})
 		return
 	}
 
 	// Invalidate cache for this user
-	a.invalidateUserCache(userId)
+	a.invalidateUserCache(ctx, userId)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // createUserHandler creates a new user in the database
 func (a *api) createUserHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 500*time.Millisecond)
+	if !a.allowedParams(w, r, "upsert") {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
 	defer cancel()
 
-	var payload struct {
-		FirstName string `json:"firstName"`
-		LastName  string `json:"lastName"`
+	upsert, err := boolParam(r, "upsert")
+	if err != nil {
+		writeError(w, invalidParam("upsert"))
+		return
 	}
 
-	dec := json.NewDecoder(r.Body)
+	if !utf8Body(r) {
+		writeError(w, errNotUTF8)
+		return
+	}
+
+	var payload createUserRequest
+
+	body := io.Reader(r.Body)
+	if formBody(r) {
+		fields, err := formFields(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		b, _ := json.Marshal(fields)
+		body = bytes.NewReader(b)
+	}
+
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields()
 	if err := dec.Decode(&payload); err != nil {
-		http.Error(w, "invalid json", http.StatusBadRequest)
+		writeError(w, errInvalidJSON)
 		return
 	}
 
-	if payload.FirstName == "" || payload.LastName == "" {
-		http.Error(w, "firstName and lastName are required", http.StatusBadRequest)
+	if err := payload.normalizeNames(); err != nil {
+		writeError(w, err)
+		return
+	}
+	// field-by-field errors so clients know exactly what to fix
+	if err := validate.Struct(payload); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := a.validateNames(payload); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	u, err := a.createUser(ctx, payload.FirstName, payload.LastName)
-	if err != nil {
-		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-			http.Error(w, "request timeout/canceled", http.StatusGatewayTimeout)
+	if payload.Phone != nil {
+		phone, err := normalizePhone(*payload.Phone, a.cfg.phoneRegion)
+		if err != nil {
+			writeError(w, &ValidationError{Field: "phone", Message: "phone is not a valid phone number"})
 			return
 		}
-		http.Error(w, "failed to create user", http.StatusInternalServerError)
+		payload.Phone = &phone
+	}
+
+	// ?upsert=true: an existing user with the same name is returned (200) instead of failing
+	var u User
+	created := true
+	if upsert {
+		u, created, err = a.createOrGetUser(ctx, payload.FirstName, payload.LastName, payload.Phone)
+	} else {
+		u, err = a.createUser(ctx, payload.FirstName, payload.LastName, payload.Phone)
+	}
+	if err != nil {
+		writeError(w, failed("failed to create user", err))
+		return
+	}
+
+	// a new user isn't cached anywhere yet, so only repopulate mode has anything to do
+	if a.cfg.cacheWriteMode == "repopulate" {
+		a.setUserCache(ctx, u.ID, u, a.cfg.cacheTTL)
+	}
+
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+	w.Header().Set("Location", "/users/"+u.ID)
+	w.Header().Add("Vary", "Prefer")
+
+	// Prefer: return=minimal skips echoing the user back, the Location is all bulk callers need
+	if preferReturn(r) == "minimal" {
+		w.Header().Set("Preference-Applied", "return=minimal")
+		w.WriteHeader(status)
+		return
+	}
+
+	// accepted but worth a second look, only for a user this request actually created
+	var resp any = u
+	if warnings := softValidateUser(payload); created && len(warnings) > 0 {
+		resp = createUserResponse{userResponse: newUserResponse(u), Warnings: warnings}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// duplicateUserHandler clones a user under a "(copy)" last name
+func (a *api) duplicateUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r) {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	id, err := parseUserID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, invalidParam("id"))
+		return
+	}
+
+	u, err := a.duplicateUser(ctx, id)
+	if err != nil {
+		writeError(w, failed("failed to duplicate user", err))
 		return
 	}
 
@@ -217,66 +547,147 @@ func (a *api) createUserHandler(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(u)
 }
 
+// setUserActiveHandler serves POST /users/{id}/activate and /deactivate
+func (a *api) setUserActiveHandler(active bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowedParams(w, r) {
+			return
+		}
+
+		ctx, cancel := a.requestContext(w, r)
+		defer cancel()
+
+		id, err := parseUserID(r.PathValue("id"))
+		if err != nil {
+			writeError(w, invalidParam("id"))
+			return
+		}
+
+		u, updated, err := a.setUserActive(ctx, id, active)
+		if err != nil {
+			writeError(w, failed("failed to update user", err))
+			return
+		}
+		if !updated {
+			writeError(w, errUserNotFound)
+			return
+		}
+
+		a.refreshUserCache(ctx, u)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(u)
+	}
+}
+
 // updateUserByIdHandler updates a user by id from the database
 func (a *api) updateUserByIdHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 500*time.Millisecond)
+	if !a.allowedParams(w, r, "dryRun") {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
 	defer cancel()
 
 	idStr := r.PathValue("id")
-	id, err := strconv.ParseInt(idStr, 10, 64)
-	if err != nil || id <= 0 {
-		http.Error(w, "invalid id", http.StatusBadRequest)
+	id, err := parseUserID(idStr)
+	if err != nil {
+		writeError(w, invalidParam("id"))
 		return
 	}
-	//this pointers allow us to update field that are provided.
-	//if the field is not provided, it will be nil and not updated.
-	var patch struct {
-		FirstName *string `json:"firstName"`
-		LastName  *string `json:"lastName"`
-	}
-
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
-
-	if err := dec.Decode(&patch); err != nil {
-		http.Error(w, "invalid json body", http.StatusBadRequest)
+	if !utf8Body(r) {
+		writeError(w, errNotUTF8)
 		return
 	}
-
-	if patch.FirstName == nil && patch.LastName == nil {
-		http.Error(w, "no fields to update", http.StatusBadRequest)
+	// JSON Merge Patch: absent fields are left alone, null clears a nullable field (phone).
+	// A form body follows the same rules, with an empty phone standing in for null.
+	var patch userPatch
+	if formBody(r) {
+		var fields map[string]json.RawMessage
+		if fields, err = formFields(r); err == nil {
+			patch, err = patchFromJSON(fields)
+		}
+	} else {
+		patch, err = parseUserPatch(r.Body)
+	}
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	if patch.FirstName != nil && *patch.FirstName == "" {
-		http.Error(w, "firstName cannot be empty", http.StatusBadRequest)
+	if patch.empty() {
+		writeError(w, &ValidationError{Message: "no fields to update"})
 		return
 	}
-	if patch.LastName != nil && *patch.LastName == "" {
-		http.Error(w, "lastName cannot be empty", http.StatusBadRequest)
+	if err := a.validatePatchNames(patch); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	u, updated, err := a.updateUserByID(ctx, id, patch.FirstName, patch.LastName)
-	if err != nil {
-		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-			http.Error(w, "request timeout/canceled", http.StatusGatewayTimeout)
+	if patch.Phone != nil {
+		phone, err := normalizePhone(*patch.Phone, a.cfg.phoneRegion)
+		if err != nil {
+			writeError(w, &ValidationError{Field: "phone", Message: "phone is not a valid phone number"})
 			return
 		}
-		http.Error(w, "failed to update user", http.StatusInternalServerError)
+		patch.Phone = &phone
+	}
+
+	dryRun, err := boolParam(r, "dryRun")
+	if err != nil {
+		writeError(w, invalidParam("dryRun"))
+		return
+	}
+
+	u, changed, updated, err := a.updateUserByID(ctx, id, patch, writeOptions{dryRun: dryRun, unmodifiedSince: ifUnmodifiedSince(r)})
+	if err != nil {
+		writeError(w, failed("failed to update user", err))
 		return
 	}
 	if !updated {
-		http.Error(w, "user not found", http.StatusNotFound)
+		writeError(w, errUserNotFound)
 		return
 	}
 
-	// Invalidate cache for this user (will be repopulated on next GET)
-	a.invalidateUserCache(u.ID)
+	if dryRun {
+		// Dry run: u is what the user would look like, nothing persisted so the cache stays valid
+		w.Header().Set("X-Dry-Run", "true")
+	} else {
+		a.refreshUserCache(ctx, u)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(u)
+	_ = json.NewEncoder(w).Encode(patchResponse{User: u, Changed: changed})
+}
+
+// newJSONEncoder streams JSON to w, indented for humans when pretty is set (?pretty=true)
+func newJSONEncoder(w io.Writer, pretty bool) *json.Encoder {
+	enc := json.NewEncoder(w)
+	if pretty {
+		enc.SetIndent("", "  ")
+	}
+	return enc
+}
+
+// encodeJSON encodes a response body up front. Handlers send the status only once this succeeded,
+// so a body that fails to encode is a clean 500 instead of a 200 cut off part way.
+func encodeJSON(body any, pretty bool) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := newJSONEncoder(&buf, pretty).Encode(body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// boolParam reads an optional boolean query param, absent means false
+func boolParam(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
 }
 
 // func (a *api) getUsersByHandlerQuery(w http.ResponseWriter, r *http.Request) {
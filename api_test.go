@@ -7,8 +7,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -46,10 +49,9 @@ func newTestServer(t *testing.T) (*httptest.Server, *sql.DB) {
 
 	db := openTestDb(t)
 
-	api := &api{
-		addr: ":0",
-		db:   db,
-	}
+	cfg := defaultConfig()
+	cfg.addr = ":0"
+	api := newAPI(cfg, db, newMemoryCache())
 
 	ts := httptest.NewServer(route(api))
 	return ts, db
@@ -147,3 +149,90 @@ func TestGetUsersByIDNotFound(t *testing.T) {
 		t.Fatalf("expected 404, got %d", resp.StatusCode)
 	}
 }
+
+func TestGetUsersByIDInvalid(t *testing.T) {
+	ts, db := newTestServer(t)
+	defer ts.Close()
+	defer db.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/users/abc", ts.URL))
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestListUsersStableOrderWithTiedLastNames(t *testing.T) {
+	db := openTestDb(t)
+	defer db.Close()
+
+	cfg := defaultConfig()
+	cfg.listOrder = "lastName"
+	ts := httptest.NewServer(route(newAPI(cfg, db, newMemoryCache())))
+	defer ts.Close()
+
+	// a tenant of its own so nobody else's rows land between ours
+	tenant := strconv.FormatInt(time.Now().UnixNano(), 10)
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set(tenantHeader, tenant)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return resp
+	}
+
+	// every last name ties, only the id tie-breaker orders them
+	for i := range 6 {
+		resp := do("POST", "/users", fmt.Sprintf(`{"firstName":"Tie%d","lastName":"Same"}`, i))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create: expected 201, got %d", resp.StatusCode)
+		}
+	}
+
+	listAll := func() []string {
+		var ids []string
+		for offset := 0; offset < 6; offset += 3 {
+			resp := do("GET", fmt.Sprintf("/users?limit=3&offset=%d", offset), "")
+			var page []User
+			_ = json.NewDecoder(resp.Body).Decode(&page)
+			resp.Body.Close()
+			for _, u := range page {
+				ids = append(ids, u.ID)
+			}
+		}
+		return ids
+	}
+
+	first, second := listAll(), listAll()
+	seen := map[string]bool{}
+	for _, id := range first {
+		seen[id] = true
+	}
+	if len(first) != 6 || len(seen) != 6 {
+		t.Fatalf("pages should cover all 6 users exactly once, got %v", first)
+	}
+	if !slices.Equal(first, second) {
+		t.Errorf("ordering changed between fetches: %v then %v", first, second)
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	b, err := encodeJSON([]User{{ID: "1", FirstName: "Ada"}}, false)
+	if err != nil || !strings.HasPrefix(string(b), `[{"id":"1","firstName":"Ada"`) {
+		t.Errorf("encodeJSON = %s, %v", b, err)
+	}
+
+	// a body that can't be encoded fails before anything is written, so the handler can still send a 500
+	if b, err := encodeJSON(map[string]any{"users": []any{User{ID: "1"}, make(chan int)}}, false); err == nil || b != nil {
+		t.Errorf("encodeJSON of a channel = %s, %v; want an error and no bytes", b, err)
+	}
+}
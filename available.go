@@ -0,0 +1,73 @@
+// available.go serves GET /users/available, a signup-form precheck for the unique name constraint.
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// availability is the GET /users/available body
+type availability struct {
+	Available bool `json:"available"`
+}
+
+// userAvailableHandler reports whether ?firstName=&lastName= is still free in the tenant, so a form can
+// warn before submitting instead of getting a 409 from POST /users. It's a read-only check, a create can
+// still race it. Being a name lookup it should sit behind rate limiting to make enumeration slow.
+func (a *api) userAvailableHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r, "firstName", "lastName") {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	// same rules as POST /users, so a name that's "available" is also a valid one
+	name := createUserRequest{
+		FirstName: r.URL.Query().Get("firstName"),
+		LastName:  r.URL.Query().Get("lastName"),
+	}
+	if err := name.normalizeNames(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validate.Struct(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := a.validateNames(name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	exists, err := a.userExists(ctx, name.FirstName, name.LastName)
+	if err != nil {
+		writeError(w, failed("failed to check name", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	// the answer changes as soon as anyone signs up
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_ = newJSONEncoder(w, false).Encode(availability{Available: !exists})
+}
+
+// userExists reports whether the tenant already has a user with this first and last name.
+// It reads the primary since a replica lagging behind a fresh signup would wrongly say "available".
+func (a *api) userExists(ctx context.Context, first, last string) (exists bool, err error) {
+	ctx, span := tracer.Start(ctx, "userExists")
+	defer func() { finishSpan(span, err) }()
+
+	byName, args := a.nameFilter(2, first, last)
+	for _, db := range a.primaries() {
+		err = a.readRow(ctx, db, "userExists",
+			`SELECT EXISTS (SELECT 1 FROM users WHERE tenant_id = $1 AND `+byName+`)`,
+			append([]any{GetTenantID(ctx)}, args...)...,
+		).Scan(&exists)
+		if err != nil || exists {
+			break
+		}
+	}
+	return exists, err
+}
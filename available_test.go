@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserAvailableHandlerValidation(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+
+	// all rejected before the DB is touched
+	for _, target := range []string{
+		"/users/available",
+		"/users/available?firstName=Ada",
+		"/users/available?lastName=Lovelace",
+	} {
+		w := httptest.NewRecorder()
+		a.userAvailableHandler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", target, w.Code)
+		}
+	}
+}
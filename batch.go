@@ -0,0 +1,121 @@
+// batch.go serves GET /users?ids=1,2,3, loading many users in one round-trip.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxBatchIDs caps ?ids= so one request can't turn into an unbounded ANY($1)
+const maxBatchIDs = 100
+
+// parseBatchIDs parses the comma separated ?ids= value, dropping duplicates but keeping the order
+func parseBatchIDs(raw string) ([]string, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) > maxBatchIDs {
+		return nil, &ValidationError{Field: "ids", Message: fmt.Sprintf("ids must have at most %d entries", maxBatchIDs)}
+	}
+
+	ids := make([]string, 0, len(parts))
+	seen := make(map[string]bool, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		id, err := parseUserID(p)
+		if err != nil {
+			return nil, &ValidationError{Field: "ids", Message: fmt.Sprintf("invalid id %q", p)}
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// batchGetUsersHandler returns the users in ?ids= as an array, in the order asked for.
+// Ids that don't exist are simply left out.
+func (a *api) batchGetUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r, "ids", "fields", "pretty") {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	ids, err := parseBatchIDs(r.URL.Query().Get("ids"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	fields, err := parseFields(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	pretty, err := boolParam(r, "pretty")
+	if err != nil {
+		writeError(w, invalidParam("pretty"))
+		return
+	}
+
+	users, err := a.getUsersBatch(ctx, ids)
+	if err != nil {
+		writeError(w, failed("failed to get users", err))
+		return
+	}
+
+	var body any = users
+	if fields != nil {
+		body, err = selectFieldsList(users, fields)
+	}
+	var b []byte
+	if err == nil {
+		b, err = encodeJSON(body, pretty)
+	}
+	if err != nil {
+		writeError(w, failed("failed to encode users", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(a.cfg.listMaxAge.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b)
+}
+
+// getUsersBatch answers what it can from the cache, loads the misses with one query
+// and backfills the cache with them
+func (a *api) getUsersBatch(ctx context.Context, ids []string) ([]User, error) {
+	byID := make(map[string]User, len(ids))
+	var misses []string
+	for _, id := range ids {
+		if e, err := a.getUserFromCache(ctx, id); err == nil {
+			byID[e.user.ID] = e.user
+		} else {
+			misses = append(misses, id)
+		}
+	}
+
+	if len(misses) > 0 {
+		loaded, err := a.getUsersByIDs(ctx, misses)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range loaded {
+			a.setUserCache(ctx, u.ID, u, a.cfg.cacheTTL)
+			byID[u.ID] = u
+		}
+	}
+
+	users := make([]User, 0, len(byID))
+	for _, id := range ids {
+		if u, ok := byID[id]; ok {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestParseBatchIDs(t *testing.T) {
+	ids, err := parseBatchIDs("3, 1,3,2")
+	if err != nil {
+		t.Fatalf("parseBatchIDs: %v", err)
+	}
+	if want := []string{"3", "1", "2"}; !slices.Equal(ids, want) {
+		t.Errorf("ids = %v, want %v", ids, want)
+	}
+
+	for _, raw := range []string{"", "1,,2", "abc", "0", "-1"} {
+		if _, err := parseBatchIDs(raw); err == nil {
+			t.Errorf("parseBatchIDs(%q): expected an error", raw)
+		}
+	}
+}
+
+func TestGetUsersBatchAllCached(t *testing.T) {
+	ctx := context.Background()
+	// no DB: every id is a cache hit, so getUsersByIDs must not be called
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	a.setUserCache(ctx, "2", User{ID: "2"}, a.cfg.cacheTTL)
+	a.setUserCache(ctx, "1", User{ID: "1"}, a.cfg.cacheTTL)
+
+	users, err := a.getUsersBatch(ctx, []string{"2", "1"})
+	if err != nil {
+		t.Fatalf("getUsersBatch: %v", err)
+	}
+	if len(users) != 2 || users[0].ID != "2" || users[1].ID != "1" {
+		t.Errorf("users = %+v, want ids 2, 1 in that order", users)
+	}
+}
@@ -0,0 +1,77 @@
+// bodylog.go is the LOG_BODIES debug middleware. Bodies can carry PII, so it's off by default.
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// noBodyLogPrefixes are paths whose bodies are never logged: admin routes and anything that
+// will carry credentials once auth lands, plus the long-lived streams.
+var noBodyLogPrefixes = []string{"/admin", "/auth", "/login", "/users/events", "/users/ws"}
+
+// bodyLogWriter passes writes through and keeps the first max bytes
+type bodyLogWriter struct {
+	http.ResponseWriter
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (bw *bodyLogWriter) Write(p []byte) (int, error) {
+	room := bw.max - bw.buf.Len()
+	if len(p) > room {
+		bw.truncated = true
+	}
+	bw.buf.Write(p[:min(room, len(p))])
+	return bw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (bw *bodyLogWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+// bodyLogMiddleware logs request and response bodies, each truncated to cfg.logBodiesMax bytes.
+// Only the logged prefix of the request body is buffered, the handler still reads the full stream.
+func (a *api) bodyLogMiddleware(next http.Handler) http.Handler {
+	if !a.cfg.logBodies {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range noBodyLogPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		limit := a.cfg.logBodiesMax
+		// read one byte past the limit to know whether we truncated
+		head, _ := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+		// put back what we read in front of the rest; the server closes the original body itself
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(head), r.Body))
+		reqTruncated := len(head) > limit
+		head = head[:min(len(head), limit)]
+
+		bw := &bodyLogWriter{ResponseWriter: w, max: limit}
+		next.ServeHTTP(bw, r)
+
+		log.Printf("bodies request_id=%s method=%s path=%s request=%q%s response=%q%s",
+			GetRequestID(r.Context()), r.Method, r.URL.Path,
+			head, truncatedMark(reqTruncated),
+			bw.buf.Bytes(), truncatedMark(bw.truncated),
+		)
+	})
+}
+
+func truncatedMark(truncated bool) string {
+	if truncated {
+		return "(truncated)"
+	}
+	return ""
+}
@@ -0,0 +1,298 @@
+// bulk.go serves POST /users/bulk-update, one patch applied to many users in a single statement.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxBulkUpdateIDs caps how many users one bulk update may touch (and lock)
+const maxBulkUpdateIDs = 1000
+
+// bulkUpdateResult is the POST /users/bulk-update body
+type bulkUpdateResult struct {
+	Updated int      `json:"updated"`
+	IDs     []string `json:"ids"`
+}
+
+// parseBulkUpdate reads {"ids":[1,2],"lastName":"Smith"}: ids plus a merge patch (see parseUserPatch) for all of them.
+// Duplicate ids are dropped.
+func parseBulkUpdate(body io.Reader) ([]string, userPatch, error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, userPatch{}, &ValidationError{Message: "invalid json body"}
+	}
+
+	var ids []jsonID
+	if err := json.Unmarshal(raw["ids"], &ids); err != nil || len(ids) == 0 {
+		return nil, userPatch{}, &ValidationError{Field: "ids", Message: "ids must be a non-empty array of user ids"}
+	}
+	if len(ids) > maxBulkUpdateIDs {
+		return nil, userPatch{}, &ValidationError{Field: "ids", Message: fmt.Sprintf("ids must have at most %d entries", maxBulkUpdateIDs)}
+	}
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	for _, raw := range ids {
+		id, err := parseUserID(string(raw))
+		if err != nil {
+			return nil, userPatch{}, &ValidationError{Field: "ids", Message: fmt.Sprintf("invalid id %q", raw)}
+		}
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	delete(raw, "ids")
+
+	p, err := patchFromJSON(raw)
+	if err != nil {
+		return nil, userPatch{}, err
+	}
+	if p.empty() {
+		return nil, userPatch{}, &ValidationError{Message: "no fields to update"}
+	}
+	return unique, p, nil
+}
+
+// bulkUpdateUsersHandler applies one patch to every user in ids, all or nothing.
+// Ids that don't exist in the tenant are skipped, the response lists the ones updated.
+// A name collision rolls everything back with a 409 naming the two users.
+func (a *api) bulkUpdateUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r) {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	ids, patch, err := parseBulkUpdate(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := a.validatePatchNames(patch); err != nil {
+		writeError(w, err)
+		return
+	}
+	// one transaction, so one database
+	if !a.sameShard(ids...) {
+		writeError(w, errCrossShard)
+		return
+	}
+
+	if patch.Phone != nil {
+		phone, err := normalizePhone(*patch.Phone, a.cfg.phoneRegion)
+		if err != nil {
+			writeError(w, &ValidationError{Field: "phone", Message: "phone is not a valid phone number"})
+			return
+		}
+		patch.Phone = &phone
+	}
+
+	updated, err := a.bulkUpdateUsers(ctx, ids, patch)
+	if err != nil {
+		writeError(w, failed("failed to update users", err))
+		return
+	}
+
+	for _, id := range updated {
+		a.invalidateUserCache(ctx, id)
+	}
+	// "ids":[] rather than null when nothing matched
+	if updated == nil {
+		updated = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(bulkUpdateResult{Updated: len(updated), IDs: updated})
+}
+
+// bulkUpdateUsers applies patch to the tenant's users in ids with one UPDATE in a transaction,
+// returning the ids it changed. The rows are locked first so new names can be checked for collisions,
+// both within the batch and with other users, and reported as a nameConflictError.
+// The ids must all be on one shard (sameShard), the handler checks.
+func (a *api) bulkUpdateUsers(ctx context.Context, ids []string, patch userPatch) (updated []string, err error) {
+	ctx, span := tracer.Start(ctx, "bulkUpdateUsers", trace.WithAttributes(attribute.Int("ids.count", len(ids))))
+	defer func() { finishSpan(span, err) }()
+
+	tenant := GetTenantID(ctx)
+	err = withTx(ctx, a.dbForID(ids[0]), func(tx *sql.Tx) error {
+		olds, err := a.lockUsers(ctx, tx, ids)
+		if err != nil || len(olds) == 0 {
+			return err
+		}
+
+		locked := make([]string, len(olds))
+		for i, u := range olds {
+			locked[i] = u.ID
+		}
+
+		stored, nameHashes := patch, []string(nil)
+		if patch.FirstName != nil || patch.LastName != nil {
+			if err := a.checkBulkNames(ctx, tx, olds, locked, patch); err != nil {
+				return err
+			}
+			// all rows get the same sealed value, but each keeps its other half of the name so needs its own hash
+			stored, _ = a.sealPatch(olds[0], patch)
+			for _, old := range olds {
+				if _, h := a.sealPatch(old, patch); h != nil {
+					nameHashes = append(nameHashes, *h)
+				}
+			}
+		}
+
+		query, args := buildBulkUserUpdate(locked, tenant, stored, nameHashes)
+		rows, err := a.query(ctx, tx, "bulkUpdateUsers", query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			updated = append(updated, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range updated {
+			if err := a.notifyUserChanged(ctx, tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	// someone took one of the names after checkBulkNames looked
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicateUser
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int64("db.rows_affected", int64(len(updated))))
+	for _, id := range updated {
+		a.events.publish(userEvent{Type: eventUpdated, ID: id, TenantID: tenant})
+	}
+	return updated, nil
+}
+
+// lockUsers reads the tenant's users in ids and locks their rows until tx ends, in id order so
+// two bulk updates over overlapping ids can't deadlock
+func (a *api) lockUsers(ctx context.Context, tx *sql.Tx, ids []string) ([]User, error) {
+	rows, err := a.query(ctx, tx, "lockUsers",
+		`SELECT `+userColumns+`
+		FROM users
+		WHERE id = ANY($1) AND tenant_id = $2
+		ORDER BY id
+		FOR UPDATE`,
+		idArray(ids), GetTenantID(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := a.scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// checkBulkNames fails with a nameConflictError if the patch would give two users the same name,
+// either two of olds or one of olds and a user outside the batch.
+// ids are olds' ids.
+func (a *api) checkBulkNames(ctx context.Context, tx *sql.Tx, olds []User, ids []string, p userPatch) error {
+	firsts := make([]string, len(olds))
+	lasts := make([]string, len(olds))
+	byName := make(map[string]string, len(olds))
+	for i, u := range olds {
+		firsts[i], lasts[i] = u.FirstName, u.LastName
+		if p.FirstName != nil {
+			firsts[i] = *p.FirstName
+		}
+		if p.LastName != nil {
+			lasts[i] = *p.LastName
+		}
+		key := a.nameKey(firsts[i], lasts[i])
+		if other, ok := byName[key]; ok {
+			return &nameConflictError{ID: u.ID, ConflictID: other, Name: firsts[i] + " " + lasts[i]}
+		}
+		byName[key] = u.ID
+	}
+
+	match, args := a.namesFilter(3, firsts, lasts)
+	existing, err := a.scanUser(a.queryRow(ctx, tx, "checkBulkNames",
+		`SELECT `+userColumns+`
+		FROM users
+		WHERE tenant_id = $1 AND NOT (id = ANY($2)) AND `+match+`
+		LIMIT 1`,
+		append([]any{GetTenantID(ctx), idArray(ids)}, args...)...,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		// not on this shard, but the others' unique indexes can't see this one's rows
+		existing, found, err := a.findNamesOffShard(ctx, a.dbForID(olds[0].ID), firsts, lasts)
+		if err != nil || !found {
+			return err
+		}
+		return &nameConflictError{
+			ID:         byName[a.nameKey(existing.FirstName, existing.LastName)],
+			ConflictID: existing.ID,
+			Name:       existing.FirstName + " " + existing.LastName,
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return &nameConflictError{
+		ID:         byName[a.nameKey(existing.FirstName, existing.LastName)],
+		ConflictID: existing.ID,
+		Name:       existing.FirstName + " " + existing.LastName,
+	}
+}
+
+// nameKey is what two names have in common when they count as the same name, see NAME_UNIQUENESS
+func (a *api) nameKey(first, last string) string {
+	if a.cfg.caseInsensitiveNames() {
+		first, last = strings.ToLower(first), strings.ToLower(last)
+	}
+	// NUL can't appear in a name, so "Ab"+"c" and "A"+"bc" stay apart
+	return first + "\x00" + last
+}
+
+// buildBulkUserUpdate is buildUserUpdate for many ids ($1, an array, see idArray) in one statement, returning the ids updated.
+// With encryption on a rename needs a name_hash per row, those come in as a second array zipped with ids.
+func buildBulkUserUpdate(ids []string, tenant int64, p userPatch, nameHashes []string) (string, []any) {
+	sets, args := patchSets(p, nil, []any{idArray(ids), tenant})
+	if nameHashes == nil {
+		return `UPDATE users SET ` + strings.Join(sets, ", ") + `
+		WHERE id = ANY($1) AND tenant_id = $2
+		RETURNING id::text`, args
+	}
+
+	args = append(args, nameHashes)
+	sets = append([]string{"name_hash = h.name_hash"}, sets...)
+	return `UPDATE users SET ` + strings.Join(sets, ", ") + fmt.Sprintf(`
+		FROM unnest($1::%s[], $%d::text[]) AS h(id, name_hash)
+		WHERE users.id = h.id AND users.tenant_id = $2
+		RETURNING users.id::text`, idSQLType(), len(args)), args
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBulkUpdate(t *testing.T) {
+	ids, p, err := parseBulkUpdate(strings.NewReader(`{"ids":[3,1,3],"lastName":"Smith","phone":null}`))
+	if err != nil {
+		t.Fatalf("parseBulkUpdate: %v", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"3", "1"}) {
+		t.Errorf("ids = %v, want [3 1] (deduped, order kept)", ids)
+	}
+	if p.LastName == nil || *p.LastName != "Smith" || !p.ClearPhone || p.FirstName != nil {
+		t.Errorf("patch = %+v", p)
+	}
+
+	for _, body := range []string{
+		`{"lastName":"Smith"}`,
+		`{"ids":[],"lastName":"Smith"}`,
+		`{"ids":[0],"lastName":"Smith"}`,
+		`{"ids":"1,2","lastName":"Smith"}`,
+		`{"ids":[1]}`,
+		`{"ids":[1],"lastName":""}`,
+		`{"ids":[1],"nickname":"x"}`,
+	} {
+		if _, _, err := parseBulkUpdate(strings.NewReader(body)); err == nil {
+			t.Errorf("%s: expected an error", body)
+		}
+	}
+}
+
+func TestBuildBulkUserUpdate(t *testing.T) {
+	str := func(s string) *string { return &s }
+	ids := []string{"4", "9"}
+
+	query, args := buildBulkUserUpdate(ids, 3, userPatch{LastName: str("Smith")}, nil)
+	if !strings.Contains(query, "SET last_name = $3, updated_at = now()") || !strings.Contains(query, "WHERE id = ANY($1) AND tenant_id = $2") {
+		t.Errorf("unexpected query:\n%s", query)
+	}
+	if !reflect.DeepEqual(args, []any{[]int64{4, 9}, int64(3), "Smith"}) {
+		t.Errorf("args = %#v", args)
+	}
+
+	// encrypted rename: one hash per id, zipped in with unnest
+	hashes := []string{"h4", "h9"}
+	query, args = buildBulkUserUpdate(ids, 3, userPatch{LastName: str("enc:v1:x")}, hashes)
+	if !strings.Contains(query, "SET name_hash = h.name_hash, last_name = $3, updated_at = now()") ||
+		!strings.Contains(query, "FROM unnest($1::bigint[], $4::text[]) AS h(id, name_hash)") {
+		t.Errorf("unexpected query:\n%s", query)
+	}
+	if !reflect.DeepEqual(args, []any{[]int64{4, 9}, int64(3), "enc:v1:x", hashes}) {
+		t.Errorf("args = %#v", args)
+	}
+}
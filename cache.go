@@ -1,47 +1,223 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log"
+	"sync"
 	"time"
 )
 
 // ErrCacheMiss is returned when a user is not found in the cache
 var ErrCacheMiss = errors.New("cache miss")
 
-// getUserFromCache gets a user from the cache
-func (a *api) getUserFromCache(id string) (User, error) {
-	a.cacheMu.RLock()
-	entry, ok := a.cache[id]
-	expired := ok && time.Now().After(entry.expiresAt)
-	a.cacheMu.RUnlock()
+// Cache stores users by id with a TTL.
+// memoryCache is the default; redisCache is shared by all replicas, so an
+// invalidation on one replica is seen by every other one.
+type Cache interface {
+	Get(ctx context.Context, id string) (cacheEntry, error)
+	// GetStale is Get without the expiry check, for serving stale when the DB is down.
+	// Expired entries are only kept for the cache's stale retention, so it misses after that.
+	GetStale(ctx context.Context, id string) (cacheEntry, error)
+	Set(ctx context.Context, id string, u User, ttl time.Duration) error
+	Invalidate(ctx context.Context, id string) error
+	// InvalidateMany evicts a batch of ids in one go, see invalidator
+	InvalidateMany(ctx context.Context, ids []string) error
+	// Stats lists live entries (ids and expiry only) for the admin routes
+	Stats(ctx context.Context) (cacheStats, error)
+	// Flush drops every user entry
+	Flush(ctx context.Context) error
+}
+
+// maxStatsItems caps how many entries Stats lists, Entries still counts all of them
+const maxStatsItems = 1000
+
+// cacheStats is the GET /admin/cache/stats body. Keys only, never the cached users themselves.
+type cacheStats struct {
+	Entries   int              `json:"entries"`
+	Items     []cacheItemStats `json:"items"`
+	Truncated bool             `json:"truncated,omitempty"`
+}
+
+type cacheItemStats struct {
+	// Key is the tenant-scoped cache key, "<tenant>:<id>"
+	Key        string  `json:"key"`
+	TTLSeconds float64 `json:"ttlSeconds"`
+}
+
+// add counts one entry and lists it while under maxStatsItems
+func (s *cacheStats) add(key string, ttl time.Duration) {
+	s.Entries++
+	if len(s.Items) >= maxStatsItems {
+		s.Truncated = true
+		return
+	}
+	s.Items = append(s.Items, cacheItemStats{Key: key, TTLSeconds: ttl.Seconds()})
+}
+
+// newCache builds the cache selected by cfg.cacheBackend
+func newCache(cfg config) (Cache, error) {
+	// expired entries are only worth keeping if something will serve them
+	var staleFor time.Duration
+	if cfg.serveStaleOnError {
+		staleFor = cfg.staleRetention
+	}
+
+	switch cfg.cacheBackend {
+	case "memory":
+		c := newMemoryCache()
+		c.staleFor, c.maxAge = staleFor, cfg.cacheMaxAge
+		return c, nil
+	case "redis":
+		c, err := newRedisCache(cfg.redisURL)
+		if err != nil {
+			return nil, err
+		}
+		c.staleFor, c.maxAge = staleFor, cfg.cacheMaxAge
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.cacheBackend)
+	}
+}
+
+// The wrappers below key the cache by tenantKey(ctx, id), so each tenant has its own entries.
+
+// getUserFromCache gets a user (and its cache timing) from the cache
+func (a *api) getUserFromCache(ctx context.Context, id string) (cacheEntry, error) {
+	e, err := a.cache.Get(ctx, tenantKey(ctx, id))
+	countCacheLookup(ctx, err == nil)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
+		// a broken cache shouldn't break reads, the caller just falls through to the DB
+		log.Printf("cache get id=%s: %v", id, err)
+	}
+	return e, err
+}
+
+// setUserCache stores a user in the cache
+func (a *api) setUserCache(ctx context.Context, id string, u User, ttl time.Duration) {
+	if err := a.cache.Set(ctx, tenantKey(ctx, id), u, ttl); err != nil {
+		log.Printf("cache set id=%s: %v", id, err)
+	}
+}
+
+// refreshUserCache updates the cache after a write returned u, see cfg.cacheWriteMode
+func (a *api) refreshUserCache(ctx context.Context, u User) {
+	if a.cfg.cacheWriteMode == "repopulate" {
+		a.setUserCache(ctx, u.ID, u, a.cfg.cacheTTL)
+		return
+	}
+	a.invalidateUserCache(ctx, u.ID)
+}
+
+// invalidateUserCache queues a user for eviction, the invalidator applies it within cfg.invalidationWindow
+func (a *api) invalidateUserCache(ctx context.Context, id string) {
+	a.invalidations.enqueue(tenantKey(ctx, id))
+}
+
+// memoryCache is the per-process map cache
+type memoryCache struct {
+	mu      sync.RWMutex
+	entries map[string]cacheEntry
+	// staleFor keeps expired entries this long for GetStale
+	staleFor time.Duration
+	// maxAge hard-evicts entries this long after they were written, whatever their TTL and staleFor, 0 is off
+	maxAge time.Duration
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{entries: make(map[string]cacheEntry)}
+}
+
+func (c *memoryCache) Get(ctx context.Context, id string) (cacheEntry, error) {
+	now := time.Now()
+	c.mu.RLock()
+	entry, ok := c.entries[id]
+	expired := ok && now.After(entry.expiresAt)
+	c.mu.RUnlock()
 
 	if !ok {
-		return User{}, ErrCacheMiss
+		return cacheEntry{}, ErrCacheMiss
+	}
+	if entry.tooOld(c.maxAge, now) {
+		_ = c.Invalidate(ctx, id)
+		return cacheEntry{}, ErrCacheMiss
 	}
 
 	// Check if entry has expired
 	if expired {
-		// Entry expired, remove it and return cache miss
-		a.invalidateUserCache(id)
-		return User{}, ErrCacheMiss
+		// Entry expired, remove it (unless it's still kept for GetStale) and return cache miss
+		if now.After(entry.expiresAt.Add(c.staleFor)) {
+			_ = c.Invalidate(ctx, id)
+		}
+		return cacheEntry{}, ErrCacheMiss
 	}
 
-	return entry.user, nil
+	return entry, nil
 }
 
-// setUserCache stores a user in the cache
-func (a *api) setUserCache(id string, u User, ttl time.Duration) {
-	a.cacheMu.Lock()
-	a.cache[id] = cacheEntry{
+func (c *memoryCache) GetStale(ctx context.Context, id string) (cacheEntry, error) {
+	now := time.Now()
+	c.mu.RLock()
+	entry, ok := c.entries[id]
+	c.mu.RUnlock()
+
+	if !ok || now.After(entry.expiresAt.Add(c.staleFor)) {
+		return cacheEntry{}, ErrCacheMiss
+	}
+	if entry.tooOld(c.maxAge, now) {
+		_ = c.Invalidate(ctx, id)
+		return cacheEntry{}, ErrCacheMiss
+	}
+	return entry, nil
+}
+
+func (c *memoryCache) Set(ctx context.Context, id string, u User, ttl time.Duration) error {
+	now := time.Now()
+	c.mu.Lock()
+	c.entries[id] = cacheEntry{
 		user:      u,
-		expiresAt: time.Now().Add(ttl),
+		cachedAt:  now,
+		expiresAt: now.Add(ttl),
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) Invalidate(ctx context.Context, id string) error {
+	c.mu.Lock()
+	delete(c.entries, id)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) InvalidateMany(ctx context.Context, ids []string) error {
+	c.mu.Lock()
+	for _, id := range ids {
+		delete(c.entries, id)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) Stats(ctx context.Context) (cacheStats, error) {
+	now := time.Now()
+	stats := cacheStats{Items: []cacheItemStats{}}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for key, e := range c.entries {
+		// expired entries are only removed on the next Get, don't report them as live
+		if ttl := e.expiresAt.Sub(now); ttl > 0 && !e.tooOld(c.maxAge, now) {
+			stats.add(key, ttl)
+		}
 	}
-	a.cacheMu.Unlock()
+	return stats, nil
 }
 
-// invalidateUserCache removes a user from the cache
-func (a *api) invalidateUserCache(id string) {
-	a.cacheMu.Lock()
-	delete(a.cache, id)
-	a.cacheMu.Unlock()
+func (c *memoryCache) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	c.entries = make(map[string]cacheEntry)
+	c.mu.Unlock()
+	return nil
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestInvalidatorEvictsBatch(t *testing.T) {
+	ctx := context.Background()
+	cache := newMemoryCache()
+	inv := newInvalidator(cache, 50*time.Millisecond)
+
+	const n = 200
+	for i := range n {
+		_ = cache.Set(ctx, strconv.Itoa(i), User{ID: strconv.Itoa(i)}, time.Minute)
+	}
+
+	// every id twice, like two updates to the same user landing in one window
+	for range 2 {
+		for i := range n {
+			inv.enqueue(strconv.Itoa(i))
+		}
+	}
+
+	// close must flush what's still queued, even though the window hasn't elapsed
+	if err := inv.close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	for i := range n {
+		if _, err := cache.Get(ctx, strconv.Itoa(i)); !errors.Is(err, ErrCacheMiss) {
+			t.Fatalf("expected id %d to be evicted, got %v", i, err)
+		}
+	}
+}
+
+func TestInvalidatorAfterClose(t *testing.T) {
+	ctx := context.Background()
+	cache := newMemoryCache()
+	inv := newInvalidator(cache, time.Millisecond)
+	if err := inv.close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// late invalidations (e.g. from the LISTEN goroutine during shutdown) are applied inline
+	_ = cache.Set(ctx, "1", User{ID: "1"}, time.Minute)
+	inv.enqueue("1")
+	if _, err := cache.Get(ctx, "1"); !errors.Is(err, ErrCacheMiss) {
+		t.Fatalf("expected inline eviction after close, got %v", err)
+	}
+}
+
+func TestMemoryCacheStatsAndFlush(t *testing.T) {
+	ctx := context.Background()
+	cache := newMemoryCache()
+
+	_ = cache.Set(ctx, "1:1", User{ID: "1", FirstName: "James"}, time.Minute)
+	_ = cache.Set(ctx, "1:2", User{ID: "2"}, time.Minute)
+	_ = cache.Set(ctx, "1:3", User{ID: "3"}, -time.Second) // already expired
+
+	stats, err := cache.Stats(ctx)
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	if stats.Entries != 2 || len(stats.Items) != 2 {
+		t.Fatalf("expected 2 live entries, got %+v", stats)
+	}
+	for _, it := range stats.Items {
+		if it.TTLSeconds <= 0 || it.TTLSeconds > 60 {
+			t.Errorf("unexpected ttl for %s: %v", it.Key, it.TTLSeconds)
+		}
+	}
+
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if stats, _ := cache.Stats(ctx); stats.Entries != 0 {
+		t.Errorf("expected empty cache after flush, got %d entries", stats.Entries)
+	}
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	ctx := context.Background()
+	cfg := defaultConfig()
+	cfg.serveStaleOnError = true
+	cache := newMemoryCache()
+	cache.staleFor = time.Minute
+	a := newAPI(cfg, nil, cache)
+
+	// already expired, only GetStale can see it
+	_ = cache.Set(ctx, tenantKey(ctx, "1"), User{ID: "1"}, -time.Second)
+	if _, err := cache.Get(ctx, tenantKey(ctx, "1")); !errors.Is(err, ErrCacheMiss) {
+		t.Fatalf("Get on an expired entry: got %v, want ErrCacheMiss", err)
+	}
+
+	res, err := a.serveStale(ctx, "1", userLookup{source: "db"}, errors.New("connection refused"))
+	if err != nil || res.source != "stale" || res.user.ID != "1" {
+		t.Fatalf("serveStale = %+v, %v; want the stale user", res, err)
+	}
+
+	// a missing user is not a DB failure
+	if _, err := a.serveStale(ctx, "1", userLookup{source: "db"}, sql.ErrNoRows); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("ErrNoRows should pass through, got %v", err)
+	}
+
+	// nothing kept past the retention
+	cache.staleFor = 0
+	if _, err := a.serveStale(ctx, "1", userLookup{source: "db"}, errors.New("connection refused")); err == nil {
+		t.Error("expected the DB error once the entry is past its retention")
+	}
+}
+
+func TestRefreshUserCache(t *testing.T) {
+	ctx := context.Background()
+	for _, mode := range []string{"repopulate", "invalidate"} {
+		cfg := defaultConfig()
+		cfg.cacheWriteMode = mode
+		cache := newMemoryCache()
+		a := newAPI(cfg, nil, cache)
+		a.setUserCache(ctx, "1", User{ID: "1", FirstName: "old"}, time.Minute)
+
+		a.refreshUserCache(ctx, User{ID: "1", FirstName: "new"})
+		a.invalidations.close(ctx)
+
+		e, err := a.getUserFromCache(ctx, "1")
+		switch mode {
+		case "repopulate":
+			if err != nil || e.user.FirstName != "new" {
+				t.Errorf("repopulate: got %+v, %v; want the new user cached", e.user, err)
+			}
+		case "invalidate":
+			if !errors.Is(err, ErrCacheMiss) {
+				t.Errorf("invalidate: got %v, want ErrCacheMiss", err)
+			}
+		}
+	}
+}
+
+func TestChangedKeySkipsOwnNotifications(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+
+	if key, own := a.changedKey(a.instanceID + " 1:42"); key != "1:42" || !own {
+		t.Errorf("own payload: got %q, %v", key, own)
+	}
+	if key, own := a.changedKey("other-instance 1:42"); key != "1:42" || own {
+		t.Errorf("other payload: got %q, %v", key, own)
+	}
+	// payloads from replicas that predate the instance prefix are still honored
+	if key, own := a.changedKey("1:42"); key != "1:42" || own {
+		t.Errorf("bare payload: got %q, %v", key, own)
+	}
+}
+
+func TestMemoryCacheMaxAge(t *testing.T) {
+	ctx := context.Background()
+	cache := newMemoryCache()
+	cache.staleFor = time.Hour
+	cache.maxAge = time.Minute
+
+	// written two minutes ago with a long TTL: within TTL and stale retention, but past the max age
+	cache.entries["1:1"] = cacheEntry{user: User{ID: "1"}, cachedAt: time.Now().Add(-2 * time.Minute), expiresAt: time.Now().Add(time.Hour)}
+	if _, err := cache.GetStale(ctx, "1:1"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("GetStale past max age: got %v, want ErrCacheMiss", err)
+	}
+	if _, ok := cache.entries["1:1"]; ok {
+		t.Error("entry past max age should be evicted")
+	}
+
+	// a fresh Set starts the clock again
+	_ = cache.Set(ctx, "1:1", User{ID: "1"}, time.Hour)
+	if _, err := cache.Get(ctx, "1:1"); err != nil {
+		t.Errorf("Get after a fresh Set: %v", err)
+	}
+}
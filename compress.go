@@ -0,0 +1,229 @@
+// compress.go is response compression: br or gzip, whichever the client prefers, for responses worth it.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressionLevels maps COMPRESSION_LEVEL to each encoder's level. balanced is gzip's default and
+// brotli's usual choice for dynamic content, best is only worth it when CPU is cheaper than egress.
+var compressionLevels = map[string]struct{ gzip, brotli int }{
+	"fastest":  {gzip.BestSpeed, brotli.BestSpeed},
+	"balanced": {gzip.DefaultCompression, 5},
+	"best":     {gzip.BestCompression, brotli.BestCompression},
+}
+
+// supportedEncodings are the encodings COMPRESSION may list
+var supportedEncodings = map[string]bool{"br": true, "gzip": true}
+
+// negotiateEncoding picks the encoding from offered (server preference order) with the highest
+// Accept-Encoding quality, "" for identity. An explicit q=0 excludes an encoding, "*" covers the ones
+// not named, and on equal quality the server's order wins.
+func negotiateEncoding(acceptEncoding string, offered []string) string {
+	q := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				continue
+			}
+			quality = f
+		}
+		if name == "*" {
+			wildcard = quality
+		} else {
+			q[name] = quality
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range offered {
+		quality, ok := q[enc]
+		if !ok {
+			quality = wildcard
+		}
+		if quality > bestQ {
+			best, bestQ = enc, quality
+		}
+	}
+	return best
+}
+
+// incompressibleTypes are already compressed, another pass only costs CPU
+var incompressibleTypes = []string{"image/", "video/", "audio/", "application/zip", "application/gzip", "application/x-gzip"}
+
+// compressible reports whether a response with these headers should be compressed: not already encoded,
+// not a stream that relies on flushing, and not a type that's compressed already
+func compressible(h http.Header) bool {
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	ct, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if ct == "text/event-stream" {
+		return false
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(ct, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// compressWriter holds the status and the first minSize bytes back until it knows whether the response
+// is big enough to compress, then either starts the encoder or writes through unchanged.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	level    int
+	minSize  int
+
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	enc     io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status == 0 {
+		cw.status = code
+	}
+	// informational responses (103 Early Hints) go out as they come
+	if code < 200 {
+		cw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.decided {
+		cw.buf.Write(p)
+		if cw.buf.Len() < cw.minSize {
+			return len(p), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// decide sends the headers, compressing if big says the body reached minSize, then the buffered bytes
+func (cw *compressWriter) decide(big bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if big && cw.status != http.StatusNoContent && cw.status != http.StatusNotModified && compressible(h) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		if cw.encoding == "br" {
+			cw.enc = brotli.NewWriterLevel(cw.ResponseWriter, cw.level)
+		} else {
+			cw.enc, _ = gzip.NewWriterLevel(cw.ResponseWriter, cw.level) // level is one of compressionLevels
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf.Reset()
+	return err
+}
+
+// close ends the response: a body that never reached minSize goes out as is, an encoder is flushed
+func (cw *compressWriter) close() error {
+	if !cw.decided {
+		if cw.status == 0 {
+			return nil // nothing written, net/http sends its default 200
+		}
+		return cw.decide(false)
+	}
+	if cw.enc != nil {
+		return cw.enc.Close()
+	}
+	return nil
+}
+
+// FlushError is what http.ResponseController.Flush calls: whatever is held back goes out now.
+// Streams aren't compressed (see compressible), so an early flush just settles the decision.
+func (cw *compressWriter) FlushError() error {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if err := cw.decide(cw.buf.Len() >= cw.minSize); err != nil {
+			return err
+		}
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Hijack hands the connection over untouched, compression never started for an upgraded request
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer for everything else
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// compressMiddleware compresses responses of at least cfg.compressionMinSize bytes with the client's
+// preferred encoding from cfg.compression (COMPRESSION, "br,gzip" by default). Tiny bodies aren't worth
+// the bytes of framing, and already-encoded bodies, images and SSE streams are left alone.
+func (a *api) compressMiddleware(next http.Handler) http.Handler {
+	if len(a.cfg.compression) == 0 {
+		return next
+	}
+	levels := compressionLevels[a.cfg.compressionLevel]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), a.cfg.compression)
+		// HEAD has no body, an upgrade (WebSocket) takes over the connection
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, level: levels.gzip, minSize: a.cfg.compressionMinSize}
+		if encoding == "br" {
+			cw.level = levels.brotli
+		}
+		next.ServeHTTP(cw, r)
+		// not deferred: after a panic nothing held back should go out, recoverMiddleware answers 500 instead
+		_ = cw.close()
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	offered := []string{"br", "gzip"}
+	for accept, want := range map[string]string{
+		"":                         "",
+		"gzip":                     "gzip",
+		"gzip, deflate, br":        "br",
+		"br;q=0.5, gzip;q=0.8":     "gzip",
+		"br;q=0, gzip":             "gzip",
+		"*":                        "br",
+		"*;q=0.1, gzip;q=0":        "br",
+		"identity":                 "",
+		"deflate, GZIP;q=1.0":      "gzip",
+		"br;q=0, gzip;q=0, *;q=1":  "",
+		"gzip;q=0.5, br;q=invalid": "gzip",
+	} {
+		if got := negotiateEncoding(accept, offered); got != want {
+			t.Errorf("%q: got %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	big := strings.Repeat(`{"firstName":"James","lastName":"Bond"},`, 100)
+	serve := func(body, contentType, accept string) *httptest.ResponseRecorder {
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = io.WriteString(w, body)
+		})
+		r := httptest.NewRequest("GET", "/users", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		newAPI(defaultConfig(), nil, newMemoryCache()).compressMiddleware(h).ServeHTTP(w, r)
+		return w
+	}
+
+	for encoding, decode := range map[string]func(io.Reader) (io.Reader, error){
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	} {
+		w := serve(big, "application/json", encoding)
+		if w.Code != http.StatusCreated || w.Header().Get("Content-Encoding") != encoding || w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("%s: got %d %v", encoding, w.Code, w.Header())
+		}
+		if w.Body.Len() >= len(big) {
+			t.Errorf("%s: %d bytes, no smaller than the %d sent", encoding, w.Body.Len(), len(big))
+		}
+		dr, err := decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := io.ReadAll(dr); string(got) != big {
+			t.Errorf("%s: body didn't round-trip", encoding)
+		}
+	}
+
+	// tiny, already compressed, streaming, or not accepted: sent as is with the handler's status
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"tiny":         serve(`{"id":"1"}`, "application/json", "br"),
+		"image":        serve(big, "image/png", "br"),
+		"sse":          serve(big, "text/event-stream", "gzip"),
+		"not accepted": serve(big, "application/json", "identity"),
+	} {
+		if w.Code != http.StatusCreated || w.Header().Get("Content-Encoding") != "" || !strings.HasPrefix(w.Body.String(), `{"`) {
+			t.Errorf("%s: got %d Content-Encoding=%q", name, w.Code, w.Header().Get("Content-Encoding"))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// conditional.go implements If-Unmodified-Since on PATCH and DELETE /users/{id}.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errPreconditionFailed means the user changed after the client's If-Unmodified-Since, handlers map it to 412
+var errPreconditionFailed = errors.New("precondition failed")
+
+// ifUnmodifiedSince reads the If-Unmodified-Since header, the zero time means there's no precondition.
+// Per RFC 9110 an unparseable date is ignored rather than rejected.
+func ifUnmodifiedSince(r *http.Request) time.Time {
+	v := r.Header.Get("If-Unmodified-Since")
+	if v == "" {
+		return time.Time{}
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// checkUnmodifiedSince locks the user's row and fails with errPreconditionFailed if it was updated after since.
+// It runs inside the mutation's transaction so nothing can change the row between the check and the write.
+func (a *api) checkUnmodifiedSince(ctx context.Context, tx *sql.Tx, id any, since time.Time) error {
+	if since.IsZero() {
+		return nil
+	}
+
+	var updatedAt time.Time
+	err := a.queryRow(ctx, tx, "checkUnmodifiedSince",
+		`SELECT updated_at FROM users WHERE id = $1 AND tenant_id = $2 FOR UPDATE`,
+		id, GetTenantID(ctx),
+	).Scan(&updatedAt)
+	if err != nil {
+		return err
+	}
+	return checkUnmodified(updatedAt, since)
+}
+
+// checkUnmodified fails with errPreconditionFailed if updatedAt is after since, the zero since always passes
+func checkUnmodified(updatedAt, since time.Time) error {
+	// HTTP dates only have second precision, so compare at that resolution
+	if !since.IsZero() && updatedAt.Truncate(time.Second).After(since) {
+		return errPreconditionFailed
+	}
+	return nil
+}
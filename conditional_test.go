@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIfUnmodifiedSince(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Time
+	}{
+		{"", time.Time{}},
+		{"not a date", time.Time{}},
+		{"Fri, 01 Mar 2024 12:00:00 GMT", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("PATCH", "/users/1", nil)
+		if tt.header != "" {
+			r.Header.Set("If-Unmodified-Since", tt.header)
+		}
+		if got := ifUnmodifiedSince(r); !got.Equal(tt.want) {
+			t.Errorf("ifUnmodifiedSince(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
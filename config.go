@@ -0,0 +1,531 @@
+// config.go loads runtime settings from the environment (and .env when present).
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// config holds the settings read once at startup.
+type config struct {
+	addr string
+	// internalAddr is a second listener (INTERNAL_ADDR) for /metrics and /admin, which then leave addr.
+	// Empty serves everything on addr
+	internalAddr string
+	databaseURL  string
+	// readDatabaseURL points reads at a replica, empty means reads go to the primary
+	readDatabaseURL string
+	// shard2DatabaseURL is the second shard (SHARD_2_DATABASE_URL): users with ids from shardSplitID up live
+	// there, the rest on databaseURL. Empty means one database, see shard.go
+	shard2DatabaseURL string
+	shardSplitID      int64
+	// cacheBackend selects the user cache implementation: "memory" or "redis"
+	cacheBackend string
+	redisURL     string
+	// cacheTTL is how long a user stays cached, it's also the max-age sent to clients
+	cacheTTL time.Duration
+	// cacheWriteMode is what a write does to the written user's cache entry:
+	// "repopulate" stores the returned user (saves the cold read, fine for a single replica),
+	// "invalidate" evicts it so the next GET reloads from the DB
+	cacheWriteMode string
+	// serveStaleOnError answers GET /users/{id} from an expired cache entry when the DB read fails,
+	// staleRetention is how long past their TTL entries are kept around for that
+	serveStaleOnError bool
+	staleRetention    time.Duration
+	// cacheMaxAge hard-evicts entries this long after they were written, bounding how old a stale answer can be, 0 is off
+	cacheMaxAge time.Duration
+	// invalidationWindow is how long the invalidator collects evictions before applying them as one batch
+	invalidationWindow time.Duration
+	// stalenessSampleRate is the fraction (0-1) of cache hits that are checked against the DB for staleness
+	stalenessSampleRate float64
+	// listMaxAge is the Cache-Control max-age for GET /users, which isn't cached server-side
+	listMaxAge time.Duration
+	// recentCacheTTL is how long GET /users/recent is cached server-side (and its max-age), 0 disables the cache
+	recentCacheTTL time.Duration
+	// statsCacheTTL is the same for GET /users/stats/lastname and /users/stats/daily, GROUP BYs over the whole tenant
+	statsCacheTTL time.Duration
+	// similarityThreshold is the minimum pg_trgm similarity (0-1) for GET /users/similar
+	similarityThreshold float64
+	// defaultPageSize applies when GET /users has no limit, maxPageSize is the hard ceiling
+	defaultPageSize int
+	maxPageSize     int
+	// listOrder is what GET /users sorts by, a key of listOrders. id always breaks ties.
+	listOrder string
+	// requestTimeout is the handler deadline when the client doesn't send X-Request-Timeout,
+	// maxRequestTimeout caps whatever the client asks for
+	requestTimeout    time.Duration
+	maxRequestTimeout time.Duration
+	// workBudget is the fraction (0-1] of the request timeout handlers may spend on the DB and cache,
+	// the rest is kept for answering 503 instead of letting the client hit its own timeout
+	workBudget float64
+	// exportTimeout replaces the request timeout for GET /users/export.csv, which reads the whole table
+	exportTimeout time.Duration
+	// importTimeout is the same for POST /users/import, which can insert up to maxImportRows in one transaction
+	importTimeout time.Duration
+	// statementTimeout is the server-side statement_timeout every DB session starts with, a backstop for
+	// queries whose client-side cancel didn't land. Defaults to maxRequestTimeout plus a second, 0 disables it
+	statementTimeout time.Duration
+	// shutdownDrainInflight releases requests waiting on another request's fetch with a 503 as soon as
+	// shutdown starts, instead of leaving them to wait for a leader that Shutdown may be cutting short
+	shutdownDrainInflight bool
+	// pingTimeout bounds each DB ping of /health and /readyz, readyzPingAttempts is how many
+	// pings /readyz tries (with jittered backoff) before reporting the DB down
+	pingTimeout        time.Duration
+	readyzPingAttempts int
+	// slowQueryThreshold logs any statement slower than this, 0 disables it
+	slowQueryThreshold time.Duration
+	// logBodies turns on bodyLogMiddleware, logBodiesMax is how many bytes of each body it logs
+	logBodies    bool
+	logBodiesMax int
+	// strictQueryParams makes handlers reject query parameters they don't know with 400
+	strictQueryParams bool
+	// devRoutes enables diagnostic admin routes (GET /admin/db/indexes) and the X-Debug response headers,
+	// neither is meant for production
+	devRoutes bool
+	// forceHTTPS redirects (or rejects) requests a TLS-terminating proxy saw as plain HTTP and sends HSTS
+	forceHTTPS bool
+	// tlsCertFile and tlsKeyFile make the server speak TLS (and HTTP/2) itself, both empty serves plain HTTP.
+	// tlsMinVersion is the oldest TLS version accepted, a tls.VersionTLS* constant
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsMinVersion uint16
+	// compression is the response encodings offered, in the order preferred when the client likes them
+	// equally ("br,gzip"), empty turns compression off. compressionLevel is a compressionLevels key and
+	// compressionMinSize the smallest body (bytes) that gets compressed
+	compression        []string
+	compressionLevel   string
+	compressionMinSize int
+	// nonceTTL is how long an X-Nonce is remembered (and can't be reused), 0 turns replay protection off.
+	// nonceRequired rejects writes that don't send one
+	nonceTTL      time.Duration
+	nonceRequired bool
+	// maintenanceMode starts the process refusing writes, see maintenanceMiddleware
+	maintenanceMode bool
+	// trailingSlash is what happens to a path ending in "/" (other than the root): "redirect" (the default)
+	// answers 308 to the path without it, "rewrite" serves it as if it weren't there, "off" leaves it to 404
+	trailingSlash string
+	// maxConcurrentRequests is how many requests may run at once before the rest get a 503, 0 is unlimited
+	maxConcurrentRequests int
+	// adminToken is the bearer token for /admin routes, empty disables them
+	adminToken string
+	// connMaxLifetime and connMaxIdleTime recycle pool connections before Postgres or a proxy drops them
+	// underneath us (which shows up as driver: bad connection), 0 keeps them forever
+	connMaxLifetime time.Duration
+	connMaxIdleTime time.Duration
+	// dbAcquireTimeout bounds how long a statement waits for a pool connection, 0 leaves it to the request deadline
+	dbAcquireTimeout time.Duration
+	// idFormat is how User ids are written in JSON: "string" (the default) or "number", see numericIDs
+	idFormat string
+	// idType is the users.id column type: "bigserial" (the default) or "uuid", see uuidIDs.
+	// It only decides the type when the table is created
+	idType string
+	// nameUniqueness is "exact" (the default) or "case-insensitive": whether "James Bond" and "james bond"
+	// are the same name to the unique index and to name lookups
+	nameUniqueness string
+	// nameFormat is "any" (the default), whatever fits the length limit, or "letters": names may only hold
+	// letters, spaces, hyphens and apostrophes. See validateName
+	nameFormat string
+	// piiKey is the AES-256 key (PII_ENCRYPTION_KEY, base64) names are encrypted with, empty stores them in plaintext
+	piiKey []byte
+	// panicWebhookURL receives a JSON POST for every recovered panic, empty disables it
+	panicWebhookURL string
+	// requestIDHeader is the header the request id is read from and echoed in, e.g. X-Correlation-ID
+	requestIDHeader string
+	// phoneRegion is the country assumed for phone numbers given without a +country code
+	phoneRegion string
+}
+
+// defaultConfig is what you get with no env vars set (also used by the tests).
+func defaultConfig() config {
+	return config{
+		addr:           ":8080",
+		cacheBackend:   "memory",
+		cacheTTL:       30 * time.Second,
+		cacheWriteMode: "repopulate",
+		listMaxAge:     5 * time.Second,
+		recentCacheTTL: 5 * time.Second,
+		statsCacheTTL:  30 * time.Second,
+
+		staleRetention: 10 * time.Minute,
+
+		invalidationWindow:  10 * time.Millisecond,
+		stalenessSampleRate: 0.01,
+
+		similarityThreshold: 0.3,
+
+		defaultPageSize: 50,
+		maxPageSize:     200,
+		listOrder:       "id",
+
+		requestTimeout:    500 * time.Millisecond,
+		maxRequestTimeout: 5 * time.Second,
+		workBudget:        0.8,
+		exportTimeout:     time.Minute,
+		importTimeout:     time.Minute,
+
+		pingTimeout:        250 * time.Millisecond,
+		readyzPingAttempts: 2,
+
+		shutdownDrainInflight: true,
+		slowQueryThreshold:    100 * time.Millisecond,
+		connMaxLifetime:       30 * time.Minute,
+		connMaxIdleTime:       5 * time.Minute,
+		logBodiesMax:          2048,
+
+		requestIDHeader: "X-Request-ID",
+		idFormat:        "string",
+		idType:          "bigserial",
+		nameUniqueness:  "exact",
+		nameFormat:      "any",
+		tlsMinVersion:   tls.VersionTLS12,
+		trailingSlash:   "redirect",
+		phoneRegion:     "US",
+
+		compression:        []string{"br", "gzip"},
+		compressionLevel:   "balanced",
+		compressionMinSize: 1024,
+	}
+}
+
+func loadConfig() (config, error) {
+	_ = godotenv.Load() // loads .env into environment variables (safe to ignore error)
+
+	cfg := defaultConfig()
+	cfg.addr = envString("ADDR", cfg.addr)
+	cfg.internalAddr = os.Getenv("INTERNAL_ADDR")
+	if cfg.internalAddr != "" && cfg.internalAddr == cfg.addr {
+		return config{}, fmt.Errorf("INTERNAL_ADDR must differ from ADDR, got %q for both", cfg.addr)
+	}
+	cfg.databaseURL = os.Getenv("DATABASE_URL")
+	cfg.readDatabaseURL = os.Getenv("READ_DATABASE_URL")
+	cfg.shard2DatabaseURL = os.Getenv("SHARD_2_DATABASE_URL")
+	cfg.adminToken = os.Getenv("ADMIN_TOKEN")
+	cfg.cacheBackend = envString("CACHE_BACKEND", cfg.cacheBackend)
+	cfg.redisURL = os.Getenv("REDIS_URL")
+	cfg.cacheWriteMode = envString("CACHE_WRITE_MODE", cfg.cacheWriteMode)
+	if cfg.cacheWriteMode != "repopulate" && cfg.cacheWriteMode != "invalidate" {
+		return config{}, fmt.Errorf("CACHE_WRITE_MODE must be repopulate or invalidate, got %q", cfg.cacheWriteMode)
+	}
+	cfg.idFormat = envString("ID_FORMAT", cfg.idFormat)
+	if cfg.idFormat != "string" && cfg.idFormat != "number" {
+		return config{}, fmt.Errorf("ID_FORMAT must be string or number, got %q", cfg.idFormat)
+	}
+	cfg.idType = envString("ID_TYPE", cfg.idType)
+	if cfg.idType != "bigserial" && cfg.idType != "uuid" {
+		return config{}, fmt.Errorf("ID_TYPE must be bigserial or uuid, got %q", cfg.idType)
+	}
+	if cfg.idType == "uuid" && cfg.idFormat == "number" {
+		return config{}, fmt.Errorf("ID_FORMAT=number needs ID_TYPE=bigserial, a uuid isn't a number")
+	}
+	cfg.phoneRegion = envString("PHONE_DEFAULT_REGION", cfg.phoneRegion)
+	cfg.requestIDHeader = envString("REQUEST_ID_HEADER", cfg.requestIDHeader)
+	cfg.panicWebhookURL = os.Getenv("PANIC_WEBHOOK_URL")
+
+	var err error
+	if v := os.Getenv("PII_ENCRYPTION_KEY"); v != "" {
+		if cfg.piiKey, err = base64.StdEncoding.DecodeString(v); err != nil || len(cfg.piiKey) != 32 {
+			return config{}, fmt.Errorf("PII_ENCRYPTION_KEY must be 32 bytes, base64 encoded")
+		}
+	}
+	if v := os.Getenv("SHARD_SPLIT_ID"); v != "" {
+		if cfg.shardSplitID, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.shardSplitID < 2 {
+			return config{}, fmt.Errorf("SHARD_SPLIT_ID must be an id above 1, got %q", v)
+		}
+	}
+	if (cfg.shard2DatabaseURL == "") != (cfg.shardSplitID == 0) {
+		return config{}, fmt.Errorf("SHARD_2_DATABASE_URL and SHARD_SPLIT_ID must be set together")
+	}
+	if cfg.shardSplitID != 0 && cfg.readDatabaseURL != "" {
+		return config{}, fmt.Errorf("READ_DATABASE_URL can't be used with SHARD_2_DATABASE_URL yet, shards have no replicas")
+	}
+	if cfg.shardSplitID != 0 && cfg.idType == "uuid" {
+		return config{}, fmt.Errorf("ID_TYPE=uuid can't be used with SHARD_2_DATABASE_URL, shards split by id range")
+	}
+	if cfg.shardSplitID != 0 && cfg.piiKey != nil {
+		return config{}, fmt.Errorf("PII_ENCRYPTION_KEY can't be used with SHARD_2_DATABASE_URL yet, shards merge on plaintext names")
+	}
+	if cfg.cacheTTL, err = envDuration("CACHE_TTL", cfg.cacheTTL); err != nil {
+		return config{}, err
+	}
+	if cfg.serveStaleOnError, err = envBool("SERVE_STALE_ON_ERROR", cfg.serveStaleOnError); err != nil {
+		return config{}, err
+	}
+	if cfg.staleRetention, err = envDuration("CACHE_STALE_RETENTION", cfg.staleRetention); err != nil {
+		return config{}, err
+	}
+	if cfg.cacheMaxAge, err = envDuration("CACHE_MAX_AGE", cfg.cacheMaxAge); err != nil {
+		return config{}, err
+	}
+	if cfg.cacheMaxAge < 0 {
+		return config{}, fmt.Errorf("CACHE_MAX_AGE can't be negative")
+	}
+	if cfg.listMaxAge, err = envDuration("LIST_CACHE_MAX_AGE", cfg.listMaxAge); err != nil {
+		return config{}, err
+	}
+	if cfg.recentCacheTTL, err = envDuration("RECENT_CACHE_TTL", cfg.recentCacheTTL); err != nil {
+		return config{}, err
+	}
+	if cfg.statsCacheTTL, err = envDuration("STATS_CACHE_TTL", cfg.statsCacheTTL); err != nil {
+		return config{}, err
+	}
+	if cfg.invalidationWindow, err = envDuration("CACHE_INVALIDATION_WINDOW", cfg.invalidationWindow); err != nil {
+		return config{}, err
+	}
+	if cfg.stalenessSampleRate, err = envFloat("CACHE_STALENESS_SAMPLE_RATE", cfg.stalenessSampleRate); err != nil {
+		return config{}, err
+	}
+	if cfg.stalenessSampleRate < 0 || cfg.stalenessSampleRate > 1 {
+		return config{}, fmt.Errorf("CACHE_STALENESS_SAMPLE_RATE must be between 0 and 1")
+	}
+	if cfg.similarityThreshold, err = envFloat("SIMILARITY_THRESHOLD", cfg.similarityThreshold); err != nil {
+		return config{}, err
+	}
+	if cfg.similarityThreshold < 0 || cfg.similarityThreshold > 1 {
+		return config{}, fmt.Errorf("SIMILARITY_THRESHOLD must be between 0 and 1")
+	}
+	if cfg.requestTimeout, err = envDuration("REQUEST_TIMEOUT", cfg.requestTimeout); err != nil {
+		return config{}, err
+	}
+	if cfg.maxRequestTimeout, err = envDuration("MAX_REQUEST_TIMEOUT", cfg.maxRequestTimeout); err != nil {
+		return config{}, err
+	}
+	if cfg.exportTimeout, err = envDuration("EXPORT_TIMEOUT", cfg.exportTimeout); err != nil {
+		return config{}, err
+	}
+	if cfg.importTimeout, err = envDuration("IMPORT_TIMEOUT", cfg.importTimeout); err != nil {
+		return config{}, err
+	}
+	if cfg.requestTimeout <= 0 || cfg.maxRequestTimeout <= 0 {
+		return config{}, fmt.Errorf("REQUEST_TIMEOUT and MAX_REQUEST_TIMEOUT must be positive")
+	}
+	// just above the longest request so the context always fires first and statement_timeout only catches leaks
+	cfg.statementTimeout = cfg.maxRequestTimeout + time.Second
+	if cfg.statementTimeout, err = envDuration("DB_STATEMENT_TIMEOUT", cfg.statementTimeout); err != nil {
+		return config{}, err
+	}
+	if cfg.statementTimeout < 0 {
+		return config{}, fmt.Errorf("DB_STATEMENT_TIMEOUT must not be negative")
+	}
+	if cfg.workBudget, err = envFloat("REQUEST_WORK_BUDGET", cfg.workBudget); err != nil {
+		return config{}, err
+	}
+	if cfg.workBudget <= 0 || cfg.workBudget > 1 {
+		return config{}, fmt.Errorf("REQUEST_WORK_BUDGET must be greater than 0 and at most 1")
+	}
+	if cfg.slowQueryThreshold, err = envDuration("SLOW_QUERY_THRESHOLD", cfg.slowQueryThreshold); err != nil {
+		return config{}, err
+	}
+	if cfg.connMaxLifetime, err = envDuration("DB_CONN_MAX_LIFETIME", cfg.connMaxLifetime); err != nil {
+		return config{}, err
+	}
+	if cfg.connMaxIdleTime, err = envDuration("DB_CONN_MAX_IDLE_TIME", cfg.connMaxIdleTime); err != nil {
+		return config{}, err
+	}
+	if cfg.connMaxLifetime < 0 || cfg.connMaxIdleTime < 0 {
+		return config{}, fmt.Errorf("DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME can't be negative")
+	}
+	if cfg.dbAcquireTimeout, err = envDuration("DB_ACQUIRE_TIMEOUT", cfg.dbAcquireTimeout); err != nil {
+		return config{}, err
+	}
+	if cfg.dbAcquireTimeout < 0 {
+		return config{}, fmt.Errorf("DB_ACQUIRE_TIMEOUT can't be negative")
+	}
+	if cfg.pingTimeout, err = envDuration("HEALTH_PING_TIMEOUT", cfg.pingTimeout); err != nil {
+		return config{}, err
+	}
+	if cfg.readyzPingAttempts, err = envInt("READYZ_PING_ATTEMPTS", cfg.readyzPingAttempts); err != nil {
+		return config{}, err
+	}
+	// a zero timeout fails every ping and zero attempts never pings, either way the probes always fail
+	if cfg.pingTimeout <= 0 {
+		return config{}, fmt.Errorf("HEALTH_PING_TIMEOUT must be positive")
+	}
+	if cfg.readyzPingAttempts < 1 {
+		return config{}, fmt.Errorf("READYZ_PING_ATTEMPTS must be at least 1")
+	}
+	if cfg.shutdownDrainInflight, err = envBool("SHUTDOWN_DRAIN_INFLIGHT", cfg.shutdownDrainInflight); err != nil {
+		return config{}, err
+	}
+	if cfg.devRoutes, err = envBool("DEV_ROUTES", cfg.devRoutes); err != nil {
+		return config{}, err
+	}
+	if cfg.forceHTTPS, err = envBool("FORCE_HTTPS", cfg.forceHTTPS); err != nil {
+		return config{}, err
+	}
+	if cfg.maintenanceMode, err = envBool("MAINTENANCE_MODE", cfg.maintenanceMode); err != nil {
+		return config{}, err
+	}
+	if cfg.nonceTTL, err = envDuration("NONCE_TTL", cfg.nonceTTL); err != nil {
+		return config{}, err
+	}
+	if cfg.nonceRequired, err = envBool("NONCE_REQUIRED", cfg.nonceRequired); err != nil {
+		return config{}, err
+	}
+	if cfg.nonceTTL < 0 || (cfg.nonceRequired && cfg.nonceTTL == 0) {
+		return config{}, fmt.Errorf("NONCE_TTL must be positive when set, and NONCE_REQUIRED needs it")
+	}
+	cfg.tlsCertFile = os.Getenv("TLS_CERT_FILE")
+	cfg.tlsKeyFile = os.Getenv("TLS_KEY_FILE")
+	if (cfg.tlsCertFile == "") != (cfg.tlsKeyFile == "") {
+		return config{}, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	switch v := envString("TLS_MIN_VERSION", "1.2"); v {
+	case "1.2":
+		cfg.tlsMinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.tlsMinVersion = tls.VersionTLS13
+	default:
+		return config{}, fmt.Errorf("TLS_MIN_VERSION must be 1.2 or 1.3, got %q", v)
+	}
+	if v, ok := os.LookupEnv("COMPRESSION"); ok {
+		cfg.compression = nil
+		for _, enc := range strings.Split(v, ",") {
+			if enc = strings.TrimSpace(enc); enc == "" || enc == "off" {
+				continue
+			}
+			if !supportedEncodings[enc] {
+				return config{}, fmt.Errorf("COMPRESSION must list br and/or gzip (or be off), got %q", enc)
+			}
+			cfg.compression = append(cfg.compression, enc)
+		}
+	}
+	cfg.compressionLevel = envString("COMPRESSION_LEVEL", cfg.compressionLevel)
+	if _, ok := compressionLevels[cfg.compressionLevel]; !ok {
+		return config{}, fmt.Errorf("COMPRESSION_LEVEL must be fastest, balanced or best, got %q", cfg.compressionLevel)
+	}
+	if cfg.compressionMinSize, err = envInt("COMPRESSION_MIN_SIZE", cfg.compressionMinSize); err != nil {
+		return config{}, err
+	}
+	if cfg.compressionMinSize < 0 {
+		return config{}, fmt.Errorf("COMPRESSION_MIN_SIZE can't be negative")
+	}
+	cfg.trailingSlash = envString("TRAILING_SLASH", cfg.trailingSlash)
+	if cfg.trailingSlash != "redirect" && cfg.trailingSlash != "rewrite" && cfg.trailingSlash != "off" {
+		return config{}, fmt.Errorf("TRAILING_SLASH must be redirect, rewrite or off, got %q", cfg.trailingSlash)
+	}
+	if cfg.maxConcurrentRequests, err = envInt("MAX_CONCURRENT_REQUESTS", cfg.maxConcurrentRequests); err != nil {
+		return config{}, err
+	}
+	if cfg.maxConcurrentRequests < 0 {
+		return config{}, fmt.Errorf("MAX_CONCURRENT_REQUESTS can't be negative")
+	}
+	if cfg.strictQueryParams, err = envBool("STRICT_QUERY_PARAMS", cfg.strictQueryParams); err != nil {
+		return config{}, err
+	}
+	if cfg.logBodies, err = envBool("LOG_BODIES", cfg.logBodies); err != nil {
+		return config{}, err
+	}
+	if cfg.logBodiesMax, err = envInt("LOG_BODIES_MAX_BYTES", cfg.logBodiesMax); err != nil {
+		return config{}, err
+	}
+	if cfg.logBodiesMax < 0 {
+		return config{}, fmt.Errorf("LOG_BODIES_MAX_BYTES must not be negative")
+	}
+	if cfg.defaultPageSize, err = envInt("DEFAULT_PAGE_SIZE", cfg.defaultPageSize); err != nil {
+		return config{}, err
+	}
+	if cfg.maxPageSize, err = envInt("MAX_PAGE_SIZE", cfg.maxPageSize); err != nil {
+		return config{}, err
+	}
+	if cfg.defaultPageSize < 1 || cfg.maxPageSize < 1 {
+		return config{}, fmt.Errorf("DEFAULT_PAGE_SIZE and MAX_PAGE_SIZE must be positive")
+	}
+	cfg.listOrder = envString("LIST_ORDER", cfg.listOrder)
+	if _, ok := listOrders[cfg.listOrder]; !ok {
+		return config{}, fmt.Errorf("LIST_ORDER must be id, lastName, createdAt or phone, got %q", cfg.listOrder)
+	}
+	if cfg.listOrder == "lastName" && cfg.piiKey != nil {
+		return config{}, fmt.Errorf("LIST_ORDER=lastName can't be used with PII_ENCRYPTION_KEY, encrypted names don't sort")
+	}
+	cfg.nameUniqueness = envString("NAME_UNIQUENESS", cfg.nameUniqueness)
+	if cfg.nameUniqueness != "exact" && cfg.nameUniqueness != "case-insensitive" {
+		return config{}, fmt.Errorf("NAME_UNIQUENESS must be exact or case-insensitive, got %q", cfg.nameUniqueness)
+	}
+	if cfg.caseInsensitiveNames() && cfg.piiKey != nil {
+		return config{}, fmt.Errorf("NAME_UNIQUENESS=case-insensitive can't be used with PII_ENCRYPTION_KEY, name_hash is computed from the exact name")
+	}
+	cfg.nameFormat = envString("NAME_FORMAT", cfg.nameFormat)
+	if cfg.nameFormat != "letters" && cfg.nameFormat != "any" {
+		return config{}, fmt.Errorf("NAME_FORMAT must be letters or any, got %q", cfg.nameFormat)
+	}
+
+	if cfg.databaseURL == "" {
+		return config{}, fmt.Errorf("DATABASE_URL is not set")
+	}
+	if cfg.cacheBackend == "redis" && cfg.redisURL == "" {
+		return config{}, fmt.Errorf("CACHE_BACKEND=redis requires REDIS_URL")
+	}
+	return cfg, nil
+}
+
+// envString returns the env var or def when it's unset/empty.
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration parses the env var as a time.Duration ("30s", "250ms"), def when unset.
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
+
+// envInt parses the env var as an int, def when unset.
+func envInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
+// envFloat parses the env var as a float64, def when unset.
+func envFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return f, nil
+}
+
+// envBool parses the env var as a bool ("true", "1", ...), def when unset.
+func envBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	return b, nil
+}
+
+// caseInsensitiveNames reports whether names that differ only in case are the same name
+func (c config) caseInsensitiveNames() bool {
+	return c.nameUniqueness == "case-insensitive"
+}
@@ -0,0 +1,388 @@
+// csv.go implements the spreadsheet export and import of the users table.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var csvHeader = []string{"id", "firstName", "lastName", "createdAt"}
+
+// exportUsersCSVHandler streams every user of the tenant as CSV straight from the DB cursor.
+// It gets cfg.exportTimeout instead of the usual request timeout since it reads the whole table.
+// A failure part way through can't be reported once rows have been sent, the file just ends early
+// (and the error is logged).
+func (a *api) exportUsersCSVHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.exportTimeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return
+	}
+
+	// limit 0 = no LIMIT, the export is the whole table. The query runs for as long as the file takes to
+	// send, so it gets the export's timeout rather than DB_STATEMENT_TIMEOUT.
+	err := a.streamUsers(ctx, listParams{statementTimeout: a.cfg.exportTimeout}, func(u User) error {
+		return cw.Write([]string{u.ID, u.FirstName, u.LastName, u.CreatedAt.Format(time.RFC3339)})
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		log.Printf("csv export request_id=%s: %v", GetRequestID(ctx), err)
+	}
+}
+
+// maxImportBytes and maxImportRows cap one POST /users/import
+const (
+	maxImportBytes = 5 << 20
+	maxImportRows  = 10000
+)
+
+// errImportTooLarge is the 413 for a body over maxImportBytes
+var errImportTooLarge = &APIError{Status: http.StatusRequestEntityTooLarge, Code: "too_large", Message: "file too large"}
+
+// importRow is one parsed CSV data row, line is its line number in the file (the header is line 1)
+type importRow struct {
+	line int
+	req  createUserRequest
+}
+
+// importResult reports what happened to one row, index is its position among the data rows (from 0)
+type importResult struct {
+	Index  int    `json:"index"`
+	Line   int    `json:"line"`
+	Status string `json:"status"` // "created" or "error"
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// importCSVError is a problem with the file itself rather than a row, it fails the whole import with 400
+type importCSVError struct{ msg string }
+
+func (e importCSVError) Error() string { return e.msg }
+
+// parseImportCSV reads a header row naming the columns (firstName, lastName, optional phone, any order)
+// followed by up to maxRows data rows. Malformed CSV reports the line it broke on.
+func parseImportCSV(rd io.Reader, maxRows int) ([]importRow, error) {
+	cr := csv.NewReader(rd)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, importCSVError{"empty file, expected a header row"}
+	}
+	if err != nil {
+		return nil, importCSVError{"malformed csv: " + err.Error()}
+	}
+
+	col := map[string]int{}
+	for i, name := range header {
+		switch name = strings.TrimSpace(name); name {
+		case "firstName", "lastName", "phone":
+			col[name] = i
+		default:
+			return nil, importCSVError{fmt.Sprintf("line 1: unknown column %q", name)}
+		}
+	}
+	if _, ok := col["firstName"]; !ok {
+		return nil, importCSVError{"line 1: missing firstName column"}
+	}
+	if _, ok := col["lastName"]; !ok {
+		return nil, importCSVError{"line 1: missing lastName column"}
+	}
+
+	var rows []importRow
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, importCSVError{"malformed csv: " + err.Error()}
+		}
+		if len(rows) == maxRows {
+			return nil, importCSVError{fmt.Sprintf("too many rows, at most %d per import", maxRows)}
+		}
+
+		line, _ := cr.FieldPos(0)
+		row := importRow{line: line}
+		row.req.FirstName = strings.TrimSpace(rec[col["firstName"]])
+		row.req.LastName = strings.TrimSpace(rec[col["lastName"]])
+		if i, ok := col["phone"]; ok {
+			if phone := strings.TrimSpace(rec[i]); phone != "" {
+				row.req.Phone = &phone
+			}
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, importCSVError{"no rows to import"}
+	}
+	return rows, nil
+}
+
+// importBody returns the CSV to import: the "file" part of a multipart upload or a raw text/csv body
+func importBody(r *http.Request) (io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(maxImportBytes); err != nil {
+			return nil, err
+		}
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, importCSVError{"multipart upload needs a \"file\" part"}
+		}
+		return f, nil
+	case "text/csv":
+		return r.Body, nil
+	default:
+		return nil, nil
+	}
+}
+
+// import modes, chosen with ?mode=
+const (
+	importTransactional = "transactional"
+	importBestEffort    = "best-effort"
+)
+
+// importUsersHandler loads users from CSV. By default the import is all-or-nothing: every row is
+// validated and inserted in one transaction, and if any row fails nothing is committed. The response
+// lists every row's outcome either way, 201 when committed and 422 when not.
+// With ?mode=best-effort each valid row is inserted on its own and the response is a 207 with every row's outcome.
+func (a *api) importUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r, "mode") {
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = importTransactional
+	}
+	if mode != importTransactional && mode != importBestEffort {
+		writeError(w, &ValidationError{Field: "mode", Message: "mode must be transactional or best-effort"})
+		return
+	}
+
+	// imports can be thousands of rows, give them their own timeout rather than the request one
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.importTimeout)
+	defer cancel()
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	body, err := importBody(r)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, errImportTooLarge)
+			return
+		}
+		writeError(w, &ValidationError{Field: "file", Message: err.Error()})
+		return
+	}
+	if body == nil {
+		writeError(w, &APIError{Status: http.StatusUnsupportedMediaType, Code: "unsupported_media_type", Message: "expected text/csv or multipart/form-data"})
+		return
+	}
+
+	rows, err := parseImportCSV(body, maxImportRows)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, errImportTooLarge)
+			return
+		}
+		writeError(w, &ValidationError{Field: "file", Message: err.Error()})
+		return
+	}
+
+	if mode == importBestEffort {
+		results, created := a.importUsersBestEffort(ctx, rows)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+		_ = json.NewEncoder(w).Encode(map[string]any{"created": created, "failed": len(results) - created, "results": results})
+		return
+	}
+
+	results, committed, err := a.importUsers(ctx, rows)
+	if err != nil {
+		writeError(w, failed("failed to import users", err))
+		return
+	}
+
+	status := http.StatusCreated
+	if !committed {
+		status = http.StatusUnprocessableEntity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"committed": committed, "results": results})
+}
+
+// importUsers validates and inserts rows in one transaction, each behind a savepoint so a duplicate
+// is recorded against its row without aborting the rest. Commits only if every row succeeded.
+// err is only for failures of the import itself (DB down, timeout), not for bad rows.
+func (a *api) importUsers(ctx context.Context, rows []importRow) (results []importResult, committed bool, err error) {
+	ctx, span := tracer.Start(ctx, "importUsers", trace.WithAttributes(attribute.Int("import.rows", len(rows))))
+	defer func() { finishSpan(span, err) }()
+
+	results = make([]importResult, len(rows))
+	failed := 0
+	fail := func(i int, msg string) {
+		results[i] = importResult{Index: i, Line: rows[i].line, Status: "error", Error: msg}
+		failed++
+	}
+
+	var created []User
+	// as long as the import's own timeout, the per-request DB_STATEMENT_TIMEOUT would cut a big one short
+	err = withStatementTimeout(ctx, a.writeDB(), a.cfg.importTimeout, func(tx *sql.Tx) error {
+		for i, row := range rows {
+			phone, msg := a.checkImportRow(&row)
+			if msg != "" {
+				fail(i, msg)
+				continue
+			}
+
+			// taken on a shard this transaction can't see, see findOnOtherShards
+			if _, found, err := a.findOnOtherShards(ctx, row.req.FirstName, row.req.LastName); err != nil {
+				return err
+			} else if found {
+				fail(i, "duplicate")
+				continue
+			}
+
+			if _, err := a.exec(ctx, tx, "import.savepoint", `SAVEPOINT import_row`); err != nil {
+				return err
+			}
+			u, err := a.insertUser(ctx, tx, row.req.FirstName, row.req.LastName, phone)
+			if isUniqueViolation(err) {
+				if _, err := a.exec(ctx, tx, "import.rollback", `ROLLBACK TO SAVEPOINT import_row`); err != nil {
+					return err
+				}
+				fail(i, "duplicate")
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			// every savepoint left open is a subtransaction until commit, thousands of them would overflow
+			// Postgres' per-backend subtransaction cache and slow the whole server down
+			if _, err := a.exec(ctx, tx, "import.release", `RELEASE SAVEPOINT import_row`); err != nil {
+				return err
+			}
+			results[i] = importResult{Index: i, Line: row.line, Status: "created", ID: u.ID}
+			created = append(created, u)
+		}
+
+		if failed > 0 {
+			return errImportRejected
+		}
+		return nil
+	})
+	if errors.Is(err, errImportRejected) {
+		// nothing was committed, so no row actually got an id
+		for i := range results {
+			if results[i].Status == "created" {
+				results[i] = importResult{Index: i, Line: results[i].Line, Status: "ok"}
+			}
+		}
+		span.SetAttributes(attribute.Int("import.failed", failed))
+		return results, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, u := range created {
+		a.events.publish(userEvent{Type: eventCreated, ID: u.ID, TenantID: GetTenantID(ctx)})
+	}
+	span.SetAttributes(attribute.Int("import.created", len(created)))
+	return results, true, nil
+}
+
+// errImportRejected rolls back the import transaction when at least one row failed
+var errImportRejected = errors.New("import rejected")
+
+// checkImportRow normalizes a row's names in place, validates it and normalizes its phone.
+// msg is the row's error, empty if it's valid.
+func (a *api) checkImportRow(row *importRow) (phone *string, msg string) {
+	if err := row.req.normalizeNames(); err != nil {
+		return nil, err.Error()
+	}
+	if err := validate.Struct(row.req); err != nil {
+		return nil, formatValidationErrors(validationErrors(err))
+	}
+	if err := a.validateNames(row.req); err != nil {
+		return nil, err.Error()
+	}
+	if row.req.Phone != nil {
+		p, err := normalizePhone(*row.req.Phone, a.cfg.phoneRegion)
+		if err != nil {
+			return nil, "phone: e164"
+		}
+		phone = &p
+	}
+	return phone, ""
+}
+
+// importUsersBestEffort inserts every valid row on its own, outside any transaction, so one bad row
+// doesn't cost the others. A row that fails for a reason other than its data (DB error) is reported
+// as "internal error", and once ctx is done the rows not yet tried are reported as "timeout".
+func (a *api) importUsersBestEffort(ctx context.Context, rows []importRow) (results []importResult, created int) {
+	ctx, span := tracer.Start(ctx, "importUsersBestEffort", trace.WithAttributes(attribute.Int("import.rows", len(rows))))
+	defer span.End()
+
+	results = make([]importResult, len(rows))
+	for i, row := range rows {
+		results[i] = importResult{Index: i, Line: row.line, Status: "error"}
+		if ctx.Err() != nil {
+			results[i].Error = "timeout"
+			continue
+		}
+
+		phone, msg := a.checkImportRow(&row)
+		if msg != "" {
+			results[i].Error = msg
+			continue
+		}
+		u, err := a.createUser(ctx, row.req.FirstName, row.req.LastName, phone)
+		switch {
+		case errors.Is(err, ErrDuplicateUser):
+			results[i].Error = "duplicate"
+		case err != nil:
+			log.Printf("import row failed request_id=%s line=%d err=%v", GetRequestID(ctx), row.line, err)
+			results[i].Error = "internal error"
+		default:
+			results[i] = importResult{Index: i, Line: row.line, Status: "created", ID: u.ID}
+			created++
+		}
+	}
+
+	span.SetAttributes(attribute.Int("import.created", created), attribute.Int("import.failed", len(rows)-created))
+	return results, created
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseImportCSV(t *testing.T) {
+	rows, err := parseImportCSV(strings.NewReader(
+		"lastName,firstName,phone\n"+
+			"Bond,James,+14155552671\n"+
+			"\"Moneypenny\",Eve,\n"), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(rows))
+	}
+
+	first := rows[0]
+	if first.line != 2 || first.req.FirstName != "James" || first.req.LastName != "Bond" ||
+		first.req.Phone == nil || *first.req.Phone != "+14155552671" {
+		t.Errorf("unexpected first row: line=%d %+v", first.line, first.req)
+	}
+	if rows[1].line != 3 || rows[1].req.Phone != nil {
+		t.Errorf("expected line 3 without phone, got line=%d phone=%v", rows[1].line, rows[1].req.Phone)
+	}
+}
+
+func TestParseImportCSVErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"empty", "", "empty file"},
+		{"missing column", "firstName\nJames\n", "missing lastName column"},
+		{"unknown column", "firstName,lastName,email\n", `unknown column "email"`},
+		{"no rows", "firstName,lastName\n", "no rows"},
+		{"malformed", "firstName,lastName\nJames,Bond\nEve,\"Money\"penny\n", "line 3"},
+		{"ragged", "firstName,lastName\nJames\n", "line 2"},
+		{"too many rows", "firstName,lastName\na,b\nc,d\ne,f\n", "too many rows"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseImportCSV(strings.NewReader(tt.body), 2)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestImportMode(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	serve := func(mode string) *httptest.ResponseRecorder {
+		// no row is valid, so nothing reaches the DB
+		r := httptest.NewRequest("POST", "/users/import?mode="+mode, strings.NewReader("firstName,lastName\nJames,\n,Bond\n"))
+		r.Header.Set("Content-Type", "text/csv")
+		w := httptest.NewRecorder()
+		route(a).ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("sometimes"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown mode: got %d, want 400", w.Code)
+	}
+
+	w := serve(importBestEffort)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("best-effort: got %d, want 207: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Created int            `json:"created"`
+		Failed  int            `json:"failed"`
+		Results []importResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Created != 0 || body.Failed != 2 || len(body.Results) != 2 {
+		t.Fatalf("best-effort: got %+v, want 2 failed rows", body)
+	}
+	for i, res := range body.Results {
+		if res.Index != i || res.Line != i+2 || res.Status != "error" || res.Error == "" {
+			t.Errorf("result %d = %+v, want an error for line %d", i, res, i+2)
+		}
+	}
+}
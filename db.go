@@ -1,26 +1,30 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
-	"os"
+	"strconv"
+	"time"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
-	"github.com/joho/godotenv"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 )
 
-func openDB() *sql.DB {
-	_ = godotenv.Load() // loads .env into environment variables (safe to ignore error)
-
-	dsn := os.Getenv("DATABASE_URL")
-	if dsn == "" {
-		log.Fatal("DATABASE_URL is not set")
-	}
-
-	db, err := sql.Open("pgx", dsn)
+// openDB opens and pings a pool for dsn, used for both the primary and the read replica.
+// Every connection starts with statement_timeout set to cfg.statementTimeout, see withStatementTimeout.
+func openDB(dsn string, cfg config) *sql.DB {
+	connConfig, err := pgx.ParseConfig(dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if cfg.statementTimeout > 0 {
+		connConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(cfg.statementTimeout.Milliseconds(), 10)
+	}
+	db := stdlib.OpenDB(*connConfig)
+	db.SetConnMaxLifetime(cfg.connMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.connMaxIdleTime)
 
 	if err := db.Ping(); err != nil {
 		log.Fatal(err)
@@ -29,17 +33,87 @@ func openDB() *sql.DB {
 	return db
 }
 
-func initSchema(db *sql.DB) error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS users (
-		id BIGSERIAL PRIMARY KEY,
-		first_name TEXT NOT NULL,
-		last_name  TEXT NOT NULL,
-		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-		UNIQUE(first_name, last_name)
-	);
+// lowerNamesIndex enforces NAME_UNIQUENESS=case-insensitive
+const lowerNamesIndex = "users_tenant_id_lower_first_name_lower_last_name_key"
+
+// initSchema runs the pending migrations (see migrate.go), then the parts of the schema that depend on
+// the config or the server rather than on a version: the case-insensitive names index and pg_trgm.
+func initSchema(db *sql.DB, caseInsensitiveNames bool) error {
+	if _, err := migrate(context.Background(), db); err != nil {
+		return err
+	}
+	if err := checkIDType(context.Background(), db); err != nil {
+		return err
+	}
+
+	// schema changes can take a while on a big table, DB_STATEMENT_TIMEOUT is for requests
+	exec := func(query string) error {
+		return withStatementTimeout(context.Background(), db, 0, func(tx *sql.Tx) error {
+			_, err := tx.Exec(query)
+			return err
+		})
+	}
+
+	// Case-insensitive uniqueness is an extra index on the lowercased names, dropped again when it's turned
+	// off so it stops enforcing. It can't be built while a tenant has names that differ only in case.
+	if caseInsensitiveNames {
+		if err := exec(`CREATE UNIQUE INDEX IF NOT EXISTS ` + lowerNamesIndex + ` ON users (tenant_id, lower(first_name), lower(last_name))`); err != nil {
+			return fmt.Errorf("NAME_UNIQUENESS=case-insensitive: %w (rename or merge users whose names differ only in case first)", err)
+		}
+	} else if err := exec(`DROP INDEX IF EXISTS ` + lowerNamesIndex); err != nil {
+		return err
+	}
+
+	// GET /users/similar needs pg_trgm. Not every Postgres has it (or lets us create it),
+	// so a failure here only disables that route instead of the whole service.
+	trgm := `
+	CREATE EXTENSION IF NOT EXISTS pg_trgm;
+	CREATE INDEX IF NOT EXISTS users_first_name_trgm_idx ON users USING GIN (first_name gin_trgm_ops);
+	CREATE INDEX IF NOT EXISTS users_last_name_trgm_idx ON users USING GIN (last_name gin_trgm_ops);
 	`
+	if err := exec(trgm); err != nil {
+		log.Printf("pg_trgm unavailable, GET /users/similar will fail: %v", err)
+	}
+	return nil
+}
+
+// withTx runs fn inside a transaction, committing if fn returns nil and rolling back otherwise.
+func withTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once Commit succeeded
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// withStatementTimeout is withTx with statement_timeout set to d (0 is no limit) for this transaction only,
+// for work that may run longer than DB_STATEMENT_TIMEOUT allows a request: schema changes, imports, exports.
+// The session's own setting is back in force once the transaction ends.
+func withStatementTimeout(ctx context.Context, db *sql.DB, d time.Duration, fn func(tx *sql.Tx) error) error {
+	return withTx(ctx, db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx,
+			`SELECT set_config('statement_timeout', $1, true)`,
+			strconv.FormatInt(d.Milliseconds(), 10),
+		); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// withRollbackTx runs fn inside a transaction that is always rolled back.
+// Used for dry runs: fn sees the effect of its own statements but nothing persists.
+func withRollbackTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	_, err := db.Exec(schema)
-	return err
+	return fn(tx)
 }
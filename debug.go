@@ -0,0 +1,99 @@
+// debug.go is the X-Debug response headers: how many statements a request ran and whether the cache served it.
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+const requestStatsKey ctxKey = "request_stats"
+
+// requestStats counts a debug request's DB statements and cache lookups. Atomic because a request's
+// work can fan out to goroutines (batch fetches, singleflight leaders).
+type requestStats struct {
+	queries     atomic.Int64
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+}
+
+// countQuery records a statement against the request's stats, a no-op unless X-Debug is on
+func countQuery(ctx context.Context) {
+	if s, ok := ctx.Value(requestStatsKey).(*requestStats); ok {
+		s.queries.Add(1)
+	}
+}
+
+// countCacheLookup records a user cache lookup, a no-op unless X-Debug is on
+func countCacheLookup(ctx context.Context, hit bool) {
+	s, ok := ctx.Value(requestStatsKey).(*requestStats)
+	switch {
+	case !ok:
+	case hit:
+		s.cacheHits.Add(1)
+	default:
+		s.cacheMisses.Add(1)
+	}
+}
+
+// cacheHeader sums up the lookups for X-Cache: HIT or MISS when they all went one way, PARTIAL when
+// they didn't, NONE when the request never looked
+func (s *requestStats) cacheHeader() string {
+	hits, misses := s.cacheHits.Load(), s.cacheMisses.Load()
+	switch {
+	case hits == 0 && misses == 0:
+		return "NONE"
+	case misses == 0:
+		return "HIT"
+	case hits == 0:
+		return "MISS"
+	default:
+		return "PARTIAL"
+	}
+}
+
+// debugWriter adds the stats headers right before the response headers go out
+type debugWriter struct {
+	http.ResponseWriter
+	stats       *requestStats
+	wroteHeader bool
+}
+
+func (dw *debugWriter) WriteHeader(code int) {
+	if !dw.wroteHeader {
+		dw.wroteHeader = true
+		dw.Header().Set("X-DB-Queries", strconv.FormatInt(dw.stats.queries.Load(), 10))
+		dw.Header().Set("X-Cache", dw.stats.cacheHeader())
+	}
+	dw.ResponseWriter.WriteHeader(code)
+}
+
+func (dw *debugWriter) Write(p []byte) (int, error) {
+	if !dw.wroteHeader {
+		dw.WriteHeader(http.StatusOK)
+	}
+	return dw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (dw *debugWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
+
+// debugMiddleware answers a request sent with X-Debug: true with X-DB-Queries (statements run so far when
+// the headers were written) and X-Cache. Only with DEV_ROUTES, production never honors the header.
+func (a *api) debugMiddleware(next http.Handler) http.Handler {
+	if !a.cfg.devRoutes {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Debug") != "true" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		stats := &requestStats{}
+		ctx := context.WithValue(r.Context(), requestStatsKey, stats)
+		next.ServeHTTP(&debugWriter{ResponseWriter: w, stats: stats}, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugMiddleware(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		countCacheLookup(r.Context(), false)
+		countQuery(r.Context())
+		countQuery(r.Context())
+		_, _ = w.Write([]byte("{}"))
+	})
+	serve := func(devRoutes bool, debug string) http.Header {
+		cfg := defaultConfig()
+		cfg.devRoutes = devRoutes
+		r := httptest.NewRequest("GET", "/users/1", nil)
+		r.Header.Set("X-Debug", debug)
+		w := httptest.NewRecorder()
+		newAPI(cfg, nil, newMemoryCache()).debugMiddleware(h).ServeHTTP(w, r)
+		return w.Header()
+	}
+
+	if got := serve(true, "true"); got.Get("X-DB-Queries") != "2" || got.Get("X-Cache") != "MISS" {
+		t.Errorf("debug: got X-DB-Queries=%q X-Cache=%q, want 2 and MISS", got.Get("X-DB-Queries"), got.Get("X-Cache"))
+	}
+	// not asked for, and never in production
+	for _, got := range []http.Header{serve(true, ""), serve(false, "true")} {
+		if got.Get("X-DB-Queries") != "" || got.Get("X-Cache") != "" {
+			t.Errorf("got debug headers %v", got)
+		}
+	}
+
+	for want, lookups := range map[string][]bool{"NONE": nil, "HIT": {true}, "PARTIAL": {true, false}} {
+		var s requestStats
+		for _, hit := range lookups {
+			if hit {
+				s.cacheHits.Add(1)
+			} else {
+				s.cacheMisses.Add(1)
+			}
+		}
+		if got := s.cacheHeader(); got != want {
+			t.Errorf("%v: got %s, want %s", lookups, got, want)
+		}
+	}
+}
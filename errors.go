@@ -0,0 +1,181 @@
+// errors.go turns handler errors into HTTP responses in one place.
+// Handlers build or pass along typed errors and call writeError, which picks the status and writes
+// {"error": {"code": "...", "message": "..."}}.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// statusClientClosedRequest is nginx's 499: the client went away, so there's no one to answer.
+// It only shows up in logs and metrics, writeError sends no body for it.
+const statusClientClosedRequest = 499
+
+// retryAfterSeconds is the Retry-After sent with a 503, which are transient
+const retryAfterSeconds = "1"
+
+// nameConflictError is a write that would give user ID the name another user (ConflictID) already has.
+// It matches ErrDuplicateUser, so it's a 409, but says which users collide.
+type nameConflictError struct {
+	ID, ConflictID string
+	Name           string
+}
+
+func (e *nameConflictError) Error() string {
+	return fmt.Sprintf("user %s would be named %q, which user %s already is", e.ID, e.Name, e.ConflictID)
+}
+
+func (e *nameConflictError) Is(target error) bool {
+	return target == ErrDuplicateUser
+}
+
+// ValidationError is a bad input value (query param, path value, header or body field), always a 400
+type ValidationError struct {
+	// Field is the name the client used, e.g. "limit" or "firstName", empty if it's not about one field
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// invalidParam is the usual ValidationError for a value that doesn't parse, e.g. "invalid limit"
+func invalidParam(name string) error {
+	return &ValidationError{Field: name, Message: "invalid " + name}
+}
+
+// APIError is an error with an explicit status and a stable code clients can switch on.
+// Err is the underlying cause, it's never shown to the client.
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// ErrDuplicateUser is a create or update that would give two users of a tenant the same name, a 409
+	ErrDuplicateUser = errors.New("user with this first name and last name already exists")
+	// ErrValidation matches any *ValidationError with errors.Is
+	ErrValidation = errors.New("validation failed")
+
+	errUserNotFound = &APIError{Status: http.StatusNotFound, Code: "not_found", Message: "user not found"}
+	errInvalidJSON  = &APIError{Status: http.StatusBadRequest, Code: "invalid_json", Message: "invalid json"}
+	errShuttingDown = &APIError{Status: http.StatusServiceUnavailable, Code: "shutting_down", Message: "server shutting down"}
+	// errNameSearchEncrypted is GET /users/similar with PII_ENCRYPTION_KEY set, trigrams need the plaintext
+	errNameSearchEncrypted = &APIError{Status: http.StatusNotImplemented, Code: "not_implemented", Message: "name search is unavailable while names are encrypted"}
+	// errStatsEncrypted is GET /users/stats/lastname with PII_ENCRYPTION_KEY set, ciphertexts never group together
+	errStatsEncrypted = &APIError{Status: http.StatusNotImplemented, Code: "not_implemented", Message: "name stats are unavailable while names are encrypted"}
+	// errSharded is a route that can't combine results from several shards yet (SHARD_2_DATABASE_URL)
+	errSharded = &APIError{Status: http.StatusNotImplemented, Code: "not_implemented", Message: "unavailable while users are sharded"}
+	// errCrossShard is a write touching users on different shards, no transaction can span them
+	errCrossShard = &APIError{Status: http.StatusNotImplemented, Code: "not_implemented", Message: "users on different shards can't be changed together"}
+	// errLeaderCanceled is a deduped read whose leader's client went away, the follower's own client is still there
+	errLeaderCanceled = &APIError{Status: http.StatusServiceUnavailable, Code: "unavailable", Message: "shared fetch was canceled"}
+)
+
+// failed wraps an unexpected error with the message the client gets if it ends up a 500.
+// Timeouts, cancellations and not-found underneath still map to 503/499/404, see errorResponse.
+func failed(message string, err error) error {
+	return &APIError{Status: http.StatusInternalServerError, Code: "internal", Message: message, Err: err}
+}
+
+// errorBody is the JSON body of every error response
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+	// Fields is set for body validation, one rule per failing field, e.g. {"firstName":"required"}
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// writeError writes err as a JSON error with the status it maps to
+func writeError(w http.ResponseWriter, err error) {
+	status, detail := errorResponse(err)
+	if status == statusClientClosedRequest {
+		// nobody is reading, just record the status
+		w.WriteHeader(status)
+		return
+	}
+	// a caller that knows the outage is longer (maintenance mode) sets its own
+	if status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+		w.Header().Set("Retry-After", retryAfterSeconds)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorBody{Error: detail})
+}
+
+// httpStatusForError is the status err maps to. Handlers that can't send a body (HEAD) use it directly.
+func httpStatusForError(err error) int {
+	status, _ := errorResponse(err)
+	return status
+}
+
+// errorMessage is the client-facing message for err, never the internal cause.
+// Streams that already sent their 200 use it for the trailing error line.
+func errorMessage(err error) string {
+	_, detail := errorResponse(err)
+	return detail.Message
+}
+
+// errorResponse is the one place errors are mapped to a status and body, a new error type is a new case here.
+// Order matters: a timeout or missing row wrapped by failed() is reported as such rather than as the generic 500.
+func errorResponse(err error) (int, errorDetail) {
+	var verr *ValidationError
+	var aerr *APIError
+	switch {
+	// Every deadline is one we set ourselves (the request's work budget, waiting for a pool connection,
+	// a feed read), so hitting one means we were slow, not the client: a 503 the client can retry.
+	// Canceled means the client disconnected, see statusClientClosedRequest.
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable, errorDetail{Code: "timeout", Message: "request took too long, retry later"}
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest, errorDetail{Code: "canceled", Message: "request canceled"}
+	case errors.As(err, &verr):
+		return http.StatusBadRequest, errorDetail{Code: "invalid_input", Message: verr.Message, Field: verr.Field}
+	case errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound, errorDetail{Code: "not_found", Message: "user not found"}
+	case errors.Is(err, ErrDuplicateUser):
+		var cerr *nameConflictError
+		if errors.As(err, &cerr) {
+			return http.StatusConflict, errorDetail{Code: "conflict", Message: cerr.Error()}
+		}
+		return http.StatusConflict, errorDetail{Code: "conflict", Message: ErrDuplicateUser.Error()}
+	case errors.Is(err, errPreconditionFailed):
+		return http.StatusPreconditionFailed, errorDetail{Code: "precondition_failed", Message: "user was modified since If-Unmodified-Since"}
+	case validationErrors(err) != nil:
+		fields := validationErrors(err)
+		return http.StatusBadRequest, errorDetail{Code: "validation_failed", Message: formatValidationErrors(fields), Fields: fields}
+	case errors.As(err, &aerr):
+		return aerr.Status, errorDetail{Code: aerr.Code, Message: aerr.Message}
+	default:
+		return http.StatusInternalServerError, errorDetail{Code: "internal", Message: "internal server error"}
+	}
+}
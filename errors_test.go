@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"validation", invalidParam("limit"), http.StatusBadRequest, "invalid_input"},
+		{"api error", errUserNotFound, http.StatusNotFound, "not_found"},
+		{"timeout under failed", failed("failed to get user", context.DeadlineExceeded), http.StatusServiceUnavailable, "timeout"},
+		{"no rows under failed", failed("failed to get user", fmt.Errorf("scan: %w", sql.ErrNoRows)), http.StatusNotFound, "not_found"},
+		{"precondition", failed("failed to update user", errPreconditionFailed), http.StatusPreconditionFailed, "precondition_failed"},
+		{"failed", failed("failed to get user", errors.New("connection refused")), http.StatusInternalServerError, "internal"},
+		{"plain error", errors.New("boom"), http.StatusInternalServerError, "internal"},
+		{"body validation", validate.Struct(createUserRequest{}), http.StatusBadRequest, "validation_failed"},
+		{"duplicate", failed("failed to create user", ErrDuplicateUser), http.StatusConflict, "conflict"},
+		{"name conflict", failed("failed to update users", &nameConflictError{ID: "4", ConflictID: "9", Name: "Ada Smith"}), http.StatusConflict, "conflict"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeError(w, tt.err)
+
+			var body errorBody
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if w.Code != tt.wantStatus || body.Error.Code != tt.wantCode {
+				t.Errorf("got %d %q, want %d %q", w.Code, body.Error.Code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestWriteErrorHidesInternalCause(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, failed("failed to get user", errors.New("pq: password authentication failed")))
+
+	var body errorBody
+	_ = json.NewDecoder(w.Body).Decode(&body)
+	if body.Error.Message != "failed to get user" {
+		t.Errorf("message = %q, the cause must not leak", body.Error.Message)
+	}
+}
+
+func TestHTTPStatusForError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{context.Canceled, statusClientClosedRequest},
+		{fmt.Errorf("query: %w", context.DeadlineExceeded), http.StatusServiceUnavailable},
+		{sql.ErrNoRows, http.StatusNotFound},
+		{ErrDuplicateUser, http.StatusConflict},
+		{invalidParam("id"), http.StatusBadRequest},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := httpStatusForError(tt.err); got != tt.want {
+			t.Errorf("httpStatusForError(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+
+	if !errors.Is(invalidParam("limit"), ErrValidation) {
+		t.Error("a ValidationError should match ErrValidation")
+	}
+	if got := errorMessage(failed("failed to list users", context.DeadlineExceeded)); got != "request took too long, retry later" {
+		t.Errorf("errorMessage = %q", got)
+	}
+}
+
+func TestWriteErrorTimeoutVsCanceled(t *testing.T) {
+	// our own budget ran out: a retryable 503
+	w := httptest.NewRecorder()
+	writeError(w, failed("failed to get user", context.DeadlineExceeded))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("deadline: got %d Retry-After=%q, want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// the client left: status for the logs, no body
+	w = httptest.NewRecorder()
+	writeError(w, failed("failed to get user", context.Canceled))
+	if w.Code != statusClientClosedRequest || w.Body.Len() != 0 {
+		t.Errorf("canceled: got %d with %d body bytes, want 499 and no body", w.Code, w.Body.Len())
+	}
+}
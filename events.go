@@ -0,0 +1,282 @@
+// events.go is the in-process change feed: mutations publish to the bus, GET /users/events streams it as SSE.
+// With ?since= the stream is read from the events table instead, so a client can pick up where it left off.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is how many events a slow subscriber can fall behind before events are dropped for it
+const subscriberBuffer = 64
+
+// sseKeepAlive is how often an idle stream gets a comment line so proxies don't time it out
+const sseKeepAlive = 15 * time.Second
+
+// feedBatch is how many events a replaying stream reads per query
+const feedBatch = 500
+
+// feedPollInterval is how often a replaying stream checks the events table without a wakeup from the bus,
+// to pick up other replicas' writes and rows that were held back while an older transaction finished
+const feedPollInterval = time.Second
+
+// feedEvent is a row of the events table, Payload is the userEvent JSON
+type feedEvent struct {
+	Seq     int64
+	Payload json.RawMessage
+}
+
+// userEvent is one change, e.g. {"type":"created","id":"42"}
+type userEvent struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	// TenantID decides who receives the event, it isn't part of the message
+	TenantID int64 `json:"-"`
+}
+
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventDeleted = "deleted"
+)
+
+// eventBus fans every published event out to the current subscribers of the same tenant.
+// Publishing never blocks: a subscriber whose buffer is full misses the event.
+type eventBus struct {
+	mu sync.Mutex
+	// subs maps each subscriber to its tenant
+	subs   map[chan userEvent]int64
+	closed bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[chan userEvent]int64)}
+}
+
+// subscribe returns a channel of tenant's events and a func to stop receiving them.
+// The channel is closed on unsubscribe or when the bus shuts down.
+func (b *eventBus) subscribe(tenant int64) (<-chan userEvent, func()) {
+	ch := make(chan userEvent, subscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = tenant
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish sends e to every subscriber of e.TenantID without waiting on any of them
+func (b *eventBus) publish(e userEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, tenant := range b.subs {
+		if tenant != e.TenantID {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			log.Printf("event bus: subscriber full, dropped %s id=%s", e.Type, e.ID)
+		}
+	}
+}
+
+// close ends every subscription so long-lived streams return and the server can shut down
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// feedCursor is where a replay starts: ?since=<seq>, or the Last-Event-ID header an EventSource sends when it
+// reconnects. ok is false when there's neither and the stream is live only.
+func feedCursor(r *http.Request) (seq int64, ok bool, err error) {
+	v := r.URL.Query().Get("since")
+	if v == "" {
+		v = r.Header.Get("Last-Event-ID")
+	}
+	if v == "" {
+		return 0, false, nil
+	}
+	seq, err = strconv.ParseInt(v, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, false, invalidParam("since")
+	}
+	return seq, true, nil
+}
+
+// userEventsHandler streams user changes as server-sent events until the client goes away
+func (a *api) userEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r, "since") {
+		return
+	}
+
+	since, replay, err := feedCursor(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// every shard numbers its own events table, there's no single seq to resume from.
+	// Live-only streams just read the in-process bus, so they work sharded too.
+	if replay && a.shards != nil {
+		writeError(w, errSharded)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+
+	// subscribed before the first read of the events table, so a change committed in between still wakes us
+	events, unsubscribe := a.events.subscribe(GetTenantID(r.Context()))
+	defer unsubscribe()
+
+	// the first batch is read before the headers so a DB failure is still a proper error response
+	var batch []feedEvent
+	if replay {
+		if batch, err = a.readFeed(r.Context(), since); err != nil {
+			writeError(w, failed("failed to read events", err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Printf("sse: streaming unsupported: %v", err)
+		return
+	}
+
+	if replay {
+		a.streamFeed(r.Context(), w, rc, events, since, batch)
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return // bus closed, server is shutting down
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// streamFeed sends batch and then everything after it from the events table, each message with its seq
+// as the SSE id, until the client goes away. The table is read again whenever the bus says this process
+// wrote something, and every feedPollInterval for everything else.
+func (a *api) streamFeed(ctx context.Context, w io.Writer, rc *http.ResponseController, wake <-chan userEvent, cursor int64, batch []feedEvent) {
+	poll := time.NewTicker(feedPollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		for _, e := range batch {
+			if err := writeFeedEvent(w, e); err != nil {
+				return
+			}
+			cursor = e.Seq
+		}
+		if len(batch) > 0 {
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+
+		// a full batch means there's more to catch up on, read again straight away
+		if len(batch) < feedBatch && !waitForFeed(ctx, w, rc, wake, poll.C, keepAlive.C) {
+			return
+		}
+
+		var err error
+		if batch, err = a.readFeed(ctx, cursor); err != nil {
+			// the client reconnects with Last-Event-ID and resumes from cursor
+			log.Printf("sse: read events after %d: %v", cursor, err)
+			return
+		}
+	}
+}
+
+// waitForFeed blocks until the events table is worth reading again, sending keep-alives meanwhile.
+// It returns false once the stream should end.
+func waitForFeed(ctx context.Context, w io.Writer, rc *http.ResponseController, wake <-chan userEvent, poll, keepAlive <-chan time.Time) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case _, ok := <-wake:
+			if !ok {
+				return false // bus closed, server is shutting down
+			}
+			// one read covers every change queued so far
+			for len(wake) > 0 {
+				<-wake
+			}
+			return true
+		case <-poll:
+			return true
+		case <-keepAlive:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return false
+			}
+			if err := rc.Flush(); err != nil {
+				return false
+			}
+		}
+	}
+}
+
+// readFeed is eventsSince(seq) bounded by the longest request timeout, each read is its own short query
+func (a *api) readFeed(ctx context.Context, seq int64) ([]feedEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.maxRequestTimeout)
+	defer cancel()
+	return a.eventsSince(ctx, seq, feedBatch)
+}
+
+// writeFeedEvent writes e as an SSE message whose id is its seq
+func writeFeedEvent(w io.Writer, e feedEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.Seq, e.Payload)
+	return err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEventBusFanOut(t *testing.T) {
+	bus := newEventBus()
+
+	a, unsubA := bus.subscribe(1)
+	b, unsubB := bus.subscribe(1)
+	defer unsubB()
+
+	bus.publish(userEvent{Type: eventCreated, ID: "1", TenantID: 1})
+
+	for name, ch := range map[string]<-chan userEvent{"a": a, "b": b} {
+		if got := <-ch; got != (userEvent{Type: eventCreated, ID: "1", TenantID: 1}) {
+			t.Errorf("subscriber %s got %+v", name, got)
+		}
+	}
+
+	unsubA()
+	if _, ok := <-a; ok {
+		t.Error("expected channel to be closed after unsubscribe")
+	}
+
+	// publishing after an unsubscribe must not panic on the closed channel
+	bus.publish(userEvent{Type: eventDeleted, ID: "1", TenantID: 1})
+	if got := <-b; got.Type != eventDeleted {
+		t.Errorf("expected deleted event, got %+v", got)
+	}
+}
+
+func TestEventBusDropsWhenFull(t *testing.T) {
+	bus := newEventBus()
+	ch, unsub := bus.subscribe(1)
+	defer unsub()
+
+	for range subscriberBuffer + 10 {
+		bus.publish(userEvent{Type: eventUpdated, ID: "1", TenantID: 1})
+	}
+	if len(ch) != subscriberBuffer {
+		t.Errorf("expected %d buffered events, got %d", subscriberBuffer, len(ch))
+	}
+}
+
+func TestEventBusClose(t *testing.T) {
+	bus := newEventBus()
+	ch, unsub := bus.subscribe(1)
+
+	bus.close()
+	if _, ok := <-ch; ok {
+		t.Error("expected channel to be closed by bus.close")
+	}
+	unsub() // must be safe after close
+
+	late, _ := bus.subscribe(1)
+	if _, ok := <-late; ok {
+		t.Error("expected subscribe after close to return a closed channel")
+	}
+}
+
+func TestEventBusScopesByTenant(t *testing.T) {
+	bus := newEventBus()
+	mine, unsubMine := bus.subscribe(1)
+	defer unsubMine()
+	other, unsubOther := bus.subscribe(2)
+	defer unsubOther()
+
+	bus.publish(userEvent{Type: eventCreated, ID: "5", TenantID: 2})
+
+	if len(mine) != 0 {
+		t.Error("tenant 1 subscriber received tenant 2's event")
+	}
+	if len(other) != 1 {
+		t.Error("tenant 2 subscriber did not receive its event")
+	}
+}
+
+func TestFeedCursor(t *testing.T) {
+	for _, tc := range []struct {
+		query, lastEventID string
+		seq                int64
+		replay             bool
+	}{
+		{"", "", 0, false},
+		{"?since=0", "", 0, true},
+		{"?since=42", "7", 42, true},
+		{"", "7", 7, true},
+	} {
+		r := httptest.NewRequest("GET", "/users/events"+tc.query, nil)
+		if tc.lastEventID != "" {
+			r.Header.Set("Last-Event-ID", tc.lastEventID)
+		}
+		seq, replay, err := feedCursor(r)
+		if err != nil || seq != tc.seq || replay != tc.replay {
+			t.Errorf("%q/%q: got %d %v %v, want %d %v", tc.query, tc.lastEventID, seq, replay, err, tc.seq, tc.replay)
+		}
+	}
+
+	// rejected before anything touches the DB
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	for _, q := range []string{"?since=-1", "?since=abc"} {
+		w := httptest.NewRecorder()
+		route(a).ServeHTTP(w, httptest.NewRequest("GET", "/users/events"+q, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", q, w.Code)
+		}
+	}
+}
+
+func TestWriteFeedEvent(t *testing.T) {
+	var buf bytes.Buffer
+	payload, _ := json.Marshal(userEvent{Type: eventCreated, ID: "7"})
+	if err := writeFeedEvent(&buf, feedEvent{Seq: 12, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "id: 12\ndata: {\"type\":\"created\",\"id\":\"7\"}\n\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,87 @@
+// fields.go implements partial responses via the ?fields= query param.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// userFields are the json names of userResponse, i.e. what a client may ask for in ?fields=
+var userFields = jsonFieldNames(reflect.TypeOf(userResponse{}))
+
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// parseFields reads ?fields=id,firstName.
+// Returns nil when the param is absent, meaning "send the full object".
+// Unknown field names are an error so typos don't silently return less data.
+func parseFields(r *http.Request) ([]string, error) {
+	raw := r.URL.Query().Get("fields")
+	if raw == "" {
+		return nil, nil
+	}
+	return checkFields(strings.Split(raw, ","))
+}
+
+// checkFields trims the requested field names and drops empty ones, with parseFields' rules:
+// an unknown name or nothing left is an error.
+func checkFields(names []string) ([]string, error) {
+	var fields []string
+	for _, f := range names {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !userFields[f] {
+			return nil, &ValidationError{Field: "fields", Message: fmt.Sprintf("unknown field %q", f)}
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, &ValidationError{Field: "fields", Message: "fields must name at least one field"}
+	}
+	return fields, nil
+}
+
+// selectFields marshals u and keeps only the requested keys.
+func selectFields(u User, fields []string) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		out[f] = all[f]
+	}
+	return out, nil
+}
+
+// selectFieldsList applies selectFields to every user in the list.
+func selectFieldsList(users []User, fields []string) ([]map[string]json.RawMessage, error) {
+	out := make([]map[string]json.RawMessage, 0, len(users))
+	for _, u := range users {
+		m, err := selectFields(u, fields)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
@@ -0,0 +1,51 @@
+// form.go lets POST /users and PATCH /users/{id} take application/x-www-form-urlencoded bodies,
+// for a legacy internal tool that can't send JSON, and checks the charset those bodies are sent in.
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// formBody reports whether r's body is form encoded rather than JSON
+func formBody(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "application/x-www-form-urlencoded"
+}
+
+// formFields reads a form body into what the same request as a JSON object decodes to, so the JSON
+// paths (unknown fields, PATCH's present-vs-absent keys) apply unchanged. Every value is a string,
+// except that an empty phone is null: a form can't send null, and clearing is what an empty phone means.
+// Only the body is read, query parameters never become fields.
+func formFields(r *http.Request) (map[string]json.RawMessage, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, &ValidationError{Message: "invalid form body"}
+	}
+
+	fields := make(map[string]json.RawMessage, len(r.PostForm))
+	for key, vals := range r.PostForm {
+		if len(vals) > 1 {
+			return nil, &ValidationError{Field: key, Message: key + " given more than once"}
+		}
+		if key == "phone" && vals[0] == "" {
+			fields[key] = json.RawMessage("null")
+			continue
+		}
+		b, _ := json.Marshal(vals[0])
+		fields[key] = b
+	}
+	return fields, nil
+}
+
+// errNotUTF8 is a body whose Content-Type names a charset other than UTF-8
+var errNotUTF8 = &APIError{Status: http.StatusUnsupportedMediaType, Code: "unsupported_media_type", Message: "body must be UTF-8"}
+
+// utf8Body reports whether r's body may be read as UTF-8: its Content-Type has no charset or utf-8.
+// A client that labels a latin-1 body honestly gets a 415 rather than having its names mangled.
+func utf8Body(r *http.Request) bool {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	cs, ok := params["charset"]
+	return err != nil || !ok || strings.EqualFold(cs, "utf-8") || strings.EqualFold(cs, "utf8")
+}
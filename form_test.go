@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFormFields(t *testing.T) {
+	r := httptest.NewRequest("PATCH", "/users/1?dryRun=true", strings.NewReader("firstName=J%C3%BCrgen&phone="))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if !formBody(r) {
+		t.Fatal("form content type not recognized")
+	}
+
+	fields, err := formFields(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := patchFromJSON(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lastName absent: left alone. phone present but empty: cleared. The query string isn't a field.
+	if p.FirstName == nil || *p.FirstName != "Jürgen" || p.LastName != nil || !p.ClearPhone {
+		t.Errorf("got %+v, want firstName set, lastName untouched and phone cleared", p)
+	}
+
+	r = httptest.NewRequest("PATCH", "/users/1", strings.NewReader("firstName=a&firstName=b"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := formFields(r); err == nil {
+		t.Error("repeated key accepted")
+	}
+}
+
+func TestFormBodyValidation(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	// every case fails validation, so nothing reaches the DB
+	tests := []struct{ method, path, body string }{
+		{"POST", "/users", "firstName=James"},
+		{"POST", "/users", "firstName=James&lastName=Bond&email=x"},
+		{"PATCH", "/users/1", "firstName="},
+		{"PATCH", "/users/1", "nickname=Jim"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		route(a).ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s %q: got %d, want 400", tt.method, tt.path, tt.body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// ids.go is what a user id looks like: a BIGSERIAL integer by default, or a UUID with ID_TYPE=uuid.
+// Either way the code passes ids around as the text Postgres prints for them (id::text).
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// uuidIDs is ID_TYPE=uuid. Like numericIDs it's set once in main before the schema is created,
+// parsing and query building have no way to reach the config.
+var uuidIDs bool
+
+// errInvalidUserID is a user id that isn't a valid id of ID_TYPE, callers report it as their own field
+var errInvalidUserID = errors.New("invalid user id")
+
+// parseUserID parses a user id from a path, query or body into its canonical text, so it matches the
+// cache keys and User.ID. Anything but a positive int64 (text, 0, negatives, or too many digits to fit),
+// or with ID_TYPE=uuid anything but a UUID, is errInvalidUserID: handlers answer 400 before the DB
+// sees it rather than a 500 from Postgres failing the cast.
+func parseUserID(s string) (string, error) {
+	if uuidIDs {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return "", errInvalidUserID
+		}
+		return id.String(), nil
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return "", errInvalidUserID
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// jsonID is a user id in a request body, a JSON string or number (see ID_FORMAT). It's only read
+// as text, parseUserID checks it.
+type jsonID string
+
+func (id *jsonID) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*id = jsonID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*id = jsonID(n)
+	return nil
+}
+
+// idSQLType is the type of users.id, for casts in queries
+func idSQLType() string {
+	if uuidIDs {
+		return "uuid"
+	}
+	return "bigint"
+}
+
+// idArray is ids (parseUserID output) as a value the driver binds to an array of idSQLType,
+// for id = ANY($1) and unnest
+func idArray(ids []string) any {
+	if uuidIDs {
+		out := make([]uuid.UUID, len(ids))
+		for i, id := range ids {
+			out[i], _ = uuid.Parse(id)
+		}
+		return out
+	}
+	out := make([]int64, len(ids))
+	for i, id := range ids {
+		out[i], _ = strconv.ParseInt(id, 10, 64)
+	}
+	return out
+}
+
+// checkIDType fails when users.id isn't the type ID_TYPE asks for. The type is fixed when the table
+// is created, flipping ID_TYPE on an existing database would otherwise only show up as 400s and 500s.
+func checkIDType(ctx context.Context, db *sql.DB) error {
+	var got string
+	if err := db.QueryRowContext(ctx,
+		`SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'id'`,
+	).Scan(&got); err != nil {
+		return err
+	}
+	if got != idSQLType() {
+		return fmt.Errorf("users.id is %s but ID_TYPE wants %s, the id type can't change once the table exists", got, idSQLType())
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// withUUIDIDs runs the rest of the test with ID_TYPE=uuid
+func withUUIDIDs(t *testing.T) {
+	uuidIDs = true
+	t.Cleanup(func() { uuidIDs = false })
+}
+
+func TestParseUserID(t *testing.T) {
+	for in, want := range map[string]string{
+		"42":                                   "42",
+		"007":                                  "7",
+		"9223372036854775807":                  "9223372036854775807",
+		"9223372036854775808":                  "",
+		"99999999999999999999999999":           "",
+		"0":                                    "",
+		"-1":                                   "",
+		"abc":                                  "",
+		"":                                     "",
+		"6f9619ff-8b86-d011-b42d-00c04fc964ff": "",
+	} {
+		got, err := parseUserID(in)
+		if got != want || (err != nil) != (want == "") {
+			t.Errorf("parseUserID(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+
+	// an id too long for bigint is a 400 from the handler, not a 500 from Postgres
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	w := httptest.NewRecorder()
+	route(a).ServeHTTP(w, httptest.NewRequest("GET", "/users/99999999999999999999999999", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET oversized id = %d, want 400", w.Code)
+	}
+}
+
+func TestParseUserIDUUID(t *testing.T) {
+	withUUIDIDs(t)
+	for in, want := range map[string]string{
+		"6f9619ff-8b86-d011-b42d-00c04fc964ff":   "6f9619ff-8b86-d011-b42d-00c04fc964ff",
+		"6F9619FF-8B86-D011-B42D-00C04FC964FF":   "6f9619ff-8b86-d011-b42d-00c04fc964ff",
+		"{6f9619ff-8b86-d011-b42d-00c04fc964ff}": "6f9619ff-8b86-d011-b42d-00c04fc964ff",
+		"42":                                     "",
+		"6f9619ff-8b86-d011-b42d":                "",
+		"":                                       "",
+	} {
+		got, err := parseUserID(in)
+		if got != want || (err != nil) != (want == "") {
+			t.Errorf("parseUserID(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+
+	// a bigint id is as invalid as any other text
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	w := httptest.NewRecorder()
+	route(a).ServeHTTP(w, httptest.NewRequest("GET", "/users/42", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET /users/42 with uuid ids = %d, want 400", w.Code)
+	}
+}
+
+func TestJSONID(t *testing.T) {
+	var ids []jsonID
+	if err := json.Unmarshal([]byte(`["1", 2, "6f9619ff-8b86-d011-b42d-00c04fc964ff"]`), &ids); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if want := []jsonID{"1", "2", "6f9619ff-8b86-d011-b42d-00c04fc964ff"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ids = %q, want %q", ids, want)
+	}
+	for _, body := range []string{`[true]`, `[{}]`, `[[1]]`} {
+		if err := json.Unmarshal([]byte(body), &ids); err == nil {
+			t.Errorf("%s: expected an error", body)
+		}
+	}
+}
+
+func TestIDArray(t *testing.T) {
+	if got := idArray([]string{"4", "9"}); !reflect.DeepEqual(got, []int64{4, 9}) || idSQLType() != "bigint" {
+		t.Errorf("bigint ids bind as %#v (%s)", got, idSQLType())
+	}
+
+	withUUIDIDs(t)
+	id := uuid.New()
+	if got := idArray([]string{id.String()}); !reflect.DeepEqual(got, []uuid.UUID{id}) || idSQLType() != "uuid" {
+		t.Errorf("uuid ids bind as %#v (%s)", got, idSQLType())
+	}
+}
+
+func TestIDTypeConfig(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://localhost/test")
+
+	t.Setenv("ID_TYPE", "uuid")
+	if cfg, err := loadConfig(); err != nil || cfg.idType != "uuid" {
+		t.Fatalf("loadConfig = %q, %v; want uuid", cfg.idType, err)
+	}
+
+	t.Setenv("ID_FORMAT", "number")
+	if _, err := loadConfig(); err == nil {
+		t.Error("ID_FORMAT=number with uuid ids accepted")
+	}
+	t.Setenv("ID_FORMAT", "")
+
+	t.Setenv("SHARD_2_DATABASE_URL", "postgres://localhost/shard2")
+	t.Setenv("SHARD_SPLIT_ID", "1000")
+	if _, err := loadConfig(); err == nil {
+		t.Error("uuid ids with shards accepted")
+	}
+	t.Setenv("SHARD_2_DATABASE_URL", "")
+	t.Setenv("SHARD_SPLIT_ID", "")
+
+	t.Setenv("ID_TYPE", "ulid")
+	if _, err := loadConfig(); err == nil {
+		t.Error("ID_TYPE=ulid accepted")
+	}
+}
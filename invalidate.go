@@ -0,0 +1,109 @@
+// invalidate.go batches cache invalidations: callers enqueue keys and a single goroutine
+// evicts them in batches, so heavy write traffic doesn't take the cache lock once per update.
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// invalidationQueueSize is how many keys can wait for the drainer before enqueue falls back to evicting inline
+const invalidationQueueSize = 1024
+
+// invalidator coalesces invalidations arriving within window into one InvalidateMany call
+type invalidator struct {
+	cache  Cache
+	window time.Duration
+	queue  chan string
+	done   chan struct{}
+
+	// mu guards closed: enqueue holds it for reading while sending, close takes it to close the queue
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newInvalidator starts the drainer goroutine, stop it with close
+func newInvalidator(c Cache, window time.Duration) *invalidator {
+	v := &invalidator{
+		cache:  c,
+		window: window,
+		queue:  make(chan string, invalidationQueueSize),
+		done:   make(chan struct{}),
+	}
+	go v.run()
+	return v
+}
+
+// enqueue schedules key for eviction. It never blocks: once the queue is full or closed the key is evicted inline.
+func (v *invalidator) enqueue(key string) {
+	v.mu.RLock()
+	if !v.closed {
+		select {
+		case v.queue <- key:
+			v.mu.RUnlock()
+			return
+		default:
+		}
+	}
+	v.mu.RUnlock()
+
+	v.flush([]string{key})
+}
+
+// run collects keys for up to window after the first one arrives, dedupes them and evicts the batch.
+// It drains whatever is left once the queue is closed.
+func (v *invalidator) run() {
+	defer close(v.done)
+
+	for key := range v.queue {
+		batch := map[string]struct{}{key: {}}
+		timer := time.NewTimer(v.window)
+
+	collect:
+		for {
+			select {
+			case k, ok := <-v.queue:
+				if !ok {
+					break collect
+				}
+				batch[k] = struct{}{}
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		keys := make([]string, 0, len(batch))
+		for k := range batch {
+			keys = append(keys, k)
+		}
+		v.flush(keys)
+	}
+}
+
+func (v *invalidator) flush(keys []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := v.cache.InvalidateMany(ctx, keys); err != nil {
+		log.Printf("cache invalidate %d keys: %v", len(keys), err)
+	}
+}
+
+// close stops accepting keys and waits until every queued invalidation has been applied (or ctx ends)
+func (v *invalidator) close(ctx context.Context) error {
+	v.mu.Lock()
+	if !v.closed {
+		v.closed = true
+		close(v.queue)
+	}
+	v.mu.Unlock()
+
+	select {
+	case <-v.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,73 @@
+// jsonapi.go serializes users in JSON:API format for clients that ask for it via Accept.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const jsonAPIMediaType = "application/vnd.api+json"
+
+// jsonAPIResource is a single JSON:API resource object
+type jsonAPIResource struct {
+	Type       string                     `json:"type"`
+	ID         string                     `json:"id"`
+	Attributes map[string]json.RawMessage `json:"attributes"`
+}
+
+// jsonAPIListMeta carries the paging info for a collection
+type jsonAPIListMeta struct {
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	Count  int `json:"count"`
+}
+
+// wantsJSONAPI reports whether the client negotiated JSON:API, everyone else gets plain JSON
+func wantsJSONAPI(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), jsonAPIMediaType)
+}
+
+// toJSONAPIResource wraps u as {"type":"users","id":...,"attributes":{...}}.
+// Attributes are every field except id, or just the ?fields= selection when given.
+func toJSONAPIResource(u User, fields []string) (jsonAPIResource, error) {
+	if fields == nil {
+		for f := range userFields {
+			fields = append(fields, f)
+		}
+	}
+
+	attrs, err := selectFields(u, fields)
+	if err != nil {
+		return jsonAPIResource{}, err
+	}
+	delete(attrs, "id")
+
+	return jsonAPIResource{Type: "users", ID: u.ID, Attributes: attrs}, nil
+}
+
+// jsonAPIDocument builds {"data":{...}} for a single user
+func jsonAPIDocument(u User, fields []string) (any, error) {
+	res, err := toJSONAPIResource(u, fields)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"data": res}, nil
+}
+
+// jsonAPIListDocument builds {"data":[...],"meta":{...}} for a page of users
+func jsonAPIListDocument(users []User, fields []string, p listParams) (any, error) {
+	data := make([]jsonAPIResource, 0, len(users))
+	for _, u := range users {
+		res, err := toJSONAPIResource(u, fields)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, res)
+	}
+
+	return map[string]any{
+		"data": data,
+		"meta": jsonAPIListMeta{Limit: p.limit, Offset: p.offset, Count: len(users)},
+	}, nil
+}
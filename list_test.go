@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOrderBy(t *testing.T) {
+	tests := map[string]string{
+		"":          "ORDER BY id",
+		"id":        "ORDER BY id",
+		"lastName":  "ORDER BY last_name, id",
+		"createdAt": "ORDER BY created_at, id",
+		"phone":     "ORDER BY phone NULLS LAST, id",
+		"bogus":     "ORDER BY id",
+	}
+	for order, want := range tests {
+		if got := orderBy(order, ""); got != want {
+			t.Errorf("orderBy(%q) = %q, want %q", order, got, want)
+		}
+	}
+
+	// ?nulls= only changes nullable columns, and nothing outside listNulls reaches the SQL
+	for nulls, want := range map[string]string{
+		"first":       "ORDER BY phone NULLS FIRST, id",
+		"last":        "ORDER BY phone NULLS LAST, id",
+		"; DROP user": "ORDER BY phone NULLS LAST, id",
+	} {
+		if got := orderBy("phone", nulls); got != want {
+			t.Errorf("orderBy(phone, %q) = %q, want %q", nulls, got, want)
+		}
+	}
+	if got := orderBy("lastName", "first"); got != "ORDER BY last_name, id" {
+		t.Errorf("orderBy(lastName, first) = %q, want no NULLS clause", got)
+	}
+}
+
+func TestParseListParamsPaging(t *testing.T) {
+	cfg := defaultConfig()
+	a := newAPI(cfg, nil, newMemoryCache())
+	tests := []struct {
+		query         string
+		limit, offset int
+		wantErr       bool
+	}{
+		{query: "", limit: cfg.defaultPageSize},
+		{query: "limit=0", limit: cfg.defaultPageSize},
+		{query: "limit=5&offset=10", limit: 5, offset: 10},
+		{query: fmt.Sprintf("limit=%d", cfg.maxPageSize+1), limit: cfg.maxPageSize},
+		{query: "limit=-1", wantErr: true},
+		{query: "offset=-1", wantErr: true},
+		{query: "limit=ten", wantErr: true},
+	}
+	for _, tt := range tests {
+		p, err := a.parseListParams(httptest.NewRequest("GET", "/users?"+tt.query, nil))
+		if tt.wantErr {
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Errorf("%q: err = %v, want a 400", tt.query, err)
+			}
+			continue
+		}
+		if err != nil || p.limit != tt.limit || p.offset != tt.offset {
+			t.Errorf("%q: limit=%d offset=%d err=%v, want limit=%d offset=%d", tt.query, p.limit, p.offset, err, tt.limit, tt.offset)
+		}
+	}
+}
+
+func TestParseListParamsNulls(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	p, err := a.parseListParams(httptest.NewRequest("GET", "/users?nulls=first", nil))
+	if err != nil || p.nulls != "first" {
+		t.Errorf("nulls=first: got %q, %v", p.nulls, err)
+	}
+	if _, err := a.parseListParams(httptest.NewRequest("GET", "/users?nulls=middle", nil)); err == nil {
+		t.Error("nulls=middle accepted")
+	}
+}
+
+func TestListParamsKey(t *testing.T) {
+	yes, no := true, false
+	ctx := context.Background()
+	base := listParams{limit: 20, order: "id"}
+	variants := map[string]listParams{
+		"limit":        {limit: 21, order: "id"},
+		"offset":       {limit: 20, offset: 20, order: "id"},
+		"active=true":  {limit: 20, order: "id", active: &yes},
+		"active=false": {limit: 20, order: "id", active: &no},
+		"order":        {limit: 20, order: "lastName"},
+		"nulls":        {limit: 20, order: "id", nulls: "first"},
+	}
+
+	if tenantKey(ctx, base.key()) != tenantKey(ctx, listParams{limit: 20, order: "id"}.key()) {
+		t.Error("equal params must share a key")
+	}
+	seen := map[string]string{tenantKey(ctx, base.key()): "base"}
+	for name, p := range variants {
+		k := tenantKey(ctx, p.key())
+		if other, ok := seen[k]; ok {
+			t.Errorf("%s shares key %q with %s", name, k, other)
+		}
+		seen[k] = name
+	}
+	if tenantKey(withTenantID(ctx, 2), base.key()) == tenantKey(ctx, base.key()) {
+		t.Error("two tenants' lists share a key")
+	}
+}
+
+// blockingConnector's connections hold every query until release is closed, then return no rows
+type blockingConnector struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c blockingConnector) Connect(context.Context) (driver.Conn, error) { return blockingConn{c}, nil }
+func (blockingConnector) Driver() driver.Driver                          { return nil }
+
+type blockingConn struct{ blockingConnector }
+
+func (blockingConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (blockingConn) Close() error                        { return nil }
+func (blockingConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+func (c blockingConn) QueryContext(ctx context.Context, _ string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.started <- struct{}{}
+	select {
+	case <-c.release:
+		return noRows{}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// noRows is an empty result with userColumns' columns
+type noRows struct{}
+
+func (noRows) Columns() []string {
+	return []string{"id", "first_name", "last_name", "full_name", "phone", "is_active", "created_at", "updated_at"}
+}
+func (noRows) Close() error              { return nil }
+func (noRows) Next([]driver.Value) error { return io.EOF }
+
+func TestListUsersDedupeFollowerCanceled(t *testing.T) {
+	conn := blockingConnector{started: make(chan struct{}, 2), release: make(chan struct{})}
+	db := sql.OpenDB(conn)
+	defer db.Close()
+	a := newAPI(defaultConfig(), db, newMemoryCache())
+	p := listParams{limit: 20, order: "id"}
+
+	leader := make(chan error, 1)
+	go func() {
+		_, err := a.listUsersDedupe(context.Background(), p)
+		leader <- err
+	}()
+	<-conn.started
+
+	// the follower joins the leader's query and gives up on it, the query itself has to carry on
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := a.listUsersDedupe(canceled, p); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled follower: %v, want context.Canceled", err)
+	}
+
+	close(conn.release)
+	if err := <-leader; err != nil {
+		t.Errorf("leader after its follower was canceled: %v, want the page", err)
+	}
+	if n := len(conn.started); n != 0 {
+		t.Errorf("%d extra queries ran, the follower should have shared the leader's", n)
+	}
+}
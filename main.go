@@ -1,49 +1,271 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func route(api *api) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /health", api.healthHandler)
+	mux.HandleFunc("GET /readyz", api.readyzHandler)
 	mux.HandleFunc("GET /users", api.getUsersHandler)
 	mux.HandleFunc("POST /users", api.createUserHandler)
+	mux.HandleFunc("POST /users/import", api.importUsersHandler)
+	mux.HandleFunc("POST /users/bulk-update", api.requireAdmin(api.bulkUpdateUsersHandler))
+	mux.HandleFunc("GET /users/events", api.userEventsHandler)
+	mux.HandleFunc("GET /users/ws", api.userEventsWSHandler)
+	mux.HandleFunc("GET /users/export.csv", api.exportUsersCSVHandler)
+	mux.HandleFunc("GET /users/similar", api.similarUsersHandler)
+	mux.HandleFunc("GET /users/available", api.userAvailableHandler)
+	mux.HandleFunc("GET /users/recent", api.recentUsersHandler)
+	mux.HandleFunc("GET /users/stats/lastname", api.lastNameStatsHandler)
+	mux.HandleFunc("GET /users/stats/daily", api.dailyStatsHandler)
+	mux.HandleFunc("POST "+resolvePath, api.resolveUsersHandler)
 	mux.HandleFunc("GET /users/{id}", api.getUserByIdHandler)
 	mux.HandleFunc("DELETE /users/{id}", api.deleteUserByIdHandler)
 	mux.HandleFunc("PATCH /users/{id}", api.updateUserByIdHandler)
+	mux.HandleFunc("POST /users/{id}/duplicate", api.duplicateUserHandler)
+	mux.HandleFunc("POST /users/{id}/merge", api.mergeUserHandler)
+	mux.HandleFunc("POST /users/{id}/activate", api.setUserActiveHandler(true))
+	mux.HandleFunc("POST /users/{id}/deactivate", api.setUserActiveHandler(false))
+	// with INTERNAL_ADDR they're served by internalRoute instead
+	if api.cfg.internalAddr == "" {
+		internalRoutes(mux, api)
+	}
 
-	var h http.Handler = mux
+	// outermost first, see chain
+	return chain(recordPattern(mux),
+		// the server span (and any incoming traceparent) is in the context for everything below
+		otelMiddleware,
+		// catches panics from every middleware below, not just the handlers
+		api.recoverMiddleware,
+		api.requestIDMiddleware,
+		loggingMiddleware,
+		// before anything matches on the path, the concurrency limit's exempt routes included
+		api.trailingSlashMiddleware,
+		// shed before doing any work for a request we won't serve, shed requests are still logged
+		api.concurrencyLimitMiddleware,
+		// before anything reads a body or credentials that shouldn't have been sent over plain http
+		api.httpsMiddleware,
+		// inside logging so statusRecorder sees the real status, outside body logging so that logs plaintext
+		api.compressMiddleware,
+		// a refused write never reaches auth or the handlers, and costs nothing beyond the log line
+		api.maintenanceMiddleware,
+		// CORS, auth and rate limiting go here, in that order: preflights are answered before auth,
+		// and unauthenticated requests are rejected before they count against a rate limit
+		// replay protection belongs after auth, so only authenticated requests can use up nonces
+		api.nonceMiddleware,
+		api.bodyLogMiddleware,
+		api.debugMiddleware,
+		tenantMiddleware,
+	)
+}
 
-	h = loggingMiddleware(h)
-	h = requestIDMiddleware(h)
-	h = recoverMiddleware(h)
+// internalRoutes registers the routes for operators rather than clients: metrics and /admin
+func internalRoutes(mux *http.ServeMux, api *api) {
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("POST /admin/cache/warm", api.requireAdmin(api.warmCacheHandler))
+	mux.HandleFunc("GET /admin/cache/stats", api.requireAdmin(api.cacheStatsHandler))
+	mux.HandleFunc("DELETE /admin/cache", api.requireAdmin(api.flushCacheHandler))
+	mux.HandleFunc("POST /admin/maintenance", api.requireAdmin(api.maintenanceHandler))
+	mux.HandleFunc("GET /admin/db/indexes", api.requireAdmin(api.requireDev(api.dbIndexesHandler)))
+}
 
-	return h
+// internalRoute is the handler for the INTERNAL_ADDR listener: only the internal routes, behind the
+// middleware that still matters for them. Load shedding, compression and maintenance are for client
+// traffic, and a scrape or an admin call should get through even when clients are being shed.
+func internalRoute(api *api) http.Handler {
+	mux := http.NewServeMux()
+	internalRoutes(mux, api)
+	return chain(recordPattern(mux),
+		otelMiddleware,
+		api.recoverMiddleware,
+		api.requestIDMiddleware,
+		loggingMiddleware,
+		tenantMiddleware,
+	)
+}
+
+// newAPI wires up the api with its dependencies
+func newAPI(cfg config, db *sql.DB, cache Cache) *api {
+	a := &api{
+		addr:          cfg.addr,
+		cfg:           cfg,
+		db:            db,
+		readDB:        db,
+		cache:         cache,
+		invalidations: newInvalidator(cache, cfg.invalidationWindow),
+		inflight:      make(map[string]chan fetchResult),
+		draining:      make(chan struct{}),
+		events:        newEventBus(),
+		instanceID:    uuid.NewString(),
+	}
+	if cfg.panicWebhookURL != "" {
+		a.onPanic = panicWebhook(cfg.panicWebhookURL)
+	}
+	a.maintenance.Store(cfg.maintenanceMode)
+	return a
 }
 
 func main() {
-	db := openDB()
+	seed := flag.Int("seed", 0, "insert `N` random users and exit")
+	skipSelfTest := flag.Bool("skip-self-test", false, "start without checking that writes, reads and the cache work (local development)")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	numericIDs = cfg.idFormat == "number"
+	uuidIDs = cfg.idType == "uuid"
+
+	shutdownTracing, err := initTracing(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := openDB(cfg.databaseURL, cfg)
 	defer db.Close()
 
-	if err := initSchema(db); err != nil {
+	if err := initSchema(db, cfg.caseInsensitiveNames()); err != nil {
+		log.Fatal(err)
+	}
+
+	cache, err := newCache(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	api := &api{
-		addr:     ":8080",
-		db:       db,
-		cache:    make(map[string]cacheEntry),
-		inflight: make(map[string]chan fetchResult),
+	api := newAPI(cfg, db, cache)
+
+	if cfg.piiKey != nil {
+		if api.pii, err = newPIICipher(cfg.piiKey); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := api.encryptPlaintextUsers(ctx); err != nil {
+			log.Fatalf("pii: encrypting existing users: %v", err)
+		}
+	}
+
+	if cfg.readDatabaseURL != "" {
+		readDB := openDB(cfg.readDatabaseURL, cfg)
+		defer readDB.Close()
+		api.readDB = readDB
+	}
+
+	if cfg.shard2DatabaseURL != "" {
+		shard2 := openDB(cfg.shard2DatabaseURL, cfg)
+		defer shard2.Close()
+		if err := initSchema(shard2, cfg.caseInsensitiveNames()); err != nil {
+			log.Fatal(err)
+		}
+		// each shard's sequence only hands out its own ids, new users all go to the second
+		if err := initShardSequence(db, 1, cfg.shardSplitID-1); err != nil {
+			log.Fatalf("shard 1: %v (is SHARD_SPLIT_ID above every id on DATABASE_URL?)", err)
+		}
+		if err := initShardSequence(shard2, cfg.shardSplitID, 0); err != nil {
+			log.Fatalf("shard 2: %v", err)
+		}
+		api.shards = newShardMap(db, cfg.shardSplitID, shard2)
+	}
+
+	if *seed > 0 {
+		inserted, skipped, err := api.seedUsers(ctx, *seed)
+		if err != nil {
+			log.Fatalf("seed: %v (inserted=%d skipped=%d)", err, inserted, skipped)
+		}
+		log.Printf("seed: done, inserted=%d skipped=%d", inserted, skipped)
+		return
+	}
+
+	if !*skipSelfTest {
+		if err := api.selfTest(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Redis is shared by every replica already, only the per-process map needs to hear about other replicas' writes
+	if cfg.cacheBackend == "memory" {
+		go api.listenForInvalidations(ctx, cfg.databaseURL)
+		// a write NOTIFYs on the shard it ran on
+		if cfg.shard2DatabaseURL != "" {
+			go api.listenForInvalidations(ctx, cfg.shard2DatabaseURL)
+		}
 	}
 
 	srv := &http.Server{
 		Addr:    api.addr,
 		Handler: route(api),
+		// only used with TLS_CERT_FILE, HTTP/2 is negotiated automatically on top of it
+		TLSConfig: &tls.Config{MinVersion: cfg.tlsMinVersion},
+	}
+	// SSE streams never finish on their own, end them so Shutdown doesn't wait out its timeout
+	srv.RegisterOnShutdown(api.events.close)
+	if cfg.shutdownDrainInflight {
+		srv.RegisterOnShutdown(api.drainInflight)
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	// the internal listener is plain HTTP even with TLS_CERT_FILE, it's meant to be reachable from inside only
+	var internalSrv *http.Server
+	if cfg.internalAddr != "" {
+		internalSrv = &http.Server{Addr: cfg.internalAddr, Handler: internalRoute(api)}
+		go func() {
+			if err := internalSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	go func() {
+		var err error
+		if cfg.tlsCertFile != "" {
+			err = srv.ListenAndServeTLS(cfg.tlsCertFile, cfg.tlsKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("server shutdown: %v", err)
+	}
+	// after the API has drained, so metrics can still be scraped while it does
+	if internalSrv != nil {
+		if err := internalSrv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("internal server shutdown: %v", err)
+		}
+	}
+	// apply invalidations still waiting in the batch before the process exits
+	if err := api.invalidations.close(shutdownCtx); err != nil {
+		log.Printf("cache invalidations shutdown: %v", err)
+	}
+	// flush spans still sitting in the batcher
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("tracing shutdown: %v", err)
 	}
 }
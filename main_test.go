@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestRouteRegisters catches mux pattern conflicts, which only show up as a panic when the routes are built.
+func TestRouteRegisters(t *testing.T) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			t.Fatalf("route panicked: %v", rec)
+		}
+	}()
+	route(newAPI(defaultConfig(), nil, newMemoryCache()))
+}
+
+// The 1.22+ mux answers 405 with an Allow header on its own, this pins that behavior
+// so a catch-all route added later can't turn it back into a 404.
+func TestMethodNotAllowed(t *testing.T) {
+	h := route(newAPI(defaultConfig(), nil, newMemoryCache()))
+
+	tests := []struct {
+		method, path string
+		wantAllow    string
+	}{
+		{"POST", "/users/1", "DELETE, GET, HEAD, PATCH"},
+		{"PUT", "/users", "GET, HEAD, POST"},
+		{"DELETE", "/health", "GET, HEAD"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: expected 405, got %d", tt.method, tt.path, w.Code)
+		}
+		if got := w.Header().Get("Allow"); got != tt.wantAllow {
+			t.Errorf("%s %s: expected Allow %q, got %q", tt.method, tt.path, tt.wantAllow, got)
+		}
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	mw := func(name string) middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	h := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), mw("outer"), mw("middle"), mw("inner"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if got := strings.Join(order, ","); got != "outer,middle,inner,handler" {
+		t.Errorf("order = %s", got)
+	}
+}
+
+func TestDrainInflightReleasesFollowers(t *testing.T) {
+	ctx := context.Background()
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+
+	// a leader that never finishes, like a fetch Shutdown is cutting short
+	a.inflight[tenantKey(ctx, "1")] = make(chan fetchResult, 1)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := a.getUserByIdDedupe(ctx, "1")
+		errc <- err
+	}()
+
+	// let the follower reach its wait before draining
+	time.Sleep(20 * time.Millisecond)
+	a.drainInflight()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, errShuttingDown) || httpStatusForError(err) != http.StatusServiceUnavailable {
+			t.Errorf("follower got %v, want errShuttingDown (503)", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("follower still waiting after drainInflight")
+	}
+
+	// and nothing new becomes a leader
+	if _, err := a.getUserByIdDedupe(ctx, "2"); !errors.Is(err, errShuttingDown) {
+		t.Errorf("new fetch after drain got %v, want errShuttingDown", err)
+	}
+	a.drainInflight() // idempotent
+}
+
+func TestUserLookupMetrics(t *testing.T) {
+	ctx := context.Background()
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	count := func(role string) float64 { return testutil.ToFloat64(userLookupsTotal.WithLabelValues(role)) }
+
+	// a cache hit never touches the dedupe
+	a.setUserCache(ctx, "1", User{ID: "1"}, time.Minute)
+	before := count("cache")
+	if _, err := a.getUserByIdDedupe(ctx, "1"); err != nil {
+		t.Fatalf("cached lookup: %v", err)
+	}
+	if got := count("cache") - before; got != 1 {
+		t.Errorf("cache lookups += %v, want 1", got)
+	}
+
+	// joining someone else's fetch is a follower
+	ch := make(chan fetchResult, 1)
+	a.inflight[tenantKey(ctx, "2")] = ch
+	before = count("follower")
+	ch <- fetchResult{user: User{ID: "2"}}
+	if _, err := a.getUserByIdDedupe(ctx, "2"); err != nil {
+		t.Fatalf("follower lookup: %v", err)
+	}
+	if got := count("follower") - before; got != 1 {
+		t.Errorf("follower lookups += %v, want 1", got)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://localhost/test")
+	cfg, err := loadConfig()
+	if err != nil || cfg.tlsCertFile != "" || cfg.tlsMinVersion != tls.VersionTLS12 {
+		t.Fatalf("default: got %q %x %v, want plain HTTP and TLS 1.2 minimum", cfg.tlsCertFile, cfg.tlsMinVersion, err)
+	}
+
+	t.Setenv("TLS_CERT_FILE", "cert.pem")
+	if _, err := loadConfig(); err == nil {
+		t.Error("TLS_CERT_FILE without TLS_KEY_FILE accepted")
+	}
+
+	t.Setenv("TLS_KEY_FILE", "key.pem")
+	t.Setenv("TLS_MIN_VERSION", "1.3")
+	if cfg, err = loadConfig(); err != nil || cfg.tlsMinVersion != tls.VersionTLS13 {
+		t.Errorf("TLS_MIN_VERSION=1.3: got %x %v", cfg.tlsMinVersion, err)
+	}
+
+	t.Setenv("TLS_MIN_VERSION", "1.1")
+	if _, err := loadConfig(); err == nil {
+		t.Error("TLS_MIN_VERSION=1.1 accepted")
+	}
+}
+
+func TestInternalListener(t *testing.T) {
+	get := func(h http.Handler, path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	// default: one listener serves everything
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	if code := get(route(a), "/metrics"); code != http.StatusOK {
+		t.Errorf("GET /metrics on ADDR = %d, want 200", code)
+	}
+
+	cfg := defaultConfig()
+	cfg.internalAddr = ":9090"
+	a = newAPI(cfg, nil, newMemoryCache())
+	for path, want := range map[string]int{"/metrics": http.StatusNotFound, "/admin/cache/stats": http.StatusNotFound} {
+		if code := get(route(a), path); code != want {
+			t.Errorf("GET %s on ADDR = %d, want %d", path, code, want)
+		}
+	}
+	// admin still needs the token on the internal port, unset here so it's refused rather than missing
+	for path, want := range map[string]int{"/metrics": http.StatusOK, "/admin/cache/stats": http.StatusForbidden, "/users": http.StatusNotFound} {
+		if code := get(internalRoute(a), path); code != want {
+			t.Errorf("GET %s on INTERNAL_ADDR = %d, want %d", path, code, want)
+		}
+	}
+
+	t.Setenv("DATABASE_URL", "postgres://localhost/test")
+	t.Setenv("INTERNAL_ADDR", ":8080")
+	if _, err := loadConfig(); err == nil {
+		t.Error("INTERNAL_ADDR equal to ADDR accepted")
+	}
+}
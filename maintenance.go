@@ -0,0 +1,66 @@
+// maintenance.go is maintenance mode: writes get a 503 while reads carry on, e.g. to quiesce a schema change.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// maintenanceRetryAfter is the Retry-After for a write refused in maintenance. Longer than the usual
+// 503's, maintenance lasts minutes and clients retrying every second would only add load.
+const maintenanceRetryAfter = "30"
+
+// errMaintenance is a write refused by maintenanceMiddleware
+var errMaintenance = &APIError{Status: http.StatusServiceUnavailable, Code: "maintenance", Message: "writes are paused for maintenance, retry later"}
+
+// readOnlyRequest reports whether r can't change anything: GET, HEAD, OPTIONS, and POST /users/resolve,
+// a read that takes its ids in a body
+func readOnlyRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		return r.URL.Path == resolvePath
+	}
+	return false
+}
+
+// maintenanceMiddleware refuses every request that isn't a read (see readOnlyRequest) while a.maintenance
+// is on. /admin stays open, it's where maintenance is switched off again.
+func (a *api) maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !a.maintenance.Load(), readOnlyRequest(r),
+			strings.HasPrefix(r.URL.Path, "/admin/"):
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", maintenanceRetryAfter)
+			writeError(w, errMaintenance)
+		}
+	})
+}
+
+// maintenanceHandler switches maintenance mode with {"enabled":true|false} and answers with the new state.
+// It only affects this process: behind a load balancer, call every replica or set MAINTENANCE_MODE.
+func (a *api) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Enabled *bool `json:"enabled"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&payload); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	if payload.Enabled == nil {
+		writeError(w, &ValidationError{Field: "enabled", Message: "enabled must be true or false"})
+		return
+	}
+
+	a.maintenance.Store(*payload.Enabled)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]bool{"maintenance": *payload.Enabled})
+}
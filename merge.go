@@ -0,0 +1,118 @@
+// merge.go serves POST /users/{id}/merge, folding a duplicate user into the one that survives.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errMergeIntoSelf is a merge whose source and target are the same user
+var errMergeIntoSelf = &ValidationError{Field: "into", Message: "into must be a different user"}
+
+// parseMergeTarget reads {"into":"<targetId>"}, the id may also be a JSON number (see ID_FORMAT)
+func parseMergeTarget(body io.Reader) (string, error) {
+	var req struct {
+		Into jsonID `json:"into"`
+	}
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return "", errInvalidJSON
+	}
+	into, err := parseUserID(string(req.Into))
+	if err != nil {
+		return "", invalidParam("into")
+	}
+	return into, nil
+}
+
+// mergeUserHandler merges user {id} into the user in the body and returns the surviving target.
+// 404 if either user doesn't exist, 400 if they're the same user.
+func (a *api) mergeUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r) {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	id, err := parseUserID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, invalidParam("id"))
+		return
+	}
+	into, err := parseMergeTarget(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if into == id {
+		writeError(w, errMergeIntoSelf)
+		return
+	}
+	if !a.sameShard(id, into) {
+		writeError(w, errCrossShard)
+		return
+	}
+
+	target, merged, err := a.mergeUsers(ctx, id, into)
+	if err != nil {
+		writeError(w, failed("failed to merge users", err))
+		return
+	}
+	if !merged {
+		writeError(w, errUserNotFound)
+		return
+	}
+
+	a.invalidateUserCache(ctx, id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(target)
+}
+
+// mergeUsers moves everything that belongs to user source over to target and deletes source, in one
+// transaction. merged=false (nothing changed) if either user doesn't exist in the tenant.
+// Users have no dependent rows yet: a table that references users.id gets its UPDATE ... SET user_id = target
+// here, before the DELETE, so a merge never leaves rows pointing at a user that's gone.
+// Both users must be on one shard (sameShard), the handler checks.
+func (a *api) mergeUsers(ctx context.Context, source, target string) (u User, merged bool, err error) {
+	ctx, span := tracer.Start(ctx, "mergeUsers", trace.WithAttributes(
+		attribute.String("user.id", source),
+		attribute.String("merge.into", target),
+	))
+	defer func() { finishSpan(span, err) }()
+
+	err = withTx(ctx, a.dbForID(source), func(tx *sql.Tx) error {
+		// both rows locked (in id order, like bulk updates) so neither can change or vanish mid-merge
+		locked, err := a.lockUsers(ctx, tx, []string{source, target})
+		if err != nil || len(locked) < 2 {
+			return err
+		}
+		for _, l := range locked {
+			if l.ID != source {
+				u = l
+			}
+		}
+
+		if _, err := a.exec(ctx, tx, "mergeUsers.delete",
+			`DELETE FROM users WHERE id = $1 AND tenant_id = $2`,
+			source, GetTenantID(ctx),
+		); err != nil {
+			return err
+		}
+		merged = true
+		return a.notifyUserChanged(ctx, tx, source)
+	})
+	if err != nil || !merged {
+		return User{}, false, err
+	}
+
+	a.events.publish(userEvent{Type: eventDeleted, ID: source, TenantID: GetTenantID(ctx)})
+	return u, true, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseMergeTarget(t *testing.T) {
+	tests := []struct {
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{body: `{"into":"42"}`, want: "42"},
+		{body: `{"into":42}`, want: "42"},
+		{body: `{}`, wantErr: true},
+		{body: `{"into":"abc"}`, wantErr: true},
+		{body: `{"into":"-3"}`, wantErr: true},
+		{body: `not json`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMergeTarget(strings.NewReader(tt.body))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseMergeTarget(%s) = %q, %v; want %q, err=%v", tt.body, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMergeUserIntoSelf(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+
+	// rejected before any DB access, so no DB is needed
+	w := httptest.NewRecorder()
+	route(a).ServeHTTP(w, httptest.NewRequest("POST", "/users/7/merge", strings.NewReader(`{"into":"7"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("merge into self: got %d, want 400", w.Code)
+	}
+}
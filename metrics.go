@@ -0,0 +1,93 @@
+// metrics.go contains the Prometheus metrics exposed on /metrics.
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total number of HTTP requests.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency in seconds.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	panicsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "panics_total",
+		Help: "Total number of panics recovered by recoverMiddleware.",
+	})
+
+	requestsShedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "http_requests_shed_total",
+		Help: "Total number of requests rejected by concurrencyLimitMiddleware.",
+	})
+
+	// userLookupsTotal splits GET /users/{id} lookups by how getUserByIdDedupe served them:
+	// cache (no DB), leader (ran the DB fetch) or follower (joined a leader's fetch instead of its own).
+	// follower / (leader + follower) is the share of DB reads the dedupe saved.
+	userLookupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_lookups_total",
+		Help: "Total number of user lookups by id, by role in the request dedupe.",
+	}, []string{"role"})
+
+	// userLookupsInflight is the size of the inflight map, a key that stays there points at a hot user
+	userLookupsInflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "user_lookups_inflight",
+		Help: "Number of user ids with a DB fetch in flight.",
+	})
+)
+
+// routePatternKey holds a *string that recordPattern fills in with the pattern the mux matched
+const routePatternKey ctxKey = "route_pattern"
+
+// withRoutePattern gives r a place for recordPattern to leave the matched pattern in, which it returns.
+// The mux sets r.Pattern only on the request it's handed, and any middleware in between that calls
+// r.WithContext hands it a copy, so the outer middleware can't read it off its own r.
+func withRoutePattern(r *http.Request) (*http.Request, *string) {
+	pattern := new(string)
+	return r.WithContext(context.WithValue(r.Context(), routePatternKey, pattern)), pattern
+}
+
+// recordPattern wraps the mux, copying the pattern it matched to the place withRoutePattern set up
+func recordPattern(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		if p, ok := r.Context().Value(routePatternKey).(*string); ok {
+			*p = r.Pattern
+		}
+	})
+}
+
+// routeLabel returns the matched mux pattern without its method, e.g. "/users/{id}".
+// Using the pattern instead of the concrete path keeps label cardinality bounded,
+// unmatched requests all share one label for the same reason.
+func routeLabel(pattern string) string {
+	if pattern == "" {
+		return "unmatched"
+	}
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		return path
+	}
+	return pattern
+}
+
+// observeRequest records one finished request in the counter and latency histogram.
+// pattern is the one the mux matched, see withRoutePattern.
+func observeRequest(r *http.Request, pattern string, status int, d time.Duration) {
+	route := routeLabel(pattern)
+	code := strconv.Itoa(status)
+	httpRequestsTotal.WithLabelValues(r.Method, route, code).Inc()
+	httpRequestDuration.WithLabelValues(r.Method, route, code).Observe(d.Seconds())
+}
@@ -3,16 +3,39 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"regexp"
 	"runtime/debug"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const requestIDKey ctxKey = "request_id"
 
+// middleware wraps a handler, the shape every middleware in this file has
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in mws so they run in the order listed: mws[0] sees the request first
+// and the response last. route() relies on this to keep the stack readable.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// otelMiddleware starts the server span for each request
+func otelMiddleware(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "users-api")
+}
+
 // GetRequestID safely extracts the request ID from context.
 // Returns empty string if missing (shouldn't happen once middleware is wired).
 func GetRequestID(ctx context.Context) string {
@@ -26,10 +49,122 @@ func GetRequestID(ctx context.Context) string {
 	return ""
 }
 
-func requestIDMiddleware(next http.Handler) http.Handler {
+// requestIDPattern is the short opaque form we accept besides UUIDs
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// validRequestID reports whether a client-supplied id is sane enough to put in our logs
+func validRequestID(rid string) bool {
+	if _, err := uuid.Parse(rid); err == nil {
+		return true
+	}
+	return requestIDPattern.MatchString(rid)
+}
+
+// trailingSlashMiddleware makes /users/ the same as /users (cfg.trailingSlash). No route ends in a slash,
+// so without it the mux 404s them. With "redirect" the client gets a 308 to the canonical path (method and
+// body are kept), with "rewrite" the request is routed as if the slash weren't there.
+func (a *api) trailingSlashMiddleware(next http.Handler) http.Handler {
+	if a.cfg.trailingSlash == "off" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimRight(r.URL.Path, "/")
+		// "//host/" would become a redirect to another host, the mux cleans those paths itself
+		if path == r.URL.Path || path == "" || strings.HasPrefix(path, "//") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u := *r.URL
+		u.Path = path
+		u.RawPath = strings.TrimRight(u.RawPath, "/")
+
+		if a.cfg.trailingSlash == "redirect" {
+			http.Redirect(w, r, u.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+		r2 := *r
+		r2.URL = &u
+		next.ServeHTTP(w, &r2)
+	})
+}
+
+// hstsHeader tells browsers to use https only for the next year
+const hstsHeader = "max-age=31536000"
+
+// errHTTPSRequired is a non-GET/HEAD request that came in over plain HTTP with FORCE_HTTPS set
+var errHTTPSRequired = &APIError{Status: http.StatusBadRequest, Code: "https_required", Message: "use https"}
+
+// httpsMiddleware enforces HTTPS behind a TLS-terminating proxy (cfg.forceHTTPS), a no-op otherwise.
+// The proxy reports the client's scheme in X-Forwarded-Proto: a GET or HEAD over http is redirected
+// to https with 308, anything else is rejected since its body already went out in the clear.
+// Requests without the header didn't come through the proxy (probes, local dev) and pass.
+// Every response gets Strict-Transport-Security.
+func (a *api) httpsMiddleware(next http.Handler) http.Handler {
+	if !a.cfg.forceHTTPS {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", hstsHeader)
+
+		if r.Header.Get("X-Forwarded-Proto") == "http" {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				writeError(w, errHTTPSRequired)
+				return
+			}
+			http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errOverloaded is a request shed by concurrencyLimitMiddleware because MAX_CONCURRENT_REQUESTS are already running
+var errOverloaded = &APIError{Status: http.StatusServiceUnavailable, Code: "overloaded", Message: "server is at capacity, retry shortly"}
+
+// unlimitedPaths bypass concurrencyLimitMiddleware: probes and scrapes must keep answering under load,
+// and the event streams stay open for as long as the client listens, so they'd pin a slot each
+var unlimitedPaths = map[string]bool{
+	"/health":       true,
+	"/readyz":       true,
+	"/metrics":      true,
+	"/users/events": true,
+	"/users/ws":     true,
+}
+
+// concurrencyLimitMiddleware sheds load: at most cfg.maxConcurrentRequests requests run at once and
+// the rest get an immediate 503 with Retry-After, instead of queueing for a DB pool that is already
+// backed up and timing out anyway. A no-op when the limit is 0.
+func (a *api) concurrencyLimitMiddleware(next http.Handler) http.Handler {
+	if a.cfg.maxConcurrentRequests <= 0 {
+		return next
+	}
+	sem := make(chan struct{}, a.cfg.maxConcurrentRequests)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rid := r.Header.Get("X-Request-ID")
-		if rid == "" {
+		if unlimitedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		default:
+			requestsShedTotal.Inc()
+			writeError(w, errOverloaded)
+		}
+	})
+}
+
+// requestIDMiddleware reuses the client's request id (cfg.requestIDHeader, X-Request-ID by default)
+// if it is well formed, otherwise stamps a fresh UUID.
+func (a *api) requestIDMiddleware(next http.Handler) http.Handler {
+	header := a.cfg.requestIDHeader
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rid := r.Header.Get(header)
+		if !validRequestID(rid) {
 			rid = uuid.NewString()
 		}
 
@@ -37,7 +172,10 @@ func requestIDMiddleware(next http.Handler) http.Handler {
 		ctx := context.WithValue(r.Context(), requestIDKey, rid)
 		r = r.WithContext(ctx)
 
-		w.Header().Set("X-Request-ID", rid)
+		w.Header().Set(header, rid)
+
+		// tag the server span so traces and logs can be correlated by request id
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("request_id", rid))
 
 		next.ServeHTTP(w, r)
 	})
@@ -52,9 +190,15 @@ func (sr *statusRecorder) WriteHeader(code int) {
 	sr.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer (e.g. to Flush SSE)
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		r, pattern := withRoutePattern(r)
 
 		sr := &statusRecorder{
 			ResponseWriter: w,
@@ -63,6 +207,9 @@ func loggingMiddleware(next http.Handler) http.Handler {
 
 		next.ServeHTTP(sr, r)
 
+		duration := time.Since(start)
+		observeRequest(r, *pattern, sr.status, duration)
+
 		rid := GetRequestID(r.Context())
 		log.Printf(
 			"request_id=%s method=%s path=%s status=%d duration=%s",
@@ -70,26 +217,37 @@ func loggingMiddleware(next http.Handler) http.Handler {
 			r.Method,
 			r.URL.Path,
 			sr.status,
-			time.Since(start),
+			duration,
 		)
 	})
 }
 
-// recoverMiddleware recovers from panics and logs the panic.
+// recoverMiddleware recovers from panics, logs them, counts them in panics_total and calls onPanic if set.
 // To test put panic("test panic recovery") at the start of the handler you want to test
-func recoverMiddleware(next http.Handler) http.Handler {
+func (a *api) recoverMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Catch panics from downstream middleware/handlers.
 		defer func() {
 			if rec := recover(); rec != nil {
-				rid := GetRequestID(r.Context())
+				// recoverMiddleware sits outside requestIDMiddleware, so the id is only on the response header
+				rid := w.Header().Get(a.cfg.requestIDHeader)
 
 				// Log panic + stack trace (stack trace is gold for debugging)
 				log.Printf("panic recovered request_id=%s panic=%v\n%s", rid, rec, debug.Stack())
+				panicsTotal.Inc()
+				if a.onPanic != nil {
+					a.onPanic(panicAlert{
+						Message:   fmt.Sprint(rec),
+						RequestID: rid,
+						Method:    r.Method,
+						Path:      r.URL.Path,
+						Time:      time.Now().UTC(),
+					})
+				}
 
 				// If headers/body already started, we can't reliably send a new response.
 				// But for most handler panics, this will still work fine.
-				http.Error(w, "internal server error", http.StatusInternalServerError)
+				writeError(w, failed("internal server error", fmt.Errorf("panic: %v", rec)))
 			}
 		}()
 
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		rid  string
+		want bool
+	}{
+		{"", false},
+		{"0b8c6a8e-3f5e-4c1a-9a8e-2f1b7c6d5e4f", true},
+		{"{0b8c6a8e-3f5e-4c1a-9a8e-2f1b7c6d5e4f}", true},
+		{"abc-123_XYZ", true},
+		{"has space", false},
+		{"new\nline", false},
+		{"semi;colon", false},
+		{string(make([]byte, 65)), false},
+		{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", true},
+		{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", false},
+	}
+
+	for _, tt := range tests {
+		if got := validRequestID(tt.rid); got != tt.want {
+			t.Errorf("validRequestID(%q) = %v, want %v", tt.rid, got, tt.want)
+		}
+	}
+}
+
+func TestBodyLogMiddlewarePreservesBodies(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.logBodies = true
+	cfg.logBodiesMax = 4
+	a := newAPI(cfg, nil, newMemoryCache())
+
+	var got string
+	h := a.bodyLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got = string(b)
+		_, _ = w.Write([]byte("response body"))
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/users", strings.NewReader(`{"firstName":"James"}`)))
+
+	if got != `{"firstName":"James"}` {
+		t.Errorf("handler saw a different request body: %q", got)
+	}
+	if w.Body.String() != "response body" {
+		t.Errorf("client got a different response body: %q", w.Body.String())
+	}
+}
+
+func TestRequestIDMiddlewareCustomHeader(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.requestIDHeader = "X-Correlation-ID"
+	a := newAPI(cfg, nil, newMemoryCache())
+
+	var got string
+	h := a.requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = GetRequestID(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/users", nil)
+	r.Header.Set("X-Correlation-ID", "abc-123")
+	h.ServeHTTP(w, r)
+
+	if got != "abc-123" {
+		t.Errorf("context request id = %q, want abc-123", got)
+	}
+	if v := w.Header().Get("X-Correlation-ID"); v != "abc-123" {
+		t.Errorf("X-Correlation-ID = %q, want abc-123", v)
+	}
+	if v := w.Header().Get("X-Request-ID"); v != "" {
+		t.Errorf("X-Request-ID should not be set, got %q", v)
+	}
+}
+
+func TestRecoverMiddlewareReportsPanic(t *testing.T) {
+	got := make(chan panicAlert, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert panicAlert
+		_ = json.NewDecoder(r.Body).Decode(&alert)
+		got <- alert
+	}))
+	defer webhook.Close()
+
+	cfg := defaultConfig()
+	cfg.panicWebhookURL = webhook.URL
+	a := newAPI(cfg, nil, newMemoryCache())
+	h := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), a.recoverMiddleware, a.requestIDMiddleware)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/users/1", nil)
+	r.Header.Set("X-Request-ID", "rid-1")
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	select {
+	case alert := <-got:
+		if alert.Message != "boom" || alert.RequestID != "rid-1" || alert.Path != "/users/1" {
+			t.Errorf("unexpected alert %+v", alert)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+}
+
+func TestHTTPSMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	serve := func(a *api, method, proto string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://api.example.com/users?limit=5", nil)
+		if proto != "" {
+			r.Header.Set("X-Forwarded-Proto", proto)
+		}
+		w := httptest.NewRecorder()
+		a.httpsMiddleware(ok).ServeHTTP(w, r)
+		return w
+	}
+
+	// off (local dev): nothing changes, not even HSTS
+	off := newAPI(defaultConfig(), nil, newMemoryCache())
+	if w := serve(off, "GET", "http"); w.Code != http.StatusNoContent || w.Header().Get("Strict-Transport-Security") != "" {
+		t.Errorf("disabled: got %d hsts=%q", w.Code, w.Header().Get("Strict-Transport-Security"))
+	}
+
+	cfg := defaultConfig()
+	cfg.forceHTTPS = true
+	a := newAPI(cfg, nil, newMemoryCache())
+
+	w := serve(a, "GET", "http")
+	if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != "https://api.example.com/users?limit=5" {
+		t.Errorf("http GET: got %d Location=%q, want 308 to https", w.Code, w.Header().Get("Location"))
+	}
+	if w := serve(a, "POST", "http"); w.Code != http.StatusBadRequest {
+		t.Errorf("http POST: got %d, want 400", w.Code)
+	}
+	for _, proto := range []string{"https", ""} {
+		w := serve(a, "GET", proto)
+		if w.Code != http.StatusNoContent || w.Header().Get("Strict-Transport-Security") != hstsHeader {
+			t.Errorf("proto %q: got %d hsts=%q, want it passed with HSTS", proto, w.Code, w.Header().Get("Strict-Transport-Security"))
+		}
+	}
+}
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.maxConcurrentRequests = 1
+	a := newAPI(cfg, nil, newMemoryCache())
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := a.concurrencyLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users/1" {
+			close(entered)
+			<-release
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// the only slot is taken by a request that is still running
+	done := make(chan struct{})
+	go func() { serve("/users/1"); close(done) }()
+	<-entered
+
+	if w := serve("/users/2"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("over the limit: got %d Retry-After=%q, want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := serve("/health"); w.Code != http.StatusNoContent {
+		t.Errorf("/health over the limit: got %d, want it to bypass the limiter", w.Code)
+	}
+
+	close(release)
+	<-done
+	if w := serve("/users/2"); w.Code != http.StatusNoContent {
+		t.Errorf("after the slot is freed: got %d, want 204", w.Code)
+	}
+}
+
+func TestTrailingSlashMiddleware(t *testing.T) {
+	var seen string
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.Path
+		w.WriteHeader(http.StatusNoContent)
+	})
+	serve := func(mode, method, target string) *httptest.ResponseRecorder {
+		cfg := defaultConfig()
+		cfg.trailingSlash = mode
+		seen = ""
+		w := httptest.NewRecorder()
+		newAPI(cfg, nil, newMemoryCache()).trailingSlashMiddleware(ok).ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	w := serve("redirect", "POST", "/users/?upsert=true")
+	if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != "/users?upsert=true" {
+		t.Errorf("redirect: got %d Location=%q, want 308 to /users?upsert=true", w.Code, w.Header().Get("Location"))
+	}
+	if w := serve("rewrite", "GET", "/users/7//"); w.Code != http.StatusNoContent || seen != "/users/7" {
+		t.Errorf("rewrite: got %d path %q, want /users/7 served", w.Code, seen)
+	}
+	if w := serve("off", "GET", "/users/"); w.Code != http.StatusNoContent || seen != "/users/" {
+		t.Errorf("off: got %d path %q, want it untouched", w.Code, seen)
+	}
+	// the root, and paths that would redirect off-site, pass through
+	for _, target := range []string{"/", "//evil.example/"} {
+		if w := serve("redirect", "GET", target); w.Code != http.StatusNoContent {
+			t.Errorf("%s: got %d Location=%q, want it passed", target, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRequestMetricsRouteLabel(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	count := func(route, status string) float64 {
+		return testutil.ToFloat64(httpRequestsTotal.WithLabelValues("GET", route, status))
+	}
+
+	// tenantMiddleware and friends hand the mux a copy of the request, the label must still be the pattern
+	before, unmatched := count("/users/{id}", "400"), count("unmatched", "400")
+	w := httptest.NewRecorder()
+	route(a).ServeHTTP(w, httptest.NewRequest("GET", "/users/abc", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("GET /users/abc = %d, want 400", w.Code)
+	}
+	if got := count("/users/{id}", "400") - before; got != 1 {
+		t.Errorf(`route="/users/{id}" counted %v times, want 1`, got)
+	}
+	if count("unmatched", "400") != unmatched {
+		t.Error(`a matched request was counted as route="unmatched"`)
+	}
+}
@@ -0,0 +1,190 @@
+// migrate.go versions the schema: the migrations below run in order, each at most once per database,
+// and schema_migrations records which ones a database has had.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// migration is one schema change. Once released its version and SQL never change: fixing or undoing
+// it is a new migration at the end of the list. {{id_column}} and {{id_type}} in the SQL stand for the
+// id column definition and type of ID_TYPE, see migrationSQL.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrations is every schema change, in the order they're applied. 1 to 7 are the schema from before
+// it was versioned, written with IF NOT EXISTS so a database created back then takes them as a no-op
+// and just records them. Later ones can be plain DDL. They run inside a transaction, so nothing here
+// can use CREATE INDEX CONCURRENTLY.
+var migrations = []migration{
+	{1, "create users", `
+	CREATE TABLE IF NOT EXISTS users (
+		id {{id_column}} PRIMARY KEY,
+		first_name TEXT NOT NULL,
+		last_name  TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		UNIQUE(first_name, last_name)
+	);`},
+	{2, "add phone and updated_at", `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS phone TEXT;
+	-- rows that already exist were last updated when they were created, not when this runs, so the
+	-- column is filled from created_at before it gets its default
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+	UPDATE users SET updated_at = created_at WHERE updated_at IS NULL;
+	ALTER TABLE users ALTER COLUMN updated_at SET DEFAULT now(), ALTER COLUMN updated_at SET NOT NULL;`},
+	{3, "add tenants", `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id BIGINT NOT NULL DEFAULT 1;
+	-- names are only unique within a tenant
+	ALTER TABLE users DROP CONSTRAINT IF EXISTS users_first_name_last_name_key;
+	CREATE UNIQUE INDEX IF NOT EXISTS users_tenant_id_first_name_last_name_key ON users (tenant_id, first_name, last_name);
+	-- every query filters on tenant first, so these lead with it too:
+	-- sorting/filtering by last name, and keyset pagination on (created_at, id)
+	CREATE INDEX IF NOT EXISTS users_tenant_id_last_name_first_name_idx ON users (tenant_id, last_name, first_name);
+	CREATE INDEX IF NOT EXISTS users_tenant_id_created_at_id_idx ON users (tenant_id, created_at, id);`},
+	{4, "add is_active", `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS is_active BOOLEAN NOT NULL DEFAULT true;`},
+	{5, "add full_name", `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS full_name TEXT GENERATED ALWAYS AS (first_name || ' ' || last_name) STORED;`},
+	{6, "add name_hash", `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS name_hash TEXT;
+	-- with PII_ENCRYPTION_KEY the names are ciphertext (never equal), uniqueness moves to their HMAC.
+	-- Plaintext rows have a NULL name_hash, which this index ignores
+	CREATE UNIQUE INDEX IF NOT EXISTS users_tenant_id_name_hash_key ON users (tenant_id, name_hash);`},
+	{7, "create events", `
+	-- the change feed GET /users/events?since= replays, written by a trigger so every change to users
+	-- lands in the same transaction as the change itself. tx_id lets readers skip rows whose
+	-- transaction may still be in flight, see eventsSince
+	CREATE TABLE IF NOT EXISTS events (
+		seq BIGSERIAL PRIMARY KEY,
+		tenant_id BIGINT NOT NULL,
+		type TEXT NOT NULL,
+		user_id {{id_type}} NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		tx_id XID8 NOT NULL DEFAULT pg_current_xact_id()
+	);
+	CREATE INDEX IF NOT EXISTS events_tenant_id_seq_idx ON events (tenant_id, seq);
+
+	CREATE OR REPLACE FUNCTION record_user_event() RETURNS trigger AS $$
+	DECLARE
+		r users;
+		t TEXT;
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			r := OLD;
+			t := 'deleted';
+		ELSE
+			r := NEW;
+			t := CASE TG_OP WHEN 'INSERT' THEN 'created' ELSE 'updated' END;
+		END IF;
+		-- the payload is the SSE message, names stay out of it (they may be encrypted, see PII_ENCRYPTION_KEY)
+		INSERT INTO events (tenant_id, type, user_id, payload)
+		VALUES (r.tenant_id, t, r.id, jsonb_build_object('type', t, 'id', r.id::text));
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS users_record_event ON users;
+	CREATE TRIGGER users_record_event AFTER INSERT OR UPDATE OR DELETE ON users
+		FOR EACH ROW EXECUTE FUNCTION record_user_event();`},
+}
+
+// migrateLockID is the pg_advisory_xact_lock key migrate holds, any constant no other code locks on
+const migrateLockID = 0x75736572 // "user"
+
+// migrationSQL is m's SQL for this ID_TYPE. The bigint version is the SQL from before ids were configurable.
+func migrationSQL(m migration) string {
+	column, typ := "BIGSERIAL", "BIGINT"
+	if uuidIDs {
+		column, typ = "UUID DEFAULT gen_random_uuid()", "UUID"
+	}
+	return strings.NewReplacer("{{id_column}}", column, "{{id_type}}", typ).Replace(m.sql)
+}
+
+// pendingMigrations is the migrations not in applied, in order
+func pendingMigrations(applied map[int]bool) []migration {
+	var pending []migration
+	for _, m := range migrations {
+		if !applied[m.version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// migrate brings db up to the latest migration in a single transaction, so a failing migration leaves
+// the schema exactly as it was. Replicas starting together queue on an advisory lock: the first one
+// applies the pending migrations and the rest find none left. Returns how many it applied.
+func migrate(ctx context.Context, db *sql.DB) (applied int, err error) {
+	// schema changes can take a while on a big table, DB_STATEMENT_TIMEOUT is for requests
+	err = withStatementTimeout(ctx, db, 0, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrateLockID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version INT PRIMARY KEY,
+				name TEXT NOT NULL,
+				applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+			)`,
+		); err != nil {
+			return err
+		}
+
+		done, err := appliedMigrations(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for v := range done {
+			if v > len(migrations) {
+				// a newer build migrated this database, e.g. during a rollback. Its changes are additive, carry on
+				log.Printf("schema: database has migration %d, this build only knows up to %d", v, len(migrations))
+				break
+			}
+		}
+
+		for _, m := range pendingMigrations(done) {
+			if _, err := tx.ExecContext(ctx, migrationSQL(m)); err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+			}
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.version, m.name,
+			); err != nil {
+				return err
+			}
+			log.Printf("schema: applied migration %d (%s)", m.version, m.name)
+			applied++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return applied, nil
+}
+
+// appliedMigrations is the set of versions schema_migrations has
+func appliedMigrations(ctx context.Context, tx *sql.Tx) (map[int]bool, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := map[int]bool{}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		done[v] = true
+	}
+	return done, rows.Err()
+}
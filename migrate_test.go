@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	// versions are 1..n in order: a gap or reorder would make existing databases skip or repeat one
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migrations[%d] has version %d, want %d", i, m.version, i+1)
+		}
+		if m.name == "" || strings.TrimSpace(m.sql) == "" {
+			t.Errorf("migration %d needs a name and SQL", m.version)
+		}
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	if got := pendingMigrations(nil); len(got) != len(migrations) {
+		t.Errorf("fresh database: %d pending, want all %d", len(got), len(migrations))
+	}
+
+	// applied out of order (two branches merged): only the missing ones run, still in order
+	got := pendingMigrations(map[int]bool{1: true, 3: true, 99: true})
+	if len(got) != len(migrations)-2 || got[0].version != 2 || got[1].version != 4 {
+		t.Errorf("pending = %v, want 2, 4, ...", got)
+	}
+}
+
+func TestMigrationSQL(t *testing.T) {
+	create := migrationSQL(migrations[0])
+	if !strings.Contains(create, "id BIGSERIAL PRIMARY KEY") {
+		t.Errorf("default ids should stay BIGSERIAL:\n%s", create)
+	}
+
+	withUUIDIDs(t)
+	if create := migrationSQL(migrations[0]); !strings.Contains(create, "id UUID DEFAULT gen_random_uuid() PRIMARY KEY") {
+		t.Errorf("ID_TYPE=uuid should create a uuid id:\n%s", create)
+	}
+	for _, m := range migrations {
+		if sql := migrationSQL(m); strings.Contains(sql, "{{") || strings.Contains(sql, "id BIGSERIAL") || strings.Contains(sql, "user_id BIGINT") {
+			t.Errorf("migration %d has an id placeholder or bigint id left:\n%s", m.version, sql)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// nonce.go rejects replayed requests: a request's X-Nonce may only be used once within cfg.nonceTTL.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// nonceHeader carries the client's one-time value
+const nonceHeader = "X-Nonce"
+
+// noncePattern is a sane nonce: UUIDs, hex and base64 (standard or URL-safe) all fit
+var noncePattern = regexp.MustCompile(`^[A-Za-z0-9_.:+/=-]{8,128}$`)
+
+var (
+	errNonceReplayed = &APIError{Status: http.StatusConflict, Code: "nonce_replayed", Message: "this X-Nonce was already used"}
+	errNonceRequired = &APIError{Status: http.StatusBadRequest, Code: "nonce_required", Message: "X-Nonce is required"}
+	errNonceInvalid  = &APIError{Status: http.StatusBadRequest, Code: "invalid_nonce", Message: "X-Nonce must be 8-128 characters of [A-Za-z0-9_.:+/=-]"}
+	// errNonceStoreFull is a fresh nonce arriving while maxNonces live ones are remembered. Forgetting
+	// one early would let it be replayed, so the request is refused instead.
+	errNonceStoreFull = &APIError{Status: http.StatusServiceUnavailable, Code: "unavailable", Message: "too many nonces in flight, retry later"}
+)
+
+// maxNonces caps how many unexpired nonces a nonceStore holds, at 128 bytes each about 20MB
+const maxNonces = 100_000
+
+// nonceStore remembers nonces until they expire. It lives in memory and is per process: each replica
+// has its own, so a replay sent to another replica isn't caught. Expired ones are swept at most once
+// per ttl on the way through use, and it never holds more than max. A full store isn't swept early:
+// that would be a scan of max entries per refused request.
+type nonceStore struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	ttl       time.Duration
+	max       int
+	nextSweep time.Time
+}
+
+func newNonceStore(ttl time.Duration, max int) *nonceStore {
+	return &nonceStore{seen: make(map[string]time.Time), ttl: ttl, max: max}
+}
+
+// nonceKey scopes a nonce to its tenant, two tenants can't spend each other's nonces
+func nonceKey(tenant int64, nonce string) string {
+	return fmt.Sprintf("%d:%s", tenant, nonce)
+}
+
+// use records key (see nonceKey) if it's fresh. errNonceReplayed means it was seen within the TTL,
+// errNonceStoreFull that it wasn't but there's no room to remember it until the next sweep.
+func (s *nonceStore) use(key string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if expires, ok := s.seen[key]; ok && !now.After(expires) {
+		return errNonceReplayed
+	}
+	if now.After(s.nextSweep) {
+		for n, expires := range s.seen {
+			if now.After(expires) {
+				delete(s.seen, n)
+			}
+		}
+		s.nextSweep = now.Add(s.ttl)
+	}
+	if len(s.seen) >= s.max {
+		return errNonceStoreFull
+	}
+	s.seen[key] = now.Add(s.ttl)
+	return nil
+}
+
+// nonceMiddleware answers a request whose X-Nonce was already used with 409. A nonce is spent as soon
+// as it's seen, whatever the response: a retry needs a fresh one. Without the header a request passes,
+// unless cfg.nonceRequired makes it mandatory for writes. Off when cfg.nonceTTL is 0.
+func (a *api) nonceMiddleware(next http.Handler) http.Handler {
+	if a.cfg.nonceTTL <= 0 {
+		return next
+	}
+	store := newNonceStore(a.cfg.nonceTTL, maxNonces)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := r.Header.Get(nonceHeader)
+		switch {
+		case nonce == "":
+			if a.cfg.nonceRequired && !readOnlyRequest(r) {
+				writeError(w, errNonceRequired)
+				return
+			}
+		case !noncePattern.MatchString(nonce):
+			writeError(w, errNonceInvalid)
+			return
+		default:
+			// tenantMiddleware further in hasn't run yet, the header is read the same way it will be
+			tenant, err := requestTenant(r)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if err := store.use(nonceKey(tenant, nonce), time.Now()); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
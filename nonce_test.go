@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNonceStore(t *testing.T) {
+	s := newNonceStore(time.Minute, maxNonces)
+	now := time.Now()
+	if s.use("nonce-aaaa", now) != nil || s.use("nonce-aaaa", now.Add(30*time.Second)) != errNonceReplayed {
+		t.Error("a nonce must be usable exactly once within the TTL")
+	}
+	if s.use("nonce-aaaa", now.Add(2*time.Minute)) != nil {
+		t.Error("an expired nonce should be usable again")
+	}
+
+	// expired entries are swept, so the map doesn't grow forever
+	s.use("nonce-bbbb", now.Add(2*time.Minute))
+	s.use("nonce-cccc", now.Add(10*time.Minute))
+	if len(s.seen) != 1 {
+		t.Errorf("%d nonces kept, want only the live one", len(s.seen))
+	}
+
+	// full: a new nonce is refused rather than an old one forgotten, until some expire
+	s = newNonceStore(time.Minute, 2)
+	s.use("nonce-aaaa", now)
+	s.use("nonce-bbbb", now.Add(time.Second))
+	if err := s.use("nonce-cccc", now.Add(2*time.Second)); err != errNonceStoreFull {
+		t.Errorf("third nonce in a store of 2: %v, want errNonceStoreFull", err)
+	}
+	if err := s.use("nonce-aaaa", now.Add(3*time.Second)); err != errNonceReplayed {
+		t.Errorf("replay in a full store: %v, want errNonceReplayed", err)
+	}
+	if err := s.use("nonce-cccc", now.Add(61*time.Second)); err != nil || len(s.seen) != 2 {
+		t.Errorf("after the first expired: %v with %d kept, want room for one more", err, len(s.seen))
+	}
+	// bbbb has expired, but the store stays full until the next scheduled sweep
+	if err := s.use("nonce-dddd", now.Add(100*time.Second)); err != errNonceStoreFull {
+		t.Errorf("full store before its sweep: %v, want errNonceStoreFull", err)
+	}
+	if err := s.use("nonce-dddd", now.Add(122*time.Second)); err != nil {
+		t.Errorf("after the sweep: %v, want room again", err)
+	}
+}
+
+func TestNonceMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	cfg := defaultConfig()
+	cfg.nonceTTL = time.Minute
+	h := newAPI(cfg, nil, newMemoryCache()).nonceMiddleware(ok)
+	cfg.nonceRequired = true
+	strict := newAPI(cfg, nil, newMemoryCache()).nonceMiddleware(ok)
+
+	serve := func(h http.Handler, method, nonce, tenant string) int {
+		r := httptest.NewRequest(method, "/users", nil)
+		if nonce != "" {
+			r.Header.Set(nonceHeader, nonce)
+		}
+		if tenant != "" {
+			r.Header.Set(tenantHeader, tenant)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, tc := range []struct {
+		name    string
+		h       http.Handler
+		method  string
+		nonce   string
+		tenant  string
+		wantSts int
+	}{
+		{"first use", h, "POST", "3f2b8c1e-0001", "", http.StatusNoContent},
+		{"replay", h, "POST", "3f2b8c1e-0001", "", http.StatusConflict},
+		{"replay as GET", h, "GET", "3f2b8c1e-0001", "", http.StatusConflict},
+		{"replay as the default tenant", h, "POST", "3f2b8c1e-0001", "1", http.StatusConflict},
+		{"same nonce, other tenant", h, "POST", "3f2b8c1e-0001", "2", http.StatusNoContent},
+		{"replay, tenant 2 spelled 02", h, "POST", "3f2b8c1e-0001", "02", http.StatusConflict},
+		{"bad tenant", h, "POST", "3f2b8c1e-0002", "x", http.StatusBadRequest},
+		{"malformed", h, "POST", "short", "", http.StatusBadRequest},
+		{"none, lenient", h, "POST", "", "", http.StatusNoContent},
+		{"none, strict write", strict, "POST", "", "", http.StatusBadRequest},
+		{"none, strict read", strict, "GET", "", "", http.StatusNoContent},
+	} {
+		if got := serve(tc.h, tc.method, tc.nonce, tc.tenant); got != tc.wantSts {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.wantSts)
+		}
+	}
+}
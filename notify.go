@@ -0,0 +1,81 @@
+// notify.go keeps the in-memory cache coherent across replicas using Postgres LISTEN/NOTIFY.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const userChangedChannel = "user_changed"
+
+// notifyUserChanged queues a NOTIFY with "<instanceID> <cache key>" on tx.
+// Postgres only delivers it once tx commits, so a rolled back change never invalidates anything.
+func (a *api) notifyUserChanged(ctx context.Context, tx *sql.Tx, id string) error {
+	payload := a.instanceID + " " + tenantKey(ctx, id)
+	_, err := a.exec(ctx, tx, "notifyUserChanged", `SELECT pg_notify($1, $2)`, userChangedChannel, payload)
+	return err
+}
+
+// changedKey parses a notification payload, own is true when this process sent it.
+// Our own writes already refreshed the cache (see refreshUserCache), evicting again would undo a repopulate.
+func (a *api) changedKey(payload string) (key string, own bool) {
+	origin, key, ok := strings.Cut(payload, " ")
+	if !ok {
+		return payload, false
+	}
+	return key, origin == a.instanceID
+}
+
+// listenForInvalidations holds a dedicated connection LISTENing on user_changed and
+// evicts every key it hears about from the local cache. It runs until ctx is canceled,
+// reconnecting with capped exponential backoff whenever the connection drops.
+// Changes made while disconnected are missed, those entries are stale for at most the cache TTL.
+func (a *api) listenForInvalidations(ctx context.Context, dsn string) {
+	const maxBackoff = 30 * time.Second
+	backoff := time.Second
+
+	for {
+		err := a.listenOnce(ctx, dsn, func() { backoff = time.Second })
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("invalidation listener: %v (reconnecting in %s)", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// listenOnce connects, LISTENs and processes notifications until the connection fails.
+func (a *api) listenOnce(ctx context.Context, dsn string, onConnected func()) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	if _, err := conn.Exec(ctx, "LISTEN "+userChangedChannel); err != nil {
+		return err
+	}
+	onConnected()
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		// the payload already has the tenant-scoped cache key, so skip the invalidateUserCache wrapper
+		if key, own := a.changedKey(n.Payload); !own {
+			a.invalidations.enqueue(key)
+		}
+	}
+}
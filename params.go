@@ -0,0 +1,37 @@
+// params.go implements the opt-in strict query parameter check (STRICT_QUERY_PARAMS).
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// allowedParams rejects the request with 400 when strict mode is on and the query has a
+// parameter not in allowed, e.g. "?fristName=". Returns false if it already wrote the response.
+// With strict mode off (the default, some clients add tracking params) everything is allowed.
+func (a *api) allowedParams(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	if !a.cfg.strictQueryParams {
+		return true
+	}
+
+	if unexpected := unexpectedParams(r, allowed); len(unexpected) > 0 {
+		writeError(w, &ValidationError{Message: fmt.Sprintf("unexpected query parameters: %s", strings.Join(unexpected, ", "))})
+		return false
+	}
+	return true
+}
+
+// unexpectedParams lists the query parameters of r not in allowed, sorted
+func unexpectedParams(r *http.Request, allowed []string) []string {
+	var out []string
+	for name := range r.URL.Query() {
+		if !slices.Contains(allowed, name) {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
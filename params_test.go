@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowedParams(t *testing.T) {
+	tests := []struct {
+		strict bool
+		target string
+		want   int
+	}{
+		{false, "/users?utm_source=x", http.StatusOK},
+		{true, "/users?limit=1&offset=2", http.StatusOK},
+		{true, "/users?limit=1&zeta=1&fristName=x", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		cfg.strictQueryParams = tt.strict
+		a := &api{cfg: cfg}
+
+		rec := httptest.NewRecorder()
+		if a.allowedParams(rec, httptest.NewRequest(http.MethodGet, tt.target, nil), "limit", "offset") {
+			rec.WriteHeader(http.StatusOK)
+		}
+		if rec.Code != tt.want {
+			t.Errorf("strict=%v %s: got %d, want %d", tt.strict, tt.target, rec.Code, tt.want)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.strictQueryParams = true
+	rec := httptest.NewRecorder()
+	(&api{cfg: cfg}).allowedParams(rec, httptest.NewRequest(http.MethodGet, "/users?zeta=1&fristName=x", nil))
+	var body errorBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got, want := body.Error.Message, "unexpected query parameters: fristName, zeta"; got != want {
+		t.Errorf("message = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+// patch.go parses PATCH /users/{id} bodies with JSON Merge Patch (RFC 7396) semantics.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// userPatch is a parsed merge patch. A nil field was absent and is left alone.
+// Nullable columns have a clear flag for an explicit null.
+type userPatch struct {
+	FirstName *string
+	LastName  *string
+	Phone     *string
+	// ClearPhone is set by "phone": null
+	ClearPhone bool
+}
+
+// empty reports whether the patch changes nothing
+func (p userPatch) empty() bool {
+	return p.FirstName == nil && p.LastName == nil && p.Phone == nil && !p.ClearPhone
+}
+
+// parseUserPatch decodes a merge patch body: absent leaves a field alone, null clears it, a value sets it.
+// firstName/lastName can't be cleared or emptied, unknown fields are rejected.
+func parseUserPatch(body io.Reader) (userPatch, error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return userPatch{}, &ValidationError{Message: "invalid json body"}
+	}
+	return patchFromJSON(raw)
+}
+
+// patchFromJSON is parseUserPatch on an already decoded object, for bodies that carry a patch alongside other keys
+func patchFromJSON(raw map[string]json.RawMessage) (userPatch, error) {
+	var p userPatch
+	for key, val := range raw {
+		isNull := string(val) == "null"
+
+		switch key {
+		case "firstName", "lastName":
+			if isNull {
+				return userPatch{}, &ValidationError{Field: key, Message: key + " cannot be null"}
+			}
+			var s string
+			if err := json.Unmarshal(val, &s); err != nil {
+				return userPatch{}, &ValidationError{Field: key, Message: key + " must be a string"}
+			}
+			if s == "" {
+				return userPatch{}, &ValidationError{Field: key, Message: key + " cannot be empty"}
+			}
+			var ok bool
+			if s, ok = normalizeName(s); !ok {
+				return userPatch{}, &ValidationError{Field: key, Message: key + " must be valid UTF-8"}
+			}
+			if key == "firstName" {
+				p.FirstName = &s
+			} else {
+				p.LastName = &s
+			}
+		case "phone":
+			if isNull {
+				p.ClearPhone = true
+				continue
+			}
+			var s string
+			if err := json.Unmarshal(val, &s); err != nil {
+				return userPatch{}, &ValidationError{Field: key, Message: key + " must be a string or null"}
+			}
+			p.Phone = &s
+		default:
+			return userPatch{}, &ValidationError{Field: key, Message: fmt.Sprintf("unknown field %q", key)}
+		}
+	}
+	return p, nil
+}
+
+// changedFields lists the JSON names of the patchable fields that differ between before and after.
+// The order is fixed so responses are stable, a no-op patch gives an empty (not nil) list.
+func changedFields(before, after User) []string {
+	changed := []string{}
+	if before.FirstName != after.FirstName {
+		changed = append(changed, "firstName")
+	}
+	if before.LastName != after.LastName {
+		changed = append(changed, "lastName")
+	}
+	if !equalPtr(before.Phone, after.Phone) {
+		changed = append(changed, "phone")
+	}
+	return changed
+}
+
+// equalPtr compares two optional strings, nil only equals nil
+func equalPtr(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseUserPatch(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name    string
+		body    string
+		want    userPatch
+		wantErr string
+	}{
+		{name: "set first name", body: `{"firstName":"James"}`, want: userPatch{FirstName: str("James")}},
+		{name: "set phone", body: `{"phone":"+14155552671"}`, want: userPatch{Phone: str("+14155552671")}},
+		{name: "clear phone", body: `{"phone":null}`, want: userPatch{ClearPhone: true}},
+		{name: "empty object", body: `{}`, want: userPatch{}},
+		{name: "null name", body: `{"lastName":null}`, wantErr: "lastName cannot be null"},
+		{name: "empty name", body: `{"firstName":""}`, wantErr: "firstName cannot be empty"},
+		{name: "wrong type", body: `{"firstName":1}`, wantErr: "firstName must be a string"},
+		{name: "unknown field", body: `{"email":"x"}`, wantErr: `unknown field "email"`},
+		{name: "not json", body: `nope`, wantErr: "invalid json body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUserPatch(strings.NewReader(tt.body))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !equalPtr(got.FirstName, tt.want.FirstName) || !equalPtr(got.LastName, tt.want.LastName) ||
+				!equalPtr(got.Phone, tt.want.Phone) || got.ClearPhone != tt.want.ClearPhone {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChangedFields(t *testing.T) {
+	str := func(s string) *string { return &s }
+	base := User{FirstName: "Ada", LastName: "Lovelace", Phone: str("+14155552671")}
+
+	tests := []struct {
+		name  string
+		after func(u User) User
+		want  []string
+	}{
+		{"no-op", func(u User) User { u.Phone = str("+14155552671"); return u }, []string{}},
+		{"first name", func(u User) User { u.FirstName = "Augusta"; return u }, []string{"firstName"}},
+		{"phone cleared", func(u User) User { u.Phone = nil; return u }, []string{"phone"}},
+		{"all", func(u User) User {
+			u.FirstName, u.LastName, u.Phone = "A", "B", str("+14155550000")
+			return u
+		}, []string{"firstName", "lastName", "phone"}},
+		// timestamps always move on update, they aren't patchable fields
+		{"only updatedAt", func(u User) User { u.UpdatedAt = u.UpdatedAt.Add(1); return u }, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := changedFields(base, tt.after(base))
+			if got == nil || !slices.Equal(got, tt.want) {
+				t.Errorf("changedFields() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// errInvalidPhone is returned when a phone number can't be parsed into a real number
+var errInvalidPhone = errors.New("invalid phone number")
+
+// normalizePhone parses raw in whatever format it arrived in and returns it in E.164 (+14155552671).
+// Numbers without a country code are read as belonging to defaultRegion (ISO 3166 code, e.g. "US").
+func normalizePhone(raw, defaultRegion string) (string, error) {
+	num, err := phonenumbers.Parse(raw, defaultRegion)
+	if err != nil {
+		return "", errInvalidPhone
+	}
+	if !phonenumbers.IsValidNumber(num) {
+		return "", errInvalidPhone
+	}
+	return phonenumbers.Format(num, phonenumbers.E164), nil
+}
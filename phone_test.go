@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		raw     string
+		region  string
+		want    string
+		wantErr bool
+	}{
+		{raw: "+1 415-555-2671", region: "US", want: "+14155552671"},
+		{raw: "(415) 555-2671", region: "US", want: "+14155552671"},
+		{raw: "415.555.2671", region: "US", want: "+14155552671"},
+		{raw: "020 7946 0958", region: "GB", want: "+442079460958"},
+		{raw: "+44 20 7946 0958", region: "US", want: "+442079460958"},
+		{raw: "not a phone", region: "US", wantErr: true},
+		{raw: "123", region: "US", wantErr: true},
+		{raw: "", region: "US", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizePhone(tt.raw, tt.region)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizePhone(%q, %q) = %q, want error", tt.raw, tt.region, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizePhone(%q, %q): %v", tt.raw, tt.region, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizePhone(%q, %q) = %q, want %q", tt.raw, tt.region, got, tt.want)
+		}
+	}
+}
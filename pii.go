@@ -0,0 +1,239 @@
+// pii.go encrypts user names at rest when PII_ENCRYPTION_KEY is set.
+// Names are sealed with AES-GCM on the way into the DB and opened again in a.scanUser,
+// so handlers, the cache and the JSON only ever see plaintext.
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// sealedPrefix marks an encrypted column value, anything without it is a plaintext row from before encryption
+const sealedPrefix = "enc:v1:"
+
+// errPIIKeyMissing is a sealed value read by a process that has no PII_ENCRYPTION_KEY
+var errPIIKeyMissing = errors.New("user names are encrypted but PII_ENCRYPTION_KEY is not set")
+
+// piiCipher seals and opens name columns. A nil *piiCipher means encryption is off:
+// seal is the identity, open only passes plaintext through and nameHash is NULL.
+type piiCipher struct {
+	aead cipher.AEAD
+	// hashKey keys the name_hash HMAC, derived from the encryption key so there's one secret to manage
+	hashKey []byte
+}
+
+// newPIICipher builds the cipher from a 32-byte AES-256 key
+func newPIICipher(key []byte) (*piiCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("users.name_hash"))
+	return &piiCipher{aead: aead, hashKey: mac.Sum(nil)}, nil
+}
+
+// seal encrypts s for column col with a random nonce, so equal names never look equal in the DB.
+// The column name is the additional data: a first name copied into last_name won't open.
+func (c *piiCipher) seal(col, s string) string {
+	if c == nil {
+		return s
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	_, _ = rand.Read(nonce) // never fails, see crypto/rand.Read
+	return sealedPrefix + base64.StdEncoding.EncodeToString(c.aead.Seal(nonce, nonce, []byte(s), []byte(col)))
+}
+
+// open decrypts a value sealed for col. Plaintext (no sealedPrefix) is returned as is.
+func (c *piiCipher) open(col, s string) (string, error) {
+	enc, ok := strings.CutPrefix(s, sealedPrefix)
+	if !ok {
+		return s, nil
+	}
+	if c == nil {
+		return "", errPIIKeyMissing
+	}
+
+	b, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil || len(b) < c.aead.NonceSize() {
+		return "", fmt.Errorf("open %s: malformed ciphertext", col)
+	}
+	n := c.aead.NonceSize()
+	plain, err := c.aead.Open(nil, b[:n], b[n:], []byte(col))
+	if err != nil {
+		return "", fmt.Errorf("open %s: %w", col, err)
+	}
+	return string(plain), nil
+}
+
+// nameHash is the deterministic stand-in for the name the unique index and lookups use,
+// since sealed names never compare equal. nil (NULL) when encryption is off.
+func (c *piiCipher) nameHash(first, last string) *string {
+	if c == nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, c.hashKey)
+	mac.Write([]byte(first))
+	// the separator keeps "Ab"+"c" and "A"+"bc" apart
+	mac.Write([]byte{0})
+	mac.Write([]byte(last))
+	h := hex.EncodeToString(mac.Sum(nil))
+	return &h
+}
+
+// openUser decrypts u's names in place. fullName is rebuilt from them since the
+// generated column concatenates whatever is stored, i.e. the ciphertext.
+func (c *piiCipher) openUser(u *User) error {
+	var err error
+	if u.FirstName, err = c.open("first_name", u.FirstName); err != nil {
+		return err
+	}
+	if u.LastName, err = c.open("last_name", u.LastName); err != nil {
+		return err
+	}
+	if c != nil {
+		u.FullName = u.FirstName + " " + u.LastName
+	}
+	return nil
+}
+
+// scanUser is scanUser plus decryption, every query returning userColumns goes through it
+func (a *api) scanUser(row interface{ Scan(dest ...any) error }) (User, error) {
+	u, err := scanUser(row)
+	if err != nil {
+		return u, err
+	}
+	if err := a.pii.openUser(&u); err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+// nameFilter is the WHERE condition matching a user by first and last name, its placeholders start at $n.
+// With encryption on it compares name_hash, sealed names can't be compared. With NAME_UNIQUENESS=case-insensitive
+// it compares lowercased names, which the lowerNamesIndex serves.
+func (a *api) nameFilter(n int, first, last string) (string, []any) {
+	if a.cfg.caseInsensitiveNames() {
+		return fmt.Sprintf("lower(first_name) = lower($%d) AND lower(last_name) = lower($%d)", n, n+1), []any{first, last}
+	}
+	if a.pii == nil {
+		return fmt.Sprintf("first_name = $%d AND last_name = $%d", n, n+1), []any{first, last}
+	}
+	return fmt.Sprintf("name_hash = $%d", n), []any{*a.pii.nameHash(first, last)}
+}
+
+// namesFilter is nameFilter for several names at once, matching a user with any of them.
+// It takes one or two placeholders starting at $n.
+func (a *api) namesFilter(n int, firsts, lasts []string) (string, []any) {
+	if a.cfg.caseInsensitiveNames() {
+		return fmt.Sprintf("(lower(first_name), lower(last_name)) IN (SELECT lower(f), lower(l) FROM unnest($%d::text[], $%d::text[]) AS t(f, l))", n, n+1), []any{firsts, lasts}
+	}
+	if a.pii == nil {
+		return fmt.Sprintf("(first_name, last_name) IN (SELECT * FROM unnest($%d::text[], $%d::text[]))", n, n+1), []any{firsts, lasts}
+	}
+	hashes := make([]string, len(firsts))
+	for i := range firsts {
+		hashes[i] = *a.pii.nameHash(firsts[i], lasts[i])
+	}
+	return fmt.Sprintf("name_hash = ANY($%d)", n), []any{hashes}
+}
+
+// sealPatch encrypts the names a patch sets and returns the name_hash of the resulting name.
+// old is the current row, since a patch may set only one half of the name. The hash is nil
+// when neither name changes (or encryption is off), leaving the column alone.
+func (a *api) sealPatch(old User, p userPatch) (userPatch, *string) {
+	if a.pii == nil || (p.FirstName == nil && p.LastName == nil) {
+		return p, nil
+	}
+
+	first, last := old.FirstName, old.LastName
+	if p.FirstName != nil {
+		first = *p.FirstName
+		sealed := a.pii.seal("first_name", first)
+		p.FirstName = &sealed
+	}
+	if p.LastName != nil {
+		last = *p.LastName
+		sealed := a.pii.seal("last_name", last)
+		p.LastName = &sealed
+	}
+	return p, a.pii.nameHash(first, last)
+}
+
+// encryptBatchSize is how many plaintext rows encryptPlaintextUsers converts per transaction
+const encryptBatchSize = 500
+
+// encryptPlaintextUsers seals the names of rows written before encryption was turned on (name_hash IS NULL),
+// so they're protected and covered by the name_hash unique index. It's safe to run on every start and on
+// several replicas at once: rows are claimed with SKIP LOCKED and updated_at is left alone.
+func (a *api) encryptPlaintextUsers(ctx context.Context) (converted int, err error) {
+	if a.pii == nil {
+		return 0, nil
+	}
+
+	type plainRow struct {
+		id, first, last string
+	}
+	for {
+		var batch []plainRow
+		err := withTx(ctx, a.db, func(tx *sql.Tx) error {
+			rows, err := a.query(ctx, tx, "encryptPlaintextUsers.select",
+				`SELECT id, first_name, last_name FROM users
+				WHERE name_hash IS NULL
+				ORDER BY id
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED`,
+				encryptBatchSize,
+			)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var r plainRow
+				if err := rows.Scan(&r.id, &r.first, &r.last); err != nil {
+					rows.Close()
+					return err
+				}
+				batch = append(batch, r)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			for _, r := range batch {
+				if _, err := a.exec(ctx, tx, "encryptPlaintextUsers.update",
+					`UPDATE users SET first_name = $2, last_name = $3, name_hash = $4 WHERE id = $1`,
+					r.id, a.pii.seal("first_name", r.first), a.pii.seal("last_name", r.last), a.pii.nameHash(r.first, r.last),
+				); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return converted, err
+		}
+		if len(batch) == 0 {
+			return converted, nil
+		}
+		converted += len(batch)
+		log.Printf("pii: encrypted %d plaintext users so far", converted)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testPIICipher(t *testing.T) *piiCipher {
+	t.Helper()
+	c, err := newPIICipher(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatalf("newPIICipher: %v", err)
+	}
+	return c
+}
+
+func TestPIICipherRoundTrip(t *testing.T) {
+	c := testPIICipher(t)
+
+	a, b := c.seal("first_name", "Ada"), c.seal("first_name", "Ada")
+	if !strings.HasPrefix(a, sealedPrefix) || strings.Contains(a, "Ada") {
+		t.Fatalf("sealed value %q should be prefixed ciphertext", a)
+	}
+	if a == b {
+		t.Error("sealing the same name twice should give different ciphertexts")
+	}
+	if got, err := c.open("first_name", a); err != nil || got != "Ada" {
+		t.Errorf("open = %q, %v, want Ada", got, err)
+	}
+
+	// the column is bound in, a first name moved to last_name doesn't open
+	if _, err := c.open("last_name", a); err == nil {
+		t.Error("opening under the wrong column should fail")
+	}
+
+	// rows from before encryption pass through
+	if got, err := c.open("first_name", "Grace"); err != nil || got != "Grace" {
+		t.Errorf("open plaintext = %q, %v", got, err)
+	}
+
+	// without a key sealed rows are an error, not ciphertext shown as a name
+	var off *piiCipher
+	if _, err := off.open("first_name", a); !errors.Is(err, errPIIKeyMissing) {
+		t.Errorf("open without key: got %v, want errPIIKeyMissing", err)
+	}
+	if off.seal("first_name", "Ada") != "Ada" || off.nameHash("Ada", "Lovelace") != nil {
+		t.Error("a nil cipher should store plaintext and no hash")
+	}
+}
+
+func TestPIINameHash(t *testing.T) {
+	c := testPIICipher(t)
+
+	if *c.nameHash("Ada", "Lovelace") != *c.nameHash("Ada", "Lovelace") {
+		t.Error("nameHash must be deterministic for the unique index")
+	}
+	if *c.nameHash("Ab", "c") == *c.nameHash("A", "bc") {
+		t.Error("the first/last split must be part of the hash")
+	}
+}
+
+func TestSealPatch(t *testing.T) {
+	str := func(s string) *string { return &s }
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	a.pii = testPIICipher(t)
+	old := User{FirstName: "Ada", LastName: "Lovelace"}
+
+	// renaming half the name hashes the whole new name
+	p, hash := a.sealPatch(old, userPatch{LastName: str("Byron")})
+	if hash == nil || *hash != *a.pii.nameHash("Ada", "Byron") {
+		t.Errorf("hash = %v, want the hash of Ada Byron", hash)
+	}
+	if got, err := a.pii.open("last_name", *p.LastName); err != nil || got != "Byron" {
+		t.Errorf("sealed last name opens to %q, %v", got, err)
+	}
+
+	// a phone-only patch leaves the names and their hash alone
+	if _, hash := a.sealPatch(old, userPatch{ClearPhone: true}); hash != nil {
+		t.Errorf("hash = %v, want nil", *hash)
+	}
+}
+
+func TestNameFilter(t *testing.T) {
+	exact := newAPI(defaultConfig(), nil, newMemoryCache())
+	if where, args := exact.nameFilter(2, "Ada", "Lovelace"); where != "first_name = $2 AND last_name = $3" || len(args) != 2 {
+		t.Errorf("exact: %s %v", where, args)
+	}
+
+	cfg := defaultConfig()
+	cfg.nameUniqueness = "case-insensitive"
+	ci := newAPI(cfg, nil, newMemoryCache())
+	if where, _ := ci.nameFilter(2, "Ada", "Lovelace"); where != "lower(first_name) = lower($2) AND lower(last_name) = lower($3)" {
+		t.Errorf("case-insensitive: %s", where)
+	}
+	if ci.nameKey("James", "Bond") != ci.nameKey("james", "BOND") || exact.nameKey("James", "Bond") == exact.nameKey("james", "BOND") {
+		t.Error("nameKey must fold case only when names are case-insensitive")
+	}
+
+	encrypted := newAPI(defaultConfig(), nil, newMemoryCache())
+	encrypted.pii = testPIICipher(t)
+	if where, args := encrypted.nameFilter(1, "Ada", "Lovelace"); where != "name_hash = $1" || args[0] != *encrypted.pii.nameHash("Ada", "Lovelace") {
+		t.Errorf("encrypted: %s %v", where, args)
+	}
+}
@@ -0,0 +1,27 @@
+// prefer.go reads the RFC 7240 Prefer header.
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// preferReturn returns the client's "return" preference ("minimal" or "representation"), "" if it has none.
+// Prefer can be repeated and comma separated, e.g. "respond-async, return=minimal; foo=bar".
+func preferReturn(r *http.Request) string {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			// parameters after ';' don't matter for return
+			pref, _, _ = strings.Cut(pref, ";")
+			name, value, ok := strings.Cut(strings.TrimSpace(pref), "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(name), "return") {
+				continue
+			}
+			value = strings.ToLower(strings.Trim(strings.TrimSpace(value), `"`))
+			if value == "minimal" || value == "representation" {
+				return value
+			}
+		}
+	}
+	return ""
+}
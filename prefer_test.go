@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreferReturn(t *testing.T) {
+	tests := []struct {
+		headers []string
+		want    string
+	}{
+		{nil, ""},
+		{[]string{"return=minimal"}, "minimal"},
+		{[]string{"Return=Minimal"}, "minimal"},
+		{[]string{"respond-async, return=representation"}, "representation"},
+		{[]string{"respond-async", "return=minimal; foo=bar"}, "minimal"},
+		{[]string{`return="minimal"`}, "minimal"},
+		{[]string{"return=everything"}, ""},
+		{[]string{"wait=10"}, ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/users", nil)
+		for _, h := range tt.headers {
+			r.Header.Add("Prefer", h)
+		}
+		if got := preferReturn(r); got != tt.want {
+			t.Errorf("preferReturn(%q) = %q, want %q", tt.headers, got, tt.want)
+		}
+	}
+}
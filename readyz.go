@@ -0,0 +1,124 @@
+// readyz.go implements GET /readyz: the readiness probe, checking every dependency the read path uses.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// readyzTimeout bounds all checks together
+const readyzTimeout = 2 * time.Second
+
+// pingBackoff is the base wait between DB ping attempts, doubled per retry up to maxPingBackoff and jittered
+const (
+	pingBackoff    = 50 * time.Millisecond
+	maxPingBackoff = 200 * time.Millisecond
+)
+
+// checkResult is one named entry in the /readyz body
+type checkResult struct {
+	Status string `json:"status"` // "ok" or "error"
+	Error  string `json:"error,omitempty"`
+	// LatencyMs is the successful DB ping's round trip
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+}
+
+func newCheckResult(err error) checkResult {
+	if err != nil {
+		return checkResult{Status: "error", Error: err.Error()}
+	}
+	return checkResult{Status: "ok"}
+}
+
+// readyzHandler reports each dependency under "checks".
+// A DB failure makes the pod unready (503). A cache failure only reports "degraded" with 200,
+// reads fall through to the DB so the pod can still serve.
+// /health stays the liveness probe and doesn't look at the cache at all.
+func (a *api) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyzTimeout)
+	defer cancel()
+
+	// retried so a single transient blip doesn't flap the pod's readiness
+	latency, err := pingWithRetry(ctx, a.pingShards, a.cfg.pingTimeout, a.cfg.readyzPingAttempts)
+	db := newCheckResult(err)
+	if err == nil {
+		db.LatencyMs = milliseconds(latency)
+	}
+	checks := map[string]checkResult{
+		"db":    db,
+		"cache": newCheckResult(a.checkCache(ctx)),
+	}
+
+	status, code := "ok", http.StatusOK
+	switch {
+	case checks["db"].Status != "ok":
+		status, code = "unavailable", http.StatusServiceUnavailable
+	case checks["cache"].Status != "ok":
+		status = "degraded"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": status, "checks": checks})
+}
+
+// checkCache round-trips a sentinel entry through the cache: write, read back, compare, delete.
+// It uses its own key outside any tenant so it never touches real entries.
+func (a *api) checkCache(ctx context.Context) error {
+	key := "readyz:" + uuid.NewString()
+	sentinel := User{ID: key}
+
+	if err := a.cache.Set(ctx, key, sentinel, 10*time.Second); err != nil {
+		return fmt.Errorf("set: %w", err)
+	}
+	defer a.cache.Invalidate(context.WithoutCancel(ctx), key)
+
+	e, err := a.cache.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if e.user.ID != sentinel.ID {
+		return fmt.Errorf("read back %q, wrote %q", e.user.ID, sentinel.ID)
+	}
+	return nil
+}
+
+// pingWithRetry pings up to attempts times, each bounded by timeout so a hung connection can't
+// outlast the probe's own timeout. It returns the latency of the ping that succeeded.
+func pingWithRetry(ctx context.Context, ping func(context.Context) error, timeout time.Duration, attempts int) (time.Duration, error) {
+	var err error
+	backoff := pingBackoff
+	for attempt := range max(attempts, 1) {
+		if attempt > 0 {
+			// full jitter so replicas probing the same DB don't retry in lockstep
+			select {
+			case <-time.After(rand.N(backoff)):
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+			backoff = min(backoff*2, maxPingBackoff)
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		err = ping(pingCtx)
+		latency := time.Since(start)
+		cancel()
+		if err == nil {
+			return latency, nil
+		}
+	}
+	return 0, err
+}
+
+// milliseconds converts d for JSON bodies, keeping sub-millisecond precision
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// brokenCache fails every call, like an unreachable Redis
+type brokenCache struct{}
+
+func (brokenCache) Get(context.Context, string) (cacheEntry, error) {
+	return cacheEntry{}, errors.New("connection refused")
+}
+func (brokenCache) GetStale(context.Context, string) (cacheEntry, error) {
+	return cacheEntry{}, errors.New("connection refused")
+}
+func (brokenCache) Set(context.Context, string, User, time.Duration) error {
+	return errors.New("connection refused")
+}
+func (brokenCache) Invalidate(context.Context, string) error { return errors.New("connection refused") }
+func (brokenCache) InvalidateMany(context.Context, []string) error {
+	return errors.New("connection refused")
+}
+func (brokenCache) Stats(context.Context) (cacheStats, error) {
+	return cacheStats{}, errors.New("connection refused")
+}
+func (brokenCache) Flush(context.Context) error { return errors.New("connection refused") }
+
+func TestCheckCache(t *testing.T) {
+	ok := newAPI(defaultConfig(), nil, newMemoryCache())
+	if err := ok.checkCache(context.Background()); err != nil {
+		t.Errorf("expected memory cache round-trip to pass, got %v", err)
+	}
+
+	broken := newAPI(defaultConfig(), nil, brokenCache{})
+	if err := broken.checkCache(context.Background()); err == nil {
+		t.Error("expected broken cache to fail the check")
+	}
+}
+
+func TestPingWithRetry(t *testing.T) {
+	ctx := context.Background()
+
+	calls := 0
+	flaky := func(context.Context) error {
+		calls++
+		if calls == 1 {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+	if _, err := pingWithRetry(ctx, flaky, 100*time.Millisecond, 2); err != nil || calls != 2 {
+		t.Errorf("flaky ping: err=%v calls=%d, want success on the 2nd attempt", err, calls)
+	}
+
+	// a ping that hangs is cut off by the per-attempt timeout
+	hung := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	start := time.Now()
+	if _, err := pingWithRetry(ctx, hung, 20*time.Millisecond, 2); err == nil {
+		t.Error("hung ping: expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("hung ping took %s, the timeout didn't apply", elapsed)
+	}
+}
+
+func TestHealthConfig(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://localhost/test")
+	if cfg, err := loadConfig(); err != nil || cfg.pingTimeout != 250*time.Millisecond || cfg.readyzPingAttempts != 2 {
+		t.Fatalf("defaults: %s x%d, %v", cfg.pingTimeout, cfg.readyzPingAttempts, err)
+	}
+
+	for env, bad := range map[string][]string{
+		"HEALTH_PING_TIMEOUT":  {"0", "-1s"},
+		"READYZ_PING_ATTEMPTS": {"0", "-2"},
+	} {
+		for _, v := range bad {
+			t.Setenv(env, v)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("%s=%s accepted", env, v)
+			}
+		}
+		t.Setenv(env, "")
+	}
+}
@@ -0,0 +1,151 @@
+// recent.go serves GET /users/recent, the newest signups for the dashboard widget.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultRecentLimit and maxRecentLimit bound ?limit= for GET /users/recent
+const (
+	defaultRecentLimit = 10
+	maxRecentLimit     = 100
+)
+
+// ttlCache is a small in-process cache for dashboard reads that are fine a few seconds stale,
+// kept apart from a.cache since it holds whole result lists rather than single users.
+// a.recent keeps each tenant's maxRecentLimit newest users for cfg.recentCacheTTL; every limit is
+// served from that one list, so a tenant costs at most one query per TTL. Writes don't evict it:
+// a new signup shows up once the entry expires.
+type ttlCache[V any] struct {
+	mu      sync.Mutex
+	entries map[string]ttlEntry[V]
+}
+
+type ttlEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expiresAt) {
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+func (c *ttlCache[V]) set(key string, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]ttlEntry[V])
+	}
+	c.entries[key] = ttlEntry[V]{value: value, expiresAt: time.Now().Add(ttl)}
+}
+
+// recentUsersHandler returns the newest users, newest first. ?limit= defaults to 10 and is clamped to 100.
+func (a *api) recentUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r, "limit") {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	limit := defaultRecentLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, invalidParam("limit"))
+			return
+		}
+		limit = min(n, maxRecentLimit)
+	}
+
+	users, err := a.recentUsersCached(ctx)
+	if err != nil {
+		writeError(w, failed("failed to get recent users", err))
+		return
+	}
+	users = users[:min(limit, len(users))]
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(a.cfg.recentCacheTTL.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(users)
+}
+
+// recentUsersCached is recentUsers(ctx, maxRecentLimit) behind a.recent. The returned slice is shared, read-only.
+func (a *api) recentUsersCached(ctx context.Context) ([]User, error) {
+	key := tenantKey(ctx, "recent")
+	if users, ok := a.recent.get(key); ok {
+		return users, nil
+	}
+
+	users, err := a.recentUsers(ctx, maxRecentLimit)
+	if err != nil {
+		return nil, err
+	}
+	if a.cfg.recentCacheTTL > 0 {
+		a.recent.set(key, users, a.cfg.recentCacheTTL)
+	}
+	return users, nil
+}
+
+// recentUsers loads the tenant's newest users, served by the (tenant_id, created_at, id) index read backwards
+func (a *api) recentUsers(ctx context.Context, limit int) (users []User, err error) {
+	ctx, span := tracer.Start(ctx, "recentUsers", trace.WithAttributes(attribute.Int("page.limit", limit)))
+	defer func() { finishSpan(span, err) }()
+
+	limit = min(max(limit, 1), maxRecentLimit)
+	users = []User{}
+	// each shard's newest, then the newest of those
+	for _, db := range a.readDBs() {
+		rows, err := a.readQuery(ctx, db, "recentUsers",
+			`SELECT `+userColumns+`
+			FROM users
+			WHERE tenant_id = $2
+			ORDER BY created_at DESC, id DESC
+			LIMIT $1`,
+			limit, GetTenantID(ctx),
+		)
+		if err != nil {
+			return nil, err
+		}
+		err = func() error {
+			defer rows.Close()
+			for rows.Next() {
+				u, err := a.scanUser(rows)
+				if err != nil {
+					return err
+				}
+				users = append(users, u)
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if a.shards != nil {
+		byCreated := compareUsers("createdAt", "")
+		slices.SortFunc(users, func(x, y User) int { return byCreated(y, x) })
+		users = users[:min(limit, len(users))]
+	}
+
+	span.SetAttributes(attribute.Int("db.rows_returned", len(users)))
+	return users, nil
+}
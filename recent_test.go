@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRecentUsersHandlerFromCache(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	// a cached list means no DB is needed
+	users := make([]User, 30)
+	for i := range users {
+		users[i] = User{ID: strconv.Itoa(30 - i)}
+	}
+	a.recent.set("1:recent", users, time.Minute)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		route(a).ServeHTTP(w, httptest.NewRequest("GET", "/users/recent"+query, nil))
+		return w
+	}
+
+	for query, want := range map[string]int{"": defaultRecentLimit, "?limit=3": 3, "?limit=500": 30} {
+		w := get(query)
+		var got []User
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%q: got %d %s", query, w.Code, w.Body)
+		}
+		if len(got) != want || got[0].ID != "30" {
+			t.Errorf("%q: got %d users starting at %q, want %d starting at the newest", query, len(got), got[0].ID, want)
+		}
+	}
+	if w := get("?limit=0"); w.Code != http.StatusBadRequest {
+		t.Errorf("limit=0: got %d, want 400", w.Code)
+	}
+}
+
+func TestRecentCacheExpires(t *testing.T) {
+	var c ttlCache[[]User]
+	c.set("1:recent", []User{{ID: "1"}}, time.Millisecond)
+	if _, ok := c.get("2:recent"); ok {
+		t.Error("another tenant's key hit the cache")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.get("1:recent"); ok {
+		t.Error("expired entry still served")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisCache stores users as JSON under "user:<id>" and relies on Redis key expiry for the TTL.
+type redisCache struct {
+	client *redis.Client
+	// staleFor extends the Redis expiry past the TTL so GetStale can still find the entry
+	staleFor time.Duration
+	// maxAge caps the Redis expiry, so an entry is gone this long after it was written whatever staleFor says
+	maxAge time.Duration
+}
+
+// redisEntry is the JSON stored per key, cacheEntry's fields are unexported
+type redisEntry struct {
+	User      storedUser `json:"user"`
+	CachedAt  time.Time  `json:"cachedAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+}
+
+func newRedisCache(url string) (*redisCache, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &redisCache{client: redis.NewClient(opts)}, nil
+}
+
+func (c *redisCache) key(id string) string {
+	return "user:" + id
+}
+
+func (c *redisCache) Get(ctx context.Context, id string) (cacheEntry, error) {
+	e, err := c.GetStale(ctx, id)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	// with staleFor the key outlives its TTL, past expiresAt it only exists for GetStale
+	if time.Now().After(e.expiresAt) {
+		return cacheEntry{}, ErrCacheMiss
+	}
+	return e, nil
+}
+
+func (c *redisCache) GetStale(ctx context.Context, id string) (cacheEntry, error) {
+	b, err := c.client.Get(ctx, c.key(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return cacheEntry{}, ErrCacheMiss
+	}
+	if err != nil {
+		return cacheEntry{}, err
+	}
+
+	var e redisEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return cacheEntry{}, err
+	}
+	entry := cacheEntry{user: User(e.User), cachedAt: e.CachedAt, expiresAt: e.ExpiresAt}
+	// Redis expires the key at maxAge already, this covers entries written before CACHE_MAX_AGE was lowered
+	if entry.tooOld(c.maxAge, time.Now()) {
+		return cacheEntry{}, ErrCacheMiss
+	}
+	return entry, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, id string, u User, ttl time.Duration) error {
+	now := time.Now()
+	b, err := json.Marshal(redisEntry{User: storedUser(u), CachedAt: now, ExpiresAt: now.Add(ttl)})
+	if err != nil {
+		return err
+	}
+	expiry := ttl + c.staleFor
+	if c.maxAge > 0 {
+		expiry = min(expiry, c.maxAge)
+	}
+	return c.client.Set(ctx, c.key(id), b, expiry).Err()
+}
+
+func (c *redisCache) Invalidate(ctx context.Context, id string) error {
+	return c.client.Del(ctx, c.key(id)).Err()
+}
+
+func (c *redisCache) InvalidateMany(ctx context.Context, ids []string) error {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = c.key(id)
+	}
+	return c.client.Del(ctx, keys...).Err()
+}
+
+// scanKeys calls fn for every user key, SCAN keeps it from blocking Redis the way KEYS would
+func (c *redisCache) scanKeys(ctx context.Context, fn func(key string) error) error {
+	iter := c.client.Scan(ctx, 0, c.key("*"), 500).Iterator()
+	for iter.Next(ctx) {
+		if err := fn(iter.Val()); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func (c *redisCache) Stats(ctx context.Context) (cacheStats, error) {
+	stats := cacheStats{Items: []cacheItemStats{}}
+	err := c.scanKeys(ctx, func(key string) error {
+		ttl, err := c.client.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		// negative means the key expired (or lost its TTL) between SCAN and PTTL,
+		// and a key only kept for GetStale isn't live any more
+		if ttl -= c.staleFor; ttl > 0 {
+			stats.add(strings.TrimPrefix(key, c.key("")), ttl)
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func (c *redisCache) Flush(ctx context.Context) error {
+	return c.scanKeys(ctx, func(key string) error {
+		return c.client.Del(ctx, key).Err()
+	})
+}
@@ -0,0 +1,122 @@
+// resolve.go serves POST /users/resolve, a batch get with a projection for resolvers that join users into their own responses.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// resolvePath is POST-only but reads, see readOnlyRequest
+const resolvePath = "/users/resolve"
+
+// resolveRequest is the POST /users/resolve body. Ids may be strings or JSON numbers (see ID_FORMAT),
+// Fields is the projection and nil sends the full user.
+type resolveRequest struct {
+	IDs    []jsonID `json:"ids"`
+	Fields []string `json:"fields"`
+}
+
+// parseResolveRequest decodes and checks the body: 1 to maxBatchIDs ids, known field names. Ids are
+// deduped in the order given.
+func parseResolveRequest(r *http.Request) ([]string, []string, error) {
+	var req resolveRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, nil, errInvalidJSON
+	}
+
+	if len(req.IDs) == 0 {
+		return nil, nil, &ValidationError{Field: "ids", Message: "ids must have at least one entry"}
+	}
+	if len(req.IDs) > maxBatchIDs {
+		return nil, nil, &ValidationError{Field: "ids", Message: fmt.Sprintf("ids must have at most %d entries", maxBatchIDs)}
+	}
+	ids := make([]string, 0, len(req.IDs))
+	seen := make(map[string]bool, len(req.IDs))
+	for _, raw := range req.IDs {
+		id, err := parseUserID(string(raw))
+		if err != nil {
+			return nil, nil, &ValidationError{Field: "ids", Message: fmt.Sprintf("invalid id %q", raw)}
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	var fields []string
+	if req.Fields != nil {
+		var err error
+		if fields, err = checkFields(req.Fields); err != nil {
+			return nil, nil, err
+		}
+	}
+	return ids, fields, nil
+}
+
+// resolveUsersHandler returns {"<id>": {...}} for the ids in the body, each user cut down to the
+// requested fields. Ids that don't exist map to null, so the caller can tell them from ones it forgot to ask for.
+// Loading goes through getUsersBatch: cache first, then one ANY($1) query for the misses.
+func (a *api) resolveUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r, "pretty") {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	ids, fields, err := parseResolveRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	pretty, err := boolParam(r, "pretty")
+	if err != nil {
+		writeError(w, invalidParam("pretty"))
+		return
+	}
+
+	users, err := a.getUsersBatch(ctx, ids)
+	if err != nil {
+		writeError(w, failed("failed to resolve users", err))
+		return
+	}
+
+	body, err := resolvedUsers(ids, users, fields)
+	var b []byte
+	if err == nil {
+		b, err = encodeJSON(body, pretty)
+	}
+	if err != nil {
+		writeError(w, failed("failed to encode users", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b)
+}
+
+// resolvedUsers keys users by id, with a nil for every id in ids that wasn't found
+func resolvedUsers(ids []string, users []User, fields []string) (map[string]any, error) {
+	out := make(map[string]any, len(ids))
+	for _, id := range ids {
+		out[id] = nil
+	}
+	for _, u := range users {
+		if fields == nil {
+			out[u.ID] = u
+			continue
+		}
+		m, err := selectFields(u, fields)
+		if err != nil {
+			return nil, err
+		}
+		out[u.ID] = m
+	}
+	return out, nil
+}
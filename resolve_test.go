@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveUsers(t *testing.T) {
+	ctx := context.Background()
+	// no DB: every id that exists is a cache hit, the rest would need getUsersByIDs so stay off them
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	a.setUserCache(ctx, "1", User{ID: "1", FirstName: "Ada", LastName: "Lovelace"}, a.cfg.cacheTTL)
+	a.setUserCache(ctx, "2", User{ID: "2", FirstName: "Alan", LastName: "Turing"}, a.cfg.cacheTTL)
+
+	w := httptest.NewRecorder()
+	body := `{"ids":["2",1,"2"],"fields":["id","firstName"]}`
+	route(a).ServeHTTP(w, httptest.NewRequest("POST", "/users/resolve", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d %s, want 200", w.Code, w.Body)
+	}
+	var got map[string]map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != 2 || got["1"]["firstName"] != "Ada" || got["2"]["id"] != "2" || len(got["1"]) != 2 {
+		t.Errorf("body = %s, want users 1 and 2 with id and firstName only", w.Body)
+	}
+
+	// a missing id is a null, not left out
+	out, err := resolvedUsers([]string{"1", "3"}, []User{{ID: "1"}}, nil)
+	if err != nil {
+		t.Fatalf("resolvedUsers: %v", err)
+	}
+	if v, ok := out["3"]; !ok || v != nil {
+		t.Errorf("id 3 = %v, %v; want null", v, ok)
+	}
+}
+
+func TestResolveUsersRejectsBadBodies(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	for name, body := range map[string]string{
+		"no ids":        `{"ids":[]}`,
+		"bad id":        `{"ids":["abc"]}`,
+		"zero id":       `{"ids":[0]}`,
+		"unknown field": `{"ids":[1],"fields":["password"]}`,
+		"empty fields":  `{"ids":[1],"fields":[]}`,
+		"unknown key":   `{"ids":[1],"limit":5}`,
+		"too many ids":  `{"ids":[` + strings.Repeat("1,", maxBatchIDs) + `1]}`,
+	} {
+		w := httptest.NewRecorder()
+		route(a).ServeHTTP(w, httptest.NewRequest("POST", "/users/resolve", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// seed.go implements the -seed flag which fills the database with random users for local dev and load testing.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// seedBatchSize is how many inserts go into one transaction
+const seedBatchSize = 1000
+
+var nameSyllables = []string{
+	"ka", "lo", "mi", "ra", "ven", "do", "sa", "ti", "mar", "el",
+	"an", "jo", "ber", "li", "na", "son", "ri", "ko", "ta", "gan",
+}
+
+// randomName builds a capitalized name out of 2-4 syllables
+func randomName() string {
+	n := 2 + rand.IntN(3)
+	var b strings.Builder
+	for range n {
+		b.WriteString(nameSyllables[rand.IntN(len(nameSyllables))])
+	}
+	s := b.String()
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// isUniqueViolation reports whether err is a postgres unique_violation (23505)
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// seedUsers inserts n random users in transactions of seedBatchSize.
+// Name collisions are skipped (a savepoint keeps the rest of the batch alive), so fewer than n rows may be inserted.
+// Stops between inserts once ctx is cancelled; batches already committed stay.
+func (a *api) seedUsers(ctx context.Context, n int) (inserted, skipped int, err error) {
+	for done := 0; done < n; {
+		size := min(seedBatchSize, n-done)
+
+		var batchInserted, batchSkipped int
+		err := withTx(ctx, a.writeDB(), func(tx *sql.Tx) error {
+			for range size {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if _, err := a.exec(ctx, tx, "seed.savepoint", `SAVEPOINT seed_row`); err != nil {
+					return err
+				}
+
+				_, err := a.insertUser(ctx, tx, randomName(), randomName(), nil)
+				if isUniqueViolation(err) {
+					if _, err := a.exec(ctx, tx, "seed.rollback", `ROLLBACK TO SAVEPOINT seed_row`); err != nil {
+						return err
+					}
+					batchSkipped++
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				batchInserted++
+			}
+			return nil
+		})
+		if err != nil {
+			return inserted, skipped, fmt.Errorf("seed batch at %d: %w", done, err)
+		}
+
+		inserted += batchInserted
+		skipped += batchSkipped
+		done += size
+		log.Printf("seed: %d/%d (inserted=%d skipped=%d)", done, n, inserted, skipped)
+	}
+	return inserted, skipped, nil
+}
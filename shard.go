@@ -0,0 +1,336 @@
+// shard.go splits users across databases by id range. With SHARD_2_DATABASE_URL and SHARD_SPLIT_ID set,
+// ids below the split live on DATABASE_URL and the rest on the second shard. Anything keyed by one id
+// goes to that id's shard, lists fan out to every shard and merge the results.
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// shard is one database and the first user id it holds. It holds every id up to the next shard's minID.
+type shard struct {
+	minID int64
+	db    *sql.DB
+}
+
+// shardMap is the shards sorted by minID, the first one starts at 1. Nil when sharding is off.
+type shardMap []shard
+
+// newShardMap is the static two-shard map: ids below split on first, the rest on second
+func newShardMap(first *sql.DB, split int64, second *sql.DB) shardMap {
+	return shardMap{{minID: 1, db: first}, {minID: split, db: second}}
+}
+
+// forID is the database holding id. Ids below every range (0, negatives) exist nowhere, the first shard says so.
+func (m shardMap) forID(id int64) *sql.DB {
+	for i := len(m) - 1; i > 0; i-- {
+		if id >= m[i].minID {
+			return m[i].db
+		}
+	}
+	return m[0].db
+}
+
+// dbForID is the database user id lives on: its shard, or a.db when there's only one. It takes the
+// string ids the cache and handlers pass around. An id that doesn't parse matches no row on any shard,
+// so where it goes doesn't matter.
+func (a *api) dbForID(id string) *sql.DB {
+	if a.shards == nil {
+		return a.db
+	}
+	n, _ := strconv.ParseInt(id, 10, 64)
+	return a.shards.forID(n)
+}
+
+// readDBForID is dbForID for reads, the replica (a.readDB) when there's one. Shards have no replicas yet.
+func (a *api) readDBForID(id string) *sql.DB {
+	if a.shards == nil {
+		return a.readDB
+	}
+	return a.dbForID(id)
+}
+
+// writeDB is where new users are inserted: the last shard, the only one whose id sequence has room left
+func (a *api) writeDB() *sql.DB {
+	if a.shards == nil {
+		return a.db
+	}
+	return a.shards[len(a.shards)-1].db
+}
+
+// readDBs is every database a list has to read: each shard, or just a.readDB
+func (a *api) readDBs() []*sql.DB {
+	if a.shards == nil {
+		return []*sql.DB{a.readDB}
+	}
+	return a.primaries()
+}
+
+// primaries is every shard, or just a.db
+func (a *api) primaries() []*sql.DB {
+	if a.shards == nil {
+		return []*sql.DB{a.db}
+	}
+	dbs := make([]*sql.DB, len(a.shards))
+	for i, s := range a.shards {
+		dbs[i] = s.db
+	}
+	return dbs
+}
+
+// sameShard reports whether every id is on one database, i.e. a transaction can cover them all
+func (a *api) sameShard(ids ...string) bool {
+	for _, id := range ids {
+		if a.dbForID(id) != a.dbForID(ids[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// pingShards pings every database users live on, the first failure wins
+func (a *api) pingShards(ctx context.Context) error {
+	for i, db := range a.primaries() {
+		if err := db.PingContext(ctx); err != nil {
+			if a.shards != nil {
+				err = fmt.Errorf("shard %d: %w", i+1, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// initShardSequence confines the users id sequence on db to minID..maxID (maxID 0 = no maximum), so each
+// shard only hands out ids of its own range. It fails when the shard already holds ids past maxID,
+// e.g. a SHARD_SPLIT_ID below ids that are already on DATABASE_URL. The bounds are plain integers
+// formatted in, ALTER SEQUENCE takes no parameters.
+func initShardSequence(db *sql.DB, minID, maxID int64) error {
+	if _, err := db.Exec(
+		`SELECT setval('users_id_seq', $1, false) WHERE (SELECT last_value FROM users_id_seq) < $1`, minID,
+	); err != nil {
+		return err
+	}
+	maxValue := "NO MAXVALUE"
+	if maxID > 0 {
+		maxValue = fmt.Sprintf("MAXVALUE %d", maxID)
+	}
+	_, err := db.Exec(fmt.Sprintf(`ALTER SEQUENCE users_id_seq MINVALUE %d START %d %s`, minID, minID, maxValue))
+	return err
+}
+
+// textOrders are the listOrders on text columns. Shards are merged in Go, which compares strings by
+// byte, so across shards these sort with COLLATE "C" to agree with it instead of the database's collation.
+var textOrders = map[string]bool{"lastName": true, "phone": true}
+
+// shardOrderBy is orderBy for a query whose rows get merged with compareUsers
+func shardOrderBy(order, nulls string) string {
+	clause := orderBy(order, nulls)
+	if col := listOrders[order]; textOrders[order] {
+		clause = strings.Replace(clause, col, col+` COLLATE "C"`, 1)
+	}
+	return clause
+}
+
+// compareUsers orders users the way shardOrderBy sorts them, ties broken by id
+func compareUsers(order, nulls string) func(a, b User) int {
+	byID := func(a, b User) int {
+		x, _ := strconv.ParseInt(a.ID, 10, 64)
+		y, _ := strconv.ParseInt(b.ID, 10, 64)
+		return cmp.Compare(x, y)
+	}
+	var byCol func(a, b User) int
+	switch order {
+	case "lastName":
+		byCol = func(a, b User) int { return strings.Compare(a.LastName, b.LastName) }
+	case "createdAt":
+		byCol = func(a, b User) int { return a.CreatedAt.Compare(b.CreatedAt) }
+	case "phone":
+		nullsFirst := nulls == "first"
+		byCol = func(a, b User) int {
+			switch {
+			case a.Phone == nil && b.Phone == nil:
+				return 0
+			case a.Phone == nil || b.Phone == nil:
+				// exactly one NULL: it goes after the other unless NULLS FIRST
+				c := 1
+				if b.Phone == nil {
+					c = -1
+				}
+				if nullsFirst {
+					c = -c
+				}
+				return c
+			}
+			return strings.Compare(*a.Phone, *b.Phone)
+		}
+	default:
+		return byID
+	}
+	return func(a, b User) int {
+		if c := byCol(a, b); c != 0 {
+			return c
+		}
+		return byID(a, b)
+	}
+}
+
+// userCursor yields one shard's rows in order, ok=false once they run out
+type userCursor func() (u User, ok bool, err error)
+
+// errStopMerge is returned by a mergeSorted callback to end the merge early without an error
+var errStopMerge = errors.New("stop merge")
+
+// mergeSorted merges cursors that are each sorted by compare into one sorted sequence, calling fn per user.
+// Only the head row of each cursor is held, so it streams however many rows the cursors have.
+func mergeSorted(cursors []userCursor, compare func(a, b User) int, fn func(User) error) error {
+	heads := make([]*User, len(cursors))
+	advance := func(i int) error {
+		u, ok, err := cursors[i]()
+		if err != nil {
+			return err
+		}
+		heads[i] = nil
+		if ok {
+			heads[i] = &u
+		}
+		return nil
+	}
+	for i := range cursors {
+		if err := advance(i); err != nil {
+			return err
+		}
+	}
+
+	for {
+		next := -1
+		for i, h := range heads {
+			if h != nil && (next < 0 || compare(*h, *heads[next]) < 0) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return nil
+		}
+		if err := fn(*heads[next]); err != nil {
+			if errors.Is(err, errStopMerge) {
+				return nil
+			}
+			return err
+		}
+		if err := advance(next); err != nil {
+			return err
+		}
+	}
+}
+
+// rowsCursor reads rows (produced with userColumns) as a userCursor
+func (a *api) rowsCursor(rows *connRows) userCursor {
+	return func() (User, bool, error) {
+		if !rows.Next() {
+			return User{}, false, rows.Err()
+		}
+		u, err := a.scanUser(rows)
+		return u, err == nil, err
+	}
+}
+
+// findOnOtherShards looks for the tenant's user with this name on every shard but the write shard,
+// where creates insert. See findNamesOffShard.
+func (a *api) findOnOtherShards(ctx context.Context, firstName, lastName string) (User, bool, error) {
+	return a.findNamesOffShard(ctx, a.writeDB(), []string{firstName}, []string{lastName})
+}
+
+// findNamesOffShard looks for a tenant's user with any of the names (firsts[i], lasts[i]) on every shard
+// but home. Each shard's unique index only sees its own rows, so creates and renames check the other
+// shards before writing to home. It's a check before the write, not a constraint: two writes of the
+// same name racing on different shards can both pass it.
+func (a *api) findNamesOffShard(ctx context.Context, home *sql.DB, firsts, lasts []string) (User, bool, error) {
+	if a.shards == nil {
+		return User{}, false, nil
+	}
+	match, args := a.namesFilter(2, firsts, lasts)
+	for _, s := range a.shards {
+		if s.db == home {
+			continue
+		}
+		u, err := a.scanUser(a.queryRow(ctx, s.db, "findNamesOffShard",
+			`SELECT `+userColumns+`
+			FROM users
+			WHERE tenant_id = $1 AND `+match+`
+			LIMIT 1`,
+			append([]any{GetTenantID(ctx)}, args...)...,
+		))
+		if err == nil {
+			return u, true, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return User{}, false, err
+		}
+	}
+	return User{}, false, nil
+}
+
+// streamShards is streamUsers across shards. A page can hold rows from any shard, so every shard is
+// asked for its first offset+limit rows and the cursors are merged as they're read: offset rows are
+// skipped here and the merge stops after limit. Deep pages cost every shard the whole offset.
+func (a *api) streamShards(ctx context.Context, p listParams, fn func(User) error) (n int, err error) {
+	// LIMIT NULL is no limit
+	var limit any
+	if p.limit > 0 {
+		limit = p.offset + p.limit
+	}
+	query := `SELECT ` + userColumns + `
+		FROM users
+		WHERE tenant_id = $2
+		  AND ($3::boolean IS NULL OR is_active = $3)
+		` + shardOrderBy(p.order, p.nulls) + `
+		LIMIT $1`
+	args := []any{limit, GetTenantID(ctx), p.active}
+
+	dbs := a.readDBs()
+	cursors := make([]userCursor, 0, len(dbs))
+	skip := p.offset
+	merge := func() error {
+		return mergeSorted(cursors, compareUsers(p.order, p.nulls), func(u User) error {
+			if skip > 0 {
+				skip--
+				return nil
+			}
+			if p.limit > 0 && n == p.limit {
+				return errStopMerge
+			}
+			n++
+			return fn(u)
+		})
+	}
+
+	// each cursor is opened inside the previous shard's call, so all of them (and their transactions,
+	// when there's a statement timeout) are still open when the merge runs at the innermost level
+	var open func(i int) error
+	open = func(i int) error {
+		if i == len(dbs) {
+			return merge()
+		}
+		run := func(q dbtx) error {
+			rows, err := a.query(ctx, q, "listUsers", query, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			cursors = append(cursors, a.rowsCursor(rows))
+			return open(i + 1)
+		}
+		if p.statementTimeout > 0 {
+			return withStatementTimeout(ctx, dbs[i], p.statementTimeout, func(tx *sql.Tx) error { return run(tx) })
+		}
+		return run(dbs[i])
+	}
+	return n, open(0)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShardMapForID(t *testing.T) {
+	first, second := &sql.DB{}, &sql.DB{}
+	m := newShardMap(first, 1000, second)
+	for id, want := range map[int64]*sql.DB{0: first, 1: first, 999: first, 1000: second, 1 << 40: second} {
+		if got := m.forID(id); got != want {
+			t.Errorf("forID(%d) is the wrong shard", id)
+		}
+	}
+
+	a := newAPI(defaultConfig(), first, newMemoryCache())
+	if a.dbForID("5") != first || a.writeDB() != first || len(a.readDBs()) != 1 {
+		t.Error("unsharded api should use db for everything")
+	}
+	a.shards = m
+	if a.dbForID("1000") != second || a.readDBForID("3") != first || a.writeDB() != second {
+		t.Error("sharded api routed an id to the wrong shard")
+	}
+	if !a.sameShard("1", "2", "999") || a.sameShard("1", "1000") {
+		t.Error("sameShard disagrees with the split")
+	}
+}
+
+func TestShardOrderBy(t *testing.T) {
+	for order, want := range map[string]string{
+		"id":        "ORDER BY id",
+		"createdAt": "ORDER BY created_at, id",
+		"lastName":  `ORDER BY last_name COLLATE "C", id`,
+		"phone":     `ORDER BY phone COLLATE "C" NULLS LAST, id`,
+	} {
+		if got := shardOrderBy(order, ""); got != want {
+			t.Errorf("shardOrderBy(%q) = %q, want %q", order, got, want)
+		}
+	}
+}
+
+// sliceCursor yields users like a shard's rows would
+func sliceCursor(users ...User) userCursor {
+	return func() (User, bool, error) {
+		if len(users) == 0 {
+			return User{}, false, nil
+		}
+		u := users[0]
+		users = users[1:]
+		return u, true, nil
+	}
+}
+
+func TestMergeSorted(t *testing.T) {
+	phone := func(s string) *string { return &s }
+	shard1 := []User{{ID: "1", Phone: phone("+1")}, {ID: "3"}}
+	shard2 := []User{{ID: "1000", Phone: phone("+1")}, {ID: "1001", Phone: phone("+2")}, {ID: "1002"}}
+
+	tests := []struct {
+		nulls string
+		want  []string
+	}{
+		{"last", []string{"1", "1000", "1001", "3", "1002"}},
+		{"first", []string{"3", "1002", "1", "1000", "1001"}},
+	}
+	for _, tt := range tests {
+		cmp := compareUsers("phone", tt.nulls)
+		// each shard sorted the way its query would
+		s1, s2 := slices.Clone(shard1), slices.Clone(shard2)
+		slices.SortFunc(s1, cmp)
+		slices.SortFunc(s2, cmp)
+
+		var got []string
+		err := mergeSorted([]userCursor{sliceCursor(s1...), sliceCursor(s2...)}, cmp, func(u User) error {
+			got = append(got, u.ID)
+			return nil
+		})
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("nulls=%s: merged %v, %v; want %v", tt.nulls, got, err, tt.want)
+		}
+	}
+
+	// the callback ends the merge early, e.g. once a page is full
+	now := time.Now()
+	var got []string
+	err := mergeSorted(
+		[]userCursor{sliceCursor(User{ID: "2", CreatedAt: now}), sliceCursor(User{ID: "1000", CreatedAt: now.Add(-time.Second)})},
+		compareUsers("createdAt", ""),
+		func(u User) error {
+			if len(got) == 1 {
+				return errStopMerge
+			}
+			got = append(got, u.ID)
+			return nil
+		},
+	)
+	if err != nil || !slices.Equal(got, []string{"1000"}) {
+		t.Errorf("stopped merge = %v, %v; want [1000]", got, err)
+	}
+}
+
+func TestShardConfig(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://localhost/test")
+
+	t.Setenv("SHARD_2_DATABASE_URL", "postgres://localhost/shard2")
+	t.Setenv("SHARD_SPLIT_ID", "1000000")
+	cfg, err := loadConfig()
+	if err != nil || cfg.shardSplitID != 1000000 {
+		t.Fatalf("loadConfig = %d, %v; want split 1000000", cfg.shardSplitID, err)
+	}
+
+	t.Setenv("READ_DATABASE_URL", "postgres://localhost/replica")
+	if _, err := loadConfig(); err == nil {
+		t.Error("READ_DATABASE_URL with shards accepted")
+	}
+	t.Setenv("READ_DATABASE_URL", "")
+
+	for _, split := range []string{"", "1", "abc"} {
+		t.Setenv("SHARD_SPLIT_ID", split)
+		if _, err := loadConfig(); err == nil {
+			t.Errorf("SHARD_SPLIT_ID=%q accepted", split)
+		}
+	}
+}
+
+func TestShardedRoutesUnavailable(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	a.shards = newShardMap(nil, 1000, nil)
+	for _, path := range []string{"/users/stats/lastname", "/users/similar?q=bond", "/users/events?since=1"} {
+		w := httptest.NewRecorder()
+		route(a).ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotImplemented {
+			t.Errorf("GET %s = %d, want 501", path, w.Code)
+		}
+	}
+
+	// the live feed never touches a shard: it streams (here until the already canceled client is gone)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	route(a).ServeHTTP(w, httptest.NewRequest("GET", "/users/events", nil).WithContext(ctx))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("GET /users/events (live only) = %d, want a 200 stream", w.Code)
+	}
+}
+
+func TestCrossShardWritesRejected(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.adminToken = "s3cret"
+	a := newAPI(cfg, nil, newMemoryCache())
+	a.shards = newShardMap(nil, 1000, &sql.DB{})
+
+	for path, body := range map[string]string{
+		"/users/1/merge":     `{"into":"1000"}`,
+		"/users/bulk-update": `{"ids":[1,1000],"phone":null}`,
+	} {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		route(a).ServeHTTP(w, r)
+		if w.Code != http.StatusNotImplemented {
+			t.Errorf("POST %s = %d %s, want 501", path, w.Code, w.Body)
+		}
+	}
+}
+
+func TestCheckRenameOffShard(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	old := User{ID: "5", FirstName: "James", LastName: "Bond"}
+	name, phone := "Smith", "+14155552671"
+
+	// unsharded there's no other shard to ask, sharded a patch that keeps the name needs no lookup
+	if err := a.checkRenameOffShard(context.Background(), old, userPatch{LastName: &name}); err != nil {
+		t.Errorf("unsharded: %v", err)
+	}
+	a.shards = newShardMap(nil, 1000, nil)
+	if err := a.checkRenameOffShard(context.Background(), old, userPatch{Phone: &phone}); err != nil {
+		t.Errorf("sharded, no rename: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+// similar.go serves GET /users/similar?q=, typo-tolerant name search on the pg_trgm extension.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultSimilarLimit and maxSimilarLimit bound how many matches GET /users/similar returns
+const (
+	defaultSimilarLimit = 10
+	maxSimilarLimit     = 50
+)
+
+// similarUser is a match with its trigram similarity score (0-1), the user's fields are inlined
+type similarUser struct {
+	User
+	Score float64 `json:"score"`
+}
+
+// MarshalJSON adds score to the user's own JSON. Without it the embedded User.MarshalJSON
+// would be promoted to similarUser and score would be left out.
+func (m similarUser) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(m.User)
+	if err != nil {
+		return nil, err
+	}
+	score, err := json.Marshal(m.Score)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b[:len(b)-1], `,"score":`...)
+	return append(append(b, score...), '}'), nil
+}
+
+// similarUsersHandler returns the tenant's users whose first or last name is similar to ?q=,
+// best match first, e.g. "Jhon" finds "John". Only scores at or above cfg.similarityThreshold count.
+func (a *api) similarUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r, "q", "limit", "pretty") {
+		return
+	}
+
+	if a.pii != nil {
+		writeError(w, errNameSearchEncrypted)
+		return
+	}
+	if a.shards != nil {
+		writeError(w, errSharded)
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" || len(q) > 100 {
+		writeError(w, &ValidationError{Field: "q", Message: "q must be 1-100 characters"})
+		return
+	}
+
+	limit := defaultSimilarLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, invalidParam("limit"))
+			return
+		}
+		limit = min(n, maxSimilarLimit)
+	}
+
+	pretty, err := boolParam(r, "pretty")
+	if err != nil {
+		writeError(w, invalidParam("pretty"))
+		return
+	}
+
+	matches, err := a.similarUsers(ctx, q, a.cfg.similarityThreshold, limit)
+	if err != nil {
+		writeError(w, failed("failed to search users", err))
+		return
+	}
+
+	b, err := encodeJSON(matches, pretty)
+	if err != nil {
+		writeError(w, failed("failed to encode users", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(a.cfg.listMaxAge.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b)
+}
+
+// similarUsers runs the trigram search. The threshold is set with SET LOCAL for this transaction only,
+// so the % operator (which the GIN trgm indexes can serve) applies our cutoff rather than the server's 0.3.
+func (a *api) similarUsers(ctx context.Context, q string, threshold float64, limit int) (matches []similarUser, err error) {
+	ctx, span := tracer.Start(ctx, "similarUsers", trace.WithAttributes(attribute.Int("page.limit", limit)))
+	defer func() { finishSpan(span, err) }()
+
+	matches = []similarUser{}
+	err = withTx(ctx, a.readDB, func(tx *sql.Tx) error {
+		if _, err := a.exec(ctx, tx, "similarUsers.threshold",
+			`SELECT set_config('pg_trgm.similarity_threshold', $1, true)`,
+			strconv.FormatFloat(threshold, 'f', -1, 64),
+		); err != nil {
+			return err
+		}
+
+		rows, err := a.query(ctx, tx, "similarUsers",
+			`SELECT `+userColumns+`, GREATEST(similarity(first_name, $1), similarity(last_name, $1)) AS score
+			FROM users
+			WHERE tenant_id = $2 AND (first_name % $1 OR last_name % $1)
+			ORDER BY score DESC, id
+			LIMIT $3`,
+			q, GetTenantID(ctx), limit,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var m similarUser
+			if m.User, err = a.scanUser(scoreScanner{rows, &m.Score}); err != nil {
+				return err
+			}
+			matches = append(matches, m)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("db.rows_returned", len(matches)))
+	return matches, nil
+}
+
+// scoreScanner lets scanUser read a row that has a trailing score column
+type scoreScanner struct {
+	rows  *connRows
+	score *float64
+}
+
+func (s scoreScanner) Scan(dest ...any) error {
+	return s.rows.Scan(append(dest, s.score)...)
+}
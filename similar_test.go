@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSimilarUsersHandlerValidation(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+
+	// all rejected before the DB is touched
+	for _, target := range []string{
+		"/users/similar",
+		"/users/similar?q=%20%20",
+		"/users/similar?q=jhon&limit=0",
+		"/users/similar?q=jhon&limit=abc",
+	} {
+		w := httptest.NewRecorder()
+		a.similarUsersHandler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", target, w.Code)
+		}
+	}
+}
@@ -3,108 +3,854 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// createUser creates a new user in the database
-func (a *api) createUser(ctx context.Context, firstName, lastName string) (User, error) {
-	var u User
-	err := a.db.QueryRowContext(ctx,
-		`INSERT INTO users (first_name, last_name)
-		 VALUES ($1, $2)
-		 RETURNING id::text, first_name, last_name, created_at`,
-		firstName, lastName,
-	).Scan(&u.ID, &u.FirstName, &u.LastName, &u.CreatedAt)
+// userColumns is the column list every user query selects/returns, in the order scanUser expects
+const userColumns = `id::text, first_name, last_name, full_name, phone, is_active, created_at, updated_at`
 
+// scanUser scans a row produced with userColumns.
+// Timestamps are converted to UTC so JSON always ends in "Z", whatever offset the driver/session used.
+func scanUser(row interface{ Scan(dest ...any) error }) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.FirstName, &u.LastName, &u.FullName, &u.Phone, &u.IsActive, &u.CreatedAt, &u.UpdatedAt)
+	u.CreatedAt = u.CreatedAt.UTC()
+	u.UpdatedAt = u.UpdatedAt.UTC()
 	return u, err
 }
 
-// listUsers lists all users in the database
-func (a *api) listUsers(ctx context.Context) ([]User, error) {
-	rows, err := a.db.QueryContext(ctx,
-		`SELECT id::text, first_name, last_name, created_at
+// dbtx is what *sql.DB and *sql.Tx have in common, so a query can run standalone or inside a transaction
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// rowScanner is what queryRow returns: a *sql.Row, or an errRow when no connection could be had
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// errRow is a row whose Scan fails with err, like a *sql.Row whose query failed
+type errRow struct{ err error }
+
+func (r errRow) Scan(...any) error { return r.err }
+
+// connRow is a *sql.Row that holds its statement's connection until Scan, which hands it back.
+// Every queryRow result has to be scanned, or the connection stays out of the pool.
+type connRow struct {
+	*sql.Row
+	release func()
+}
+
+func (r connRow) Scan(dest ...any) error {
+	// the row is closed once Scan returns, only then can the connection close
+	defer r.release()
+	return r.Row.Scan(dest...)
+}
+
+// connRows is *sql.Rows that holds its statement's connection until Close, which hands it back.
+// Callers must Close it even after reading every row.
+type connRows struct {
+	*sql.Rows
+	release func()
+}
+
+func (r *connRows) Close() error {
+	err := r.Rows.Close()
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
+	return err
+}
+
+// queryRow, query and exec run a statement on q (the pool or a tx) and log it if it's slower than
+// cfg.slowQueryThreshold. name identifies the statement in the log line.
+func (a *api) queryRow(ctx context.Context, q dbtx, name, query string, args ...any) rowScanner {
+	conn, t, err := a.acquire(ctx, q, name)
+	defer a.logSlowQuery(ctx, name, t)
+	if err != nil {
+		return errRow{err}
+	}
+	t.start()
+	return connRow{Row: conn.QueryRowContext(ctx, query, args...), release: conn.release}
+}
+
+func (a *api) query(ctx context.Context, q dbtx, name, query string, args ...any) (*connRows, error) {
+	conn, t, err := a.acquire(ctx, q, name)
+	defer a.logSlowQuery(ctx, name, t)
+	if err != nil {
+		return nil, err
+	}
+	t.start()
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		conn.release()
+		return nil, err
+	}
+	return &connRows{Rows: rows, release: conn.release}, nil
+}
+
+func (a *api) exec(ctx context.Context, q dbtx, name, query string, args ...any) (sql.Result, error) {
+	conn, t, err := a.acquire(ctx, q, name)
+	defer a.logSlowQuery(ctx, name, t)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.release()
+	t.start()
+	return conn.ExecContext(ctx, query, args...)
+}
+
+// stmtConn is the connection one statement runs on, release hands it back to the pool
+type stmtConn struct {
+	dbtx
+	release func()
+}
+
+// stmtTiming splits a statement's time into waiting for a pool connection and running on it,
+// so a slow query log line says whether to tune the pool or the query
+type stmtTiming struct {
+	begin, execStart time.Time
+}
+
+func (t *stmtTiming) start() { t.execStart = time.Now() }
+
+// acquire takes a connection from the pool for one statement, timing the wait. At most
+// cfg.dbAcquireTimeout is spent waiting (when set), so an exhausted pool fails fast with a 503
+// instead of eating the whole request deadline. Inside a transaction the connection is already
+// held (acquired by BeginTx) and acquire only starts the clock.
+func (a *api) acquire(ctx context.Context, q dbtx, name string) (stmtConn, *stmtTiming, error) {
+	countQuery(ctx)
+	t := &stmtTiming{begin: time.Now()}
+	db, ok := q.(*sql.DB)
+	if !ok {
+		t.start()
+		return stmtConn{dbtx: q, release: func() {}}, t, nil
+	}
+
+	actx := ctx
+	if a.cfg.dbAcquireTimeout > 0 {
+		var cancel context.CancelFunc
+		actx, cancel = context.WithTimeout(ctx, a.cfg.dbAcquireTimeout)
+		defer cancel()
+	}
+	conn, err := db.Conn(actx)
+	if err != nil {
+		return stmtConn{}, t, fmt.Errorf("acquire connection for %s: %w", name, err)
+	}
+	return stmtConn{dbtx: conn, release: func() { _ = conn.Close() }}, t, nil
+}
+
+// readRow and readQuery are queryRow and query for idempotent reads on a pool. A driver.ErrBadConn
+// (the connection was already closed by Postgres, e.g. after sitting idle) is retried once on a fresh
+// connection instead of surfacing as a 500. Never use them for writes: a statement that failed like
+// that may still have run, and retrying an INSERT could insert twice.
+func (a *api) readRow(ctx context.Context, db *sql.DB, name, query string, args ...any) retryRow {
+	return retryRow{a: a, ctx: ctx, db: db, name: name, query: query, args: args}
+}
+
+func (a *api) readQuery(ctx context.Context, db *sql.DB, name, query string, args ...any) (rows *connRows, err error) {
+	err = retryBadConn(ctx, name, func() error {
+		rows, err = a.query(ctx, db, name, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// retryRow defers a readRow query to Scan, which is where a *sql.Row reports its error
+type retryRow struct {
+	a           *api
+	ctx         context.Context
+	db          *sql.DB
+	name, query string
+	args        []any
+}
+
+func (r retryRow) Scan(dest ...any) error {
+	return retryBadConn(r.ctx, r.name, func() error {
+		return r.a.queryRow(r.ctx, r.db, r.name, r.query, r.args...).Scan(dest...)
+	})
+}
+
+// retryBadConn runs fn and, if it failed with driver.ErrBadConn and ctx is still live, runs it once more
+func retryBadConn(ctx context.Context, name string, fn func() error) error {
+	err := fn()
+	if !errors.Is(err, driver.ErrBadConn) || ctx.Err() != nil {
+		return err
+	}
+	log.Printf("bad connection, retrying request_id=%s query=%s", GetRequestID(ctx), name)
+	return fn()
+}
+
+// logSlowQuery logs a statement that took cfg.slowQueryThreshold or longer, including the time spent
+// waiting for a connection (acquire) and running the statement (exec). A statement that never got a
+// connection has exec=0s.
+func (a *api) logSlowQuery(ctx context.Context, name string, t *stmtTiming) {
+	d := time.Since(t.begin)
+	if a.cfg.slowQueryThreshold <= 0 || d < a.cfg.slowQueryThreshold {
+		return
+	}
+	acquire, exec := d, time.Duration(0)
+	if !t.execStart.IsZero() {
+		acquire, exec = t.execStart.Sub(t.begin), time.Since(t.execStart)
+	}
+	log.Printf("slow query request_id=%s query=%s duration=%s acquire=%s exec=%s", GetRequestID(ctx), name, d, acquire, exec)
+}
+
+// createUser creates a new user in the database, phone is optional and already normalized
+func (a *api) createUser(ctx context.Context, firstName, lastName string, phone *string) (u User, err error) {
+	ctx, span := tracer.Start(ctx, "createUser")
+	defer func() { finishSpan(span, err) }()
+
+	// the unique index only covers the write shard, the others are checked first
+	if _, found, err := a.findOnOtherShards(ctx, firstName, lastName); err != nil || found {
+		if found {
+			err = ErrDuplicateUser
+		}
+		return User{}, err
+	}
+
+	u, err = a.insertUser(ctx, a.writeDB(), firstName, lastName, phone)
+	if isUniqueViolation(err) {
+		return User{}, ErrDuplicateUser
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	span.SetAttributes(attribute.String("user.id", u.ID))
+	a.events.publish(userEvent{Type: eventCreated, ID: u.ID, TenantID: GetTenantID(ctx)})
+	return u, nil
+}
+
+// createOrGetUser is createUser made idempotent on the natural key (tenant, first name, last name).
+// On a name conflict it returns the existing row untouched with created=false.
+func (a *api) createOrGetUser(ctx context.Context, firstName, lastName string, phone *string) (u User, created bool, err error) {
+	ctx, span := tracer.Start(ctx, "createOrGetUser")
+	defer func() { finishSpan(span, err) }()
+
+	// a user created before the split is on another shard, where the INSERT below can't see it
+	if u, found, err := a.findOnOtherShards(ctx, firstName, lastName); err != nil || found {
+		if found {
+			span.SetAttributes(attribute.String("user.id", u.ID), attribute.Bool("user.created", false))
+		}
+		return u, false, err
+	}
+
+	tenant := GetTenantID(ctx)
+	// two tries: the conflicting row can be deleted between our INSERT and SELECT
+	for range 2 {
+		// no conflict target: the name is unique by (first_name, last_name) or by name_hash when encrypted
+		u, err = a.scanUser(a.queryRow(ctx, a.writeDB(), "createOrGetUser.insert",
+			`INSERT INTO users (tenant_id, first_name, last_name, phone, name_hash)
+			 VALUES ($1, $2, $3, $4, $5)
+			 ON CONFLICT DO NOTHING
+			 RETURNING `+userColumns,
+			tenant, a.pii.seal("first_name", firstName), a.pii.seal("last_name", lastName), phone, a.pii.nameHash(firstName, lastName),
+		))
+		if err == nil {
+			span.SetAttributes(attribute.String("user.id", u.ID), attribute.Bool("user.created", true))
+			a.events.publish(userEvent{Type: eventCreated, ID: u.ID, TenantID: tenant})
+			return u, true, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return User{}, false, err
+		}
+
+		// DO NOTHING returns no row on conflict, fetch the one that's there
+		u, err = a.findUserByName(ctx, a.writeDB(), firstName, lastName)
+		if err == nil {
+			span.SetAttributes(attribute.String("user.id", u.ID), attribute.Bool("user.created", false))
+			return u, false, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return User{}, false, err
+		}
+	}
+	return User{}, false, fmt.Errorf("create or get %s %s: row kept disappearing", firstName, lastName)
+}
+
+// findUserByName reads the tenant's user with this name from db, sql.ErrNoRows if there's none
+func (a *api) findUserByName(ctx context.Context, db *sql.DB, firstName, lastName string) (User, error) {
+	byName, nameArgs := a.nameFilter(2, firstName, lastName)
+	return a.scanUser(a.queryRow(ctx, db, "findUserByName",
+		`SELECT `+userColumns+`
 		FROM users
-		ORDER BY id`,
+		WHERE tenant_id = $1 AND `+byName,
+		append([]any{GetTenantID(ctx)}, nameArgs...)...,
+	))
+}
+
+// insertUser runs the INSERT for createUser on q, sealing the names if encryption is on
+func (a *api) insertUser(ctx context.Context, q dbtx, firstName, lastName string, phone *string) (User, error) {
+	return a.scanUser(a.queryRow(ctx, q, "insertUser",
+		`INSERT INTO users (tenant_id, first_name, last_name, phone, name_hash)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING `+userColumns,
+		GetTenantID(ctx), a.pii.seal("first_name", firstName), a.pii.seal("last_name", lastName), phone,
+		a.pii.nameHash(firstName, lastName),
+	))
+}
+
+// maxCopyAttempts bounds how many "(copy n)" names duplicateUser tries before giving up
+const maxCopyAttempts = 100
+
+// copyLastName is the last name of the n-th copy: "Bond (copy)", "Bond (copy 2)", ...
+func copyLastName(lastName string, n int) string {
+	if n == 1 {
+		return lastName + " (copy)"
+	}
+	return fmt.Sprintf("%s (copy %d)", lastName, n)
+}
+
+// duplicateUser inserts a copy of user id with a suffixed last name, bumping the copy number
+// until it finds a name that doesn't hit the unique constraint.
+// Returns sql.ErrNoRows if the source user doesn't exist.
+func (a *api) duplicateUser(ctx context.Context, id string) (u User, err error) {
+	ctx, span := tracer.Start(ctx, "duplicateUser", trace.WithAttributes(attribute.String("user.source_id", id)))
+	defer func() { finishSpan(span, err) }()
+
+	src, err := a.getUserById(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+
+	for n := 1; n <= maxCopyAttempts; n++ {
+		u, err = a.createUser(ctx, src.FirstName, copyLastName(src.LastName, n), src.Phone)
+		// createUser reports the unique violation as ErrDuplicateUser
+		if !errors.Is(err, ErrDuplicateUser) {
+			return u, err
+		}
+	}
+	return User{}, fmt.Errorf("no free copy name for user %s after %d attempts", id, maxCopyAttempts)
+}
+
+// listUsers lists one page of users from the database
+func (a *api) listUsers(ctx context.Context, p listParams) (users []User, err error) {
+	err = a.streamUsers(ctx, p, func(u User) error {
+		users = append(users, u)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// streamUsers runs the listUsers query and calls fn for each row straight off the cursor,
+// so the page is never held in memory. An error from fn stops the iteration and is returned.
+// A zero p.limit means no limit at all (the CSV export), parseListParams never produces one.
+func (a *api) streamUsers(ctx context.Context, p listParams, fn func(User) error) (err error) {
+	ctx, span := tracer.Start(ctx, "listUsers", trace.WithAttributes(
+		attribute.Int("page.limit", p.limit),
+		attribute.Int("page.offset", p.offset),
+	))
+	defer func() { finishSpan(span, err) }()
+
+	if a.shards != nil {
+		var n int
+		if n, err = a.streamShards(ctx, p, fn); err != nil {
+			return err
+		}
+		span.SetAttributes(attribute.Int("db.rows_returned", n))
+		return nil
+	}
+
+	// LIMIT NULL is no limit
+	var limit any = p.limit
+	if p.limit == 0 {
+		limit = nil
+	}
+
+	// a nil p.active binds NULL, which turns the filter off
+	query := `SELECT ` + userColumns + `
+		FROM users
+		WHERE tenant_id = $3
+		  AND ($4::boolean IS NULL OR is_active = $4)
+		` + orderBy(p.order, p.nulls) + `
+		LIMIT $1 OFFSET $2`
+	args := []any{limit, p.offset, GetTenantID(ctx), p.active}
+
+	n := 0
+	each := func(rows *connRows) error {
+		defer rows.Close()
+		for rows.Next() {
+			u, err := a.scanUser(rows)
+			if err != nil {
+				return err
+			}
+			if err := fn(u); err != nil {
+				return err
+			}
+			n++
+		}
+		return rows.Err()
+	}
+
+	if p.statementTimeout > 0 {
+		// the cursor has to be read inside the transaction that raised the timeout. No readQuery retry,
+		// rows may already have gone to fn
+		err = withStatementTimeout(ctx, a.readDB, p.statementTimeout, func(tx *sql.Tx) error {
+			rows, err := a.query(ctx, tx, "listUsers", query, args...)
+			if err != nil {
+				return err
+			}
+			return each(rows)
+		})
+	} else {
+		var rows *connRows
+		if rows, err = a.readQuery(ctx, a.readDB, "listUsers", query, args...); err == nil {
+			err = each(rows)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	span.SetAttributes(attribute.Int("db.rows_returned", n))
+	return nil
+}
+
+// lastNameCounts counts the tenant's users per last name, most common first (ties alphabetical).
+// It's a GROUP BY over every row of the tenant, callers cache it.
+func (a *api) lastNameCounts(ctx context.Context, limit int) (counts []lastNameCount, err error) {
+	ctx, span := tracer.Start(ctx, "lastNameCounts", trace.WithAttributes(attribute.Int("page.limit", limit)))
+	defer func() { finishSpan(span, err) }()
+
+	rows, err := a.readQuery(ctx, a.readDB, "lastNameCounts",
+		`SELECT last_name, count(*)
+		FROM users
+		WHERE tenant_id = $2
+		GROUP BY last_name
+		ORDER BY count(*) DESC, last_name
+		LIMIT $1`,
+		limit, GetTenantID(ctx),
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var users []User
-
+	counts = []lastNameCount{}
 	for rows.Next() {
-		var u User
-		if err := rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.CreatedAt); err != nil {
+		var c lastNameCount
+		if err := rows.Scan(&c.LastName, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("db.rows_returned", len(counts)))
+	return counts, nil
+}
+
+// signupsByDay counts the tenant's users created since since, per UTC day ("2024-01-01"). Days without
+// signups are simply missing. Sharded, every shard is counted and the counts added up.
+func (a *api) signupsByDay(ctx context.Context, since time.Time) (byDay map[string]int64, err error) {
+	ctx, span := tracer.Start(ctx, "signupsByDay")
+	defer func() { finishSpan(span, err) }()
+
+	byDay = map[string]int64{}
+	for _, db := range a.readDBs() {
+		rows, err := a.readQuery(ctx, db, "signupsByDay",
+			`SELECT to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, count(*)
+			FROM users
+			WHERE tenant_id = $1 AND created_at >= $2
+			GROUP BY day`,
+			GetTenantID(ctx), since,
+		)
+		if err != nil {
+			return nil, err
+		}
+		err = func() error {
+			defer rows.Close()
+			for rows.Next() {
+				var day string
+				var n int64
+				if err := rows.Scan(&day, &n); err != nil {
+					return err
+				}
+				byDay[day] += n
+			}
+			return rows.Err()
+		}()
+		if err != nil {
 			return nil, err
 		}
-		users = append(users, u)
 	}
 
+	span.SetAttributes(attribute.Int("db.rows_returned", len(byDay)))
+	return byDay, nil
+}
+
+// eventsSince reads up to limit of the tenant's change feed entries after seq, oldest first.
+// seq is handed out before commit, so a transaction still in flight can end up holding a lower seq than
+// one that already committed. Rows are only returned once every transaction older than theirs (by
+// transaction id) has finished, so a reader's cursor doesn't move past a concurrent write's lower seq.
+func (a *api) eventsSince(ctx context.Context, seq int64, limit int) (events []feedEvent, err error) {
+	ctx, span := tracer.Start(ctx, "eventsSince", trace.WithAttributes(attribute.Int64("feed.since", seq)))
+	defer func() { finishSpan(span, err) }()
+
+	rows, err := a.readQuery(ctx, a.readDB, "eventsSince",
+		`SELECT seq, payload
+		FROM events
+		WHERE tenant_id = $1 AND seq > $2
+		  AND tx_id < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY seq
+		LIMIT $3`,
+		GetTenantID(ctx), seq, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e feedEvent
+		if err := rows.Scan(&e.Seq, &e.Payload); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return users, nil
+	span.SetAttributes(attribute.Int("db.rows_returned", len(events)))
+	return events, nil
 }
 
 // getUserById gets a user by id from the database
-func (a *api) getUserById(ctx context.Context, id string) (User, error) {
+func (a *api) getUserById(ctx context.Context, id string) (u User, err error) {
+	ctx, span := tracer.Start(ctx, "getUserById", trace.WithAttributes(attribute.String("user.id", id)))
+	defer func() { finishSpan(span, err) }()
+
 	log.Printf("DB HIT id=%s", id)
 
-	var u User
-	err := a.db.QueryRowContext(ctx,
-		`SELECT id::text, first_name, last_name, created_at
+	// another tenant's id is simply "not found", so existence doesn't leak across tenants
+	query := `SELECT ` + userColumns + `
 		FROM users
-		WHERE id = $1`,
-		id,
-	).Scan(&u.ID, &u.FirstName, &u.LastName, &u.CreatedAt)
+		WHERE id = $1 AND tenant_id = $2`
+	tenant := GetTenantID(ctx)
+
+	u, err = a.scanUser(a.readRow(ctx, a.readDBForID(id), "getUserById", query, id, tenant))
+	if primary := a.dbForID(id); errors.Is(err, sql.ErrNoRows) && a.readDBForID(id) != primary {
+		// the replica may not have caught up with a write that just happened (e.g. read-after-create)
+		span.SetAttributes(attribute.Bool("db.primary_fallback", true))
+		return a.scanUser(a.readRow(ctx, primary, "getUserById.primary", query, id, tenant))
+	}
 	return u, err
 }
 
-// deleteUserById deletes a user by id from the database
-func (a *api) deleteUserById(ctx context.Context, id string) (bool, error) {
-	res, err := a.db.ExecContext(ctx,
-		`DELETE FROM users WHERE id = $1`,
-		id,
-	)
-	if err != nil {
-		return false, err
+// getUsersByIDs loads every user in ids that exists (in this tenant) with a single query
+func (a *api) getUsersByIDs(ctx context.Context, ids []string) (users []User, err error) {
+	ctx, span := tracer.Start(ctx, "getUsersByIDs", trace.WithAttributes(attribute.Int("ids.count", len(ids))))
+	defer func() { finishSpan(span, err) }()
+
+	// one query per shard holding any of the ids, shards come back in id order so the result stays sorted
+	for _, db := range a.readDBs() {
+		var onShard []string
+		for _, id := range ids {
+			if a.readDBForID(id) == db {
+				onShard = append(onShard, id)
+			}
+		}
+		if len(onShard) == 0 {
+			continue
+		}
+
+		rows, err := a.readQuery(ctx, db, "getUsersByIDs",
+			`SELECT `+userColumns+`
+			FROM users
+			WHERE id = ANY($1) AND tenant_id = $2
+			ORDER BY id`,
+			idArray(onShard), GetTenantID(ctx),
+		)
+		if err != nil {
+			return nil, err
+		}
+		err = func() error {
+			defer rows.Close()
+			for rows.Next() {
+				u, err := a.scanUser(rows)
+				if err != nil {
+					return err
+				}
+				users = append(users, u)
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	span.SetAttributes(attribute.Int("db.rows_returned", len(users)))
+	return users, nil
+}
+
+// deleteUserById deletes a user by id from the database and returns the deleted row
+func (a *api) deleteUserById(ctx context.Context, id string, opts writeOptions) (u User, deleted bool, err error) {
+	ctx, span := tracer.Start(ctx, "deleteUserById", trace.WithAttributes(
+		attribute.String("user.id", id),
+		attribute.Bool("dry_run", opts.dryRun),
+	))
+	defer func() { finishSpan(span, err) }()
+
+	err = a.txFor(opts)(ctx, a.dbForID(id), func(tx *sql.Tx) error {
+		if err := a.checkUnmodifiedSince(ctx, tx, id, opts.unmodifiedSince); err != nil {
+			return err
+		}
+		var err error
+		u, err = a.scanUser(a.queryRow(ctx, tx, "deleteUserById",
+			`DELETE FROM users WHERE id = $1 AND tenant_id = $2
+			RETURNING `+userColumns,
+			id, GetTenantID(ctx),
+		))
+		if err != nil {
+			return err
+		}
+		// tell the other replicas to drop their cached copy once this commits
+		return a.notifyUserChanged(ctx, tx, id)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		span.SetAttributes(attribute.Int64("db.rows_affected", 0))
+		return User{}, false, nil
 	}
-	n, err := res.RowsAffected()
 	if err != nil {
-		return false, err
+		return User{}, false, err
 	}
-	return n > 0, nil
+	span.SetAttributes(attribute.Int64("db.rows_affected", 1))
+	if !opts.dryRun {
+		a.events.publish(userEvent{Type: eventDeleted, ID: u.ID, TenantID: GetTenantID(ctx)})
+	}
+	return u, true, nil
 }
 
-// updateUserByID updates a user by id from the database
+// updateUserByID updates a user by id from the database and reports which fields actually changed.
+// The old row is read and locked in the same transaction so the diff can't race another writer.
 func (a *api) updateUserByID(
 	ctx context.Context,
-	id int64,
-	firstName *string,
-	lastName *string,
-) (User, bool, error) {
-
-	query := `
-		UPDATE users
-		SET
-			first_name = COALESCE($2, first_name),
-			last_name  = COALESCE($3, last_name)
-		WHERE id = $1
-		RETURNING id::text, first_name, last_name, created_at
-	`
+	id string,
+	patch userPatch,
+	opts writeOptions,
+) (u User, changed []string, updated bool, err error) {
+	ctx, span := tracer.Start(ctx, "updateUserByID", trace.WithAttributes(
+		attribute.String("user.id", id),
+		attribute.Bool("dry_run", opts.dryRun),
+	))
+	defer func() { finishSpan(span, err) }()
 
-	var u User
-	err := a.db.QueryRowContext(ctx, query, id, firstName, lastName).
-		Scan(&u.ID, &u.FirstName, &u.LastName, &u.CreatedAt)
+	err = a.txFor(opts)(ctx, a.dbForID(id), func(tx *sql.Tx) error {
+		old, err := a.lockUser(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkUnmodified(old.UpdatedAt, opts.unmodifiedSince); err != nil {
+			return err
+		}
+		if err := a.checkRenameOffShard(ctx, old, patch); err != nil {
+			return err
+		}
+		stored, nameHash := a.sealPatch(old, patch)
+		query, args := buildUserUpdate(id, GetTenantID(ctx), stored, nameHash)
+		u, err = a.scanUser(a.queryRow(ctx, tx, "updateUserByID", query, args...))
+		if err != nil {
+			return err
+		}
+		changed = changedFields(old, u)
+		return a.notifyUserChanged(ctx, tx, u.ID)
+	})
 
-	if err == sql.ErrNoRows {
+	if errors.Is(err, sql.ErrNoRows) {
+		span.SetAttributes(attribute.Int64("db.rows_affected", 0))
+		return User{}, nil, false, nil
+	}
+	// renaming onto another user's name
+	if isUniqueViolation(err) {
+		return User{}, nil, false, ErrDuplicateUser
+	}
+	if err != nil {
+		return User{}, nil, false, err
+	}
+
+	span.SetAttributes(attribute.Int64("db.rows_affected", 1))
+	if !opts.dryRun {
+		a.events.publish(userEvent{Type: eventUpdated, ID: u.ID, TenantID: GetTenantID(ctx)})
+	}
+	return u, changed, true, nil
+}
+
+// checkRenameOffShard fails with a nameConflictError if patch renames old to the name of a user on
+// another shard, which old's shard's unique index can't see. A no-op unless sharded.
+func (a *api) checkRenameOffShard(ctx context.Context, old User, p userPatch) error {
+	if p.FirstName == nil && p.LastName == nil {
+		return nil
+	}
+	first, last := old.FirstName, old.LastName
+	if p.FirstName != nil {
+		first = *p.FirstName
+	}
+	if p.LastName != nil {
+		last = *p.LastName
+	}
+	other, found, err := a.findNamesOffShard(ctx, a.dbForID(old.ID), []string{first}, []string{last})
+	if err != nil || !found {
+		return err
+	}
+	return &nameConflictError{ID: old.ID, ConflictID: other.ID, Name: first + " " + last}
+}
+
+// lockUser reads a user and locks its row until tx ends
+func (a *api) lockUser(ctx context.Context, tx *sql.Tx, id any) (User, error) {
+	return a.scanUser(a.queryRow(ctx, tx, "lockUser",
+		`SELECT `+userColumns+` FROM users WHERE id = $1 AND tenant_id = $2 FOR UPDATE`,
+		id, GetTenantID(ctx),
+	))
+}
+
+// setUserActive activates or deactivates a user, returns updated=false if the user doesn't exist
+func (a *api) setUserActive(ctx context.Context, id string, active bool) (u User, updated bool, err error) {
+	ctx, span := tracer.Start(ctx, "setUserActive", trace.WithAttributes(
+		attribute.String("user.id", id),
+		attribute.Bool("user.active", active),
+	))
+	defer func() { finishSpan(span, err) }()
+
+	err = withTx(ctx, a.dbForID(id), func(tx *sql.Tx) error {
+		var err error
+		u, err = a.scanUser(a.queryRow(ctx, tx, "setUserActive",
+			`UPDATE users SET is_active = $3, updated_at = now()
+			WHERE id = $1 AND tenant_id = $2
+			RETURNING `+userColumns,
+			id, GetTenantID(ctx), active,
+		))
+		if err != nil {
+			return err
+		}
+		return a.notifyUserChanged(ctx, tx, u.ID)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		span.SetAttributes(attribute.Int64("db.rows_affected", 0))
 		return User{}, false, nil
 	}
 	if err != nil {
 		return User{}, false, err
 	}
 
+	span.SetAttributes(attribute.Int64("db.rows_affected", 1))
+	a.events.publish(userEvent{Type: eventUpdated, ID: u.ID, TenantID: GetTenantID(ctx)})
 	return u, true, nil
 }
+
+// buildUserUpdate builds the UPDATE for a patch, setting only the columns the patch touches.
+// $1 is always the id and $2 the tenant, values follow in column order. A new optional column is one more line here.
+// updated_at is always bumped, so an empty patch is still a valid statement.
+// nameHash is the new name_hash when the patch renames an encrypted user, nil leaves it alone.
+func buildUserUpdate(id string, tenant int64, p userPatch, nameHash *string) (string, []any) {
+	sets, args := patchSets(p, nameHash, []any{id, tenant})
+	query := `UPDATE users SET ` + strings.Join(sets, ", ") + `
+		WHERE id = $1 AND tenant_id = $2
+		RETURNING ` + userColumns
+	return query, args
+}
+
+// patchSets is the SET list shared by buildUserUpdate and buildBulkUserUpdate: the columns p touches,
+// with their values appended to args (so placeholders continue after the caller's), and updated_at last.
+func patchSets(p userPatch, nameHash *string, args []any) ([]string, []any) {
+	var sets []string
+	set := func(col string, v any) {
+		args = append(args, v)
+		sets = append(sets, fmt.Sprintf("%s = $%d", col, len(args)))
+	}
+
+	if p.FirstName != nil {
+		set("first_name", *p.FirstName)
+	}
+	if p.LastName != nil {
+		set("last_name", *p.LastName)
+	}
+	if nameHash != nil {
+		set("name_hash", *nameHash)
+	}
+	if p.ClearPhone {
+		sets = append(sets, "phone = NULL")
+	} else if p.Phone != nil {
+		set("phone", *p.Phone)
+	}
+	return append(sets, "updated_at = now()"), args
+}
+
+// txFor picks the transaction runner for a mutation: dry runs always roll back.
+func (a *api) txFor(opts writeOptions) func(context.Context, *sql.DB, func(*sql.Tx) error) error {
+	if opts.dryRun {
+		return withRollbackTx
+	}
+	return withTx
+}
+
+// indexReport is the GET /admin/db/indexes body. Counters are cumulative since the last stats reset.
+type indexReport struct {
+	SeqScan  int64        `json:"seqScan"`
+	IdxScan  int64        `json:"idxScan"`
+	LiveRows int64        `json:"liveRows"`
+	Indexes  []indexStats `json:"indexes"`
+}
+
+type indexStats struct {
+	Name       string `json:"name"`
+	Definition string `json:"definition"`
+	Scans      int64  `json:"scans"`
+	TupRead    int64  `json:"tuplesRead"`
+	TupFetch   int64  `json:"tuplesFetched"`
+	SizeBytes  int64  `json:"sizeBytes"`
+}
+
+// indexUsage reads pg_stat_user_tables/pg_stat_user_indexes for the users table
+func (a *api) indexUsage(ctx context.Context) (report indexReport, err error) {
+	ctx, span := tracer.Start(ctx, "indexUsage")
+	defer func() { finishSpan(span, err) }()
+
+	err = a.queryRow(ctx, a.db, "indexUsage.table",
+		`SELECT seq_scan, COALESCE(idx_scan, 0), n_live_tup
+		FROM pg_stat_user_tables WHERE relname = 'users'`,
+	).Scan(&report.SeqScan, &report.IdxScan, &report.LiveRows)
+	if err != nil {
+		return indexReport{}, err
+	}
+
+	rows, err := a.query(ctx, a.db, "indexUsage.indexes",
+		`SELECT indexrelname, pg_get_indexdef(indexrelid), idx_scan, idx_tup_read, idx_tup_fetch,
+			pg_relation_size(indexrelid)
+		FROM pg_stat_user_indexes
+		WHERE relname = 'users'
+		ORDER BY idx_scan, indexrelname`,
+	)
+	if err != nil {
+		return indexReport{}, err
+	}
+	defer rows.Close()
+
+	report.Indexes = []indexStats{}
+	for rows.Next() {
+		var u indexStats
+		if err := rows.Scan(&u.Name, &u.Definition, &u.Scans, &u.TupRead, &u.TupFetch, &u.SizeBytes); err != nil {
+			return indexReport{}, err
+		}
+		report.Indexes = append(report.Indexes, u)
+	}
+	return report, rows.Err()
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildUserUpdate(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name     string
+		patch    userPatch
+		nameHash *string
+		wantSets string
+		wantArgs []any
+	}{
+		{
+			name:     "single field",
+			patch:    userPatch{LastName: str("Bond")},
+			wantSets: "last_name = $3, updated_at = now()",
+			wantArgs: []any{"7", int64(3), "Bond"},
+		},
+		{
+			name:     "multiple fields",
+			patch:    userPatch{FirstName: str("James"), LastName: str("Bond"), Phone: str("+14155552671")},
+			wantSets: "first_name = $3, last_name = $4, phone = $5, updated_at = now()",
+			wantArgs: []any{"7", int64(3), "James", "Bond", "+14155552671"},
+		},
+		{
+			name:     "clear phone",
+			patch:    userPatch{FirstName: str("James"), ClearPhone: true},
+			wantSets: "first_name = $3, phone = NULL, updated_at = now()",
+			wantArgs: []any{"7", int64(3), "James"},
+		},
+		{
+			name:     "encrypted rename",
+			patch:    userPatch{LastName: str("enc:v1:x")},
+			nameHash: str("abc123"),
+			wantSets: "last_name = $3, name_hash = $4, updated_at = now()",
+			wantArgs: []any{"7", int64(3), "enc:v1:x", "abc123"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := buildUserUpdate("7", 3, tt.patch, tt.nameHash)
+
+			if !strings.Contains(query, "SET "+tt.wantSets+"\n") {
+				t.Errorf("expected SET %q in query:\n%s", tt.wantSets, query)
+			}
+			if !strings.Contains(query, "WHERE id = $1 AND tenant_id = $2") || !strings.Contains(query, "RETURNING "+userColumns) {
+				t.Errorf("query must filter by $1/$2 and return the full row:\n%s", query)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+// fakeRow scans fixed values, standing in for a *sql.Row
+type fakeRow []any
+
+func (r fakeRow) Scan(dest ...any) error {
+	for i, d := range dest {
+		reflect.ValueOf(d).Elem().Set(reflect.ValueOf(r[i]))
+	}
+	return nil
+}
+
+func TestScanUserNormalizesToUTC(t *testing.T) {
+	// what a session running in Asia/Kolkata would hand back
+	ist := time.FixedZone("IST", 5*3600+1800)
+	created := time.Date(2024, 3, 1, 17, 30, 0, 0, ist)
+
+	u, err := scanUser(fakeRow{"1", "James", "Bond", "James Bond", (*string)(nil), true, created, created})
+	if err != nil {
+		t.Fatalf("scanUser: %v", err)
+	}
+
+	b, err := json.Marshal(u)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var out map[string]string
+	_ = json.Unmarshal(b, &out)
+
+	for _, field := range []string{"createdAt", "updatedAt"} {
+		if out[field] != "2024-03-01T12:00:00Z" {
+			t.Errorf("expected %s in UTC with Z, got %q", field, out[field])
+		}
+	}
+}
+
+func TestRetryBadConn(t *testing.T) {
+	ctx := context.Background()
+	calls := 0
+	failing := func(errs ...error) func() error {
+		calls = 0
+		return func() error {
+			calls++
+			if calls <= len(errs) {
+				return errs[calls-1]
+			}
+			return nil
+		}
+	}
+
+	if err := retryBadConn(ctx, "q", failing(driver.ErrBadConn)); err != nil || calls != 2 {
+		t.Errorf("one bad conn: err=%v calls=%d, want nil after 2", err, calls)
+	}
+	if err := retryBadConn(ctx, "q", failing(driver.ErrBadConn, driver.ErrBadConn)); !errors.Is(err, driver.ErrBadConn) || calls != 2 {
+		t.Errorf("two bad conns: err=%v calls=%d, want ErrBadConn after 2", err, calls)
+	}
+	if err := retryBadConn(ctx, "q", failing(sql.ErrNoRows)); !errors.Is(err, sql.ErrNoRows) || calls != 1 {
+		t.Errorf("other errors: err=%v calls=%d, want no retry", err, calls)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_ = retryBadConn(canceled, "q", failing(driver.ErrBadConn))
+	if calls != 1 {
+		t.Errorf("canceled ctx: calls=%d, want no retry", calls)
+	}
+}
+
+// nopConnector opens connections whose statements do nothing, enough to exercise the pool
+type nopConnector struct{}
+
+func (nopConnector) Connect(context.Context) (driver.Conn, error) { return nopConn{}, nil }
+func (nopConnector) Driver() driver.Driver                        { return nil }
+
+type nopConn struct{}
+
+func (nopConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (nopConn) Close() error                        { return nil }
+func (nopConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+func (nopConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (nopConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return &oneRow{}, nil
+}
+
+// oneRow is a single row holding the text "1"
+type oneRow struct{ done bool }
+
+func (*oneRow) Columns() []string { return []string{"n"} }
+func (*oneRow) Close() error      { return nil }
+func (r *oneRow) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = "1"
+	return nil
+}
+
+func TestExecAcquireTimeout(t *testing.T) {
+	db := sql.OpenDB(nopConnector{})
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	cfg := defaultConfig()
+	cfg.dbAcquireTimeout = 20 * time.Millisecond
+	a := newAPI(cfg, db, newMemoryCache())
+	ctx := context.Background()
+
+	if _, err := a.exec(ctx, db, "free", "SELECT 1"); err != nil {
+		t.Fatalf("exec on a free pool: %v", err)
+	}
+
+	// hold the only connection, the next statement has to wait for it
+	held, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = a.exec(ctx, db, "exhausted", "SELECT 1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("exhausted pool: err=%v, want DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("gave up after %s, want about DB_ACQUIRE_TIMEOUT", d)
+	}
+
+	// once it's back the pool works again, release must have returned the first connection too
+	_ = held.Close()
+	if _, err := a.exec(ctx, db, "released", "SELECT 1"); err != nil {
+		t.Errorf("exec after release: %v", err)
+	}
+}
+
+func TestQueryReleasesConnection(t *testing.T) {
+	db := sql.OpenDB(nopConnector{})
+	defer db.Close()
+	// with no idle connections kept, a released connection closes and OpenConnections drops back
+	db.SetMaxIdleConns(0)
+	a := newAPI(defaultConfig(), db, newMemoryCache())
+	ctx := context.Background()
+
+	var n string
+	if err := a.queryRow(ctx, db, "row", "SELECT 1").Scan(&n); err != nil || n != "1" {
+		t.Fatalf("queryRow = %q, %v", n, err)
+	}
+	if open := db.Stats().OpenConnections; open != 0 {
+		t.Errorf("after queryRow and Scan: %d open connections, want 0", open)
+	}
+
+	rows, err := a.query(ctx, db, "rows", "SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+	}
+	if open := db.Stats().OpenConnections; open != 1 {
+		t.Errorf("before Close: %d open connections, want the query's 1", open)
+	}
+	_ = rows.Close()
+	if open := db.Stats().OpenConnections; open != 0 {
+		t.Errorf("after query and Close: %d open connections, want 0", open)
+	}
+}
@@ -0,0 +1,41 @@
+// staleness.go samples cache hits and compares them with the DB to measure how stale the cache gets.
+// It is diagnostic only: a stale entry is logged, not fixed.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// stalenessCheckTimeout bounds the background DB lookup for one sampled hit
+const stalenessCheckTimeout = 500 * time.Millisecond
+
+// sampleStaleness decides whether this cache hit gets checked, at cfg.stalenessSampleRate
+func (a *api) sampleStaleness() bool {
+	return a.cfg.stalenessSampleRate > 0 && rand.Float64() < a.cfg.stalenessSampleRate
+}
+
+// checkStaleness compares a cached user's updated_at with the primary and logs when they diverge.
+// Runs off the request path, on a context detached from the request.
+func (a *api) checkStaleness(ctx context.Context, cached User) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), stalenessCheckTimeout)
+	defer cancel()
+
+	// always the primary: a lagging replica would report false staleness
+	var updatedAt time.Time
+	err := a.readRow(ctx, a.dbForID(cached.ID), "checkStaleness", `SELECT updated_at FROM users WHERE id = $1`, cached.ID).Scan(&updatedAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		log.Printf("cache staleness: id=%s cached but deleted in db", cached.ID)
+	case err != nil:
+		log.Printf("cache staleness: id=%s check failed: %v", cached.ID, err)
+	case !updatedAt.Equal(cached.UpdatedAt):
+		log.Printf("cache staleness: id=%s cached updated_at=%s db updated_at=%s behind=%s",
+			cached.ID, cached.UpdatedAt.Format(time.RFC3339Nano), updatedAt.Format(time.RFC3339Nano),
+			updatedAt.Sub(cached.UpdatedAt))
+	}
+}
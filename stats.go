@@ -0,0 +1,186 @@
+// stats.go serves GET /users/stats/lastname, how many users share each last name, and GET /users/stats/daily,
+// signups per day, for dashboards.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultStatsLimit and maxStatsLimit bound ?limit= for GET /users/stats/lastname
+const (
+	defaultStatsLimit = 20
+	maxStatsLimit     = 100
+)
+
+// defaultStatsDays and maxStatsDays bound ?days= for GET /users/stats/daily
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 365
+)
+
+// dayLayout is how GET /users/stats/daily writes a day, and the to_char format signupsByDay reads it back in
+const dayLayout = "2006-01-02"
+
+// lastNameCount is one row of GET /users/stats/lastname
+type lastNameCount struct {
+	LastName string `json:"lastName"`
+	Count    int64  `json:"count"`
+}
+
+// dayCount is one row of GET /users/stats/daily, Day is a UTC calendar day
+type dayCount struct {
+	Day   string `json:"day"`
+	Count int64  `json:"count"`
+}
+
+// lastNameStatsHandler returns the tenant's most common last names with their user counts, most common first.
+// ?limit= defaults to 20 and is clamped to 100.
+func (a *api) lastNameStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r, "limit", "pretty") {
+		return
+	}
+
+	if a.pii != nil {
+		writeError(w, errStatsEncrypted)
+		return
+	}
+	if a.shards != nil {
+		writeError(w, errSharded)
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	limit := defaultStatsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, invalidParam("limit"))
+			return
+		}
+		limit = min(n, maxStatsLimit)
+	}
+
+	pretty, err := boolParam(r, "pretty")
+	if err != nil {
+		writeError(w, invalidParam("pretty"))
+		return
+	}
+
+	counts, err := a.lastNameCountsCached(ctx)
+	if err != nil {
+		writeError(w, failed("failed to get last name stats", err))
+		return
+	}
+
+	b, err := encodeJSON(counts[:min(limit, len(counts))], pretty)
+	if err != nil {
+		writeError(w, failed("failed to encode last name stats", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(a.cfg.statsCacheTTL.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b)
+}
+
+// lastNameCountsCached is lastNameCounts(ctx, maxStatsLimit) behind a.lastNameStats, like recentUsersCached.
+// The returned slice is shared, read-only.
+func (a *api) lastNameCountsCached(ctx context.Context) ([]lastNameCount, error) {
+	key := tenantKey(ctx, "stats:lastname")
+	if counts, ok := a.lastNameStats.get(key); ok {
+		return counts, nil
+	}
+
+	counts, err := a.lastNameCounts(ctx, maxStatsLimit)
+	if err != nil {
+		return nil, err
+	}
+	if a.cfg.statsCacheTTL > 0 {
+		a.lastNameStats.set(key, counts, a.cfg.statsCacheTTL)
+	}
+	return counts, nil
+}
+
+// dailyStatsHandler returns how many users were created on each of the last ?days= UTC days, oldest first
+// and ending today (so far). Days without signups are there with a count of 0, the list never has holes.
+// ?days= defaults to 30 and is clamped to 365.
+func (a *api) dailyStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r, "days", "pretty") {
+		return
+	}
+
+	ctx, cancel := a.requestContext(w, r)
+	defer cancel()
+
+	days := defaultStatsDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, invalidParam("days"))
+			return
+		}
+		days = min(n, maxStatsDays)
+	}
+
+	pretty, err := boolParam(r, "pretty")
+	if err != nil {
+		writeError(w, invalidParam("pretty"))
+		return
+	}
+
+	counts, err := a.dayCountsCached(ctx)
+	if err != nil {
+		writeError(w, failed("failed to get daily stats", err))
+		return
+	}
+
+	b, err := encodeJSON(counts[len(counts)-days:], pretty)
+	if err != nil {
+		writeError(w, failed("failed to encode daily stats", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(a.cfg.statsCacheTTL.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b)
+}
+
+// dayCountsCached is the last maxStatsDays of signups behind a.dailyStats, like lastNameCountsCached.
+// Every ?days= is a tail of that one list. The returned slice is shared, read-only.
+func (a *api) dayCountsCached(ctx context.Context) ([]dayCount, error) {
+	key := tenantKey(ctx, "stats:daily")
+	if counts, ok := a.dailyStats.get(key); ok {
+		return counts, nil
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, -(maxStatsDays - 1))
+	byDay, err := a.signupsByDay(ctx, first)
+	if err != nil {
+		return nil, err
+	}
+	counts := fillDays(byDay, first, today)
+	if a.cfg.statsCacheTTL > 0 {
+		a.dailyStats.set(key, counts, a.cfg.statsCacheTTL)
+	}
+	return counts, nil
+}
+
+// fillDays lists every day from first to last (UTC midnights, inclusive) with its count in byDay,
+// 0 for the days byDay doesn't have
+func fillDays(byDay map[string]int64, first, last time.Time) []dayCount {
+	var counts []dayCount
+	for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+		day := d.Format(dayLayout)
+		counts = append(counts, dayCount{Day: day, Count: byDay[day]})
+	}
+	return counts
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLastNameStatsHandlerFromCache(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	// a cached result means no DB is needed
+	counts := []lastNameCount{{"Bond", 3}, {"Smith", 2}, {"Adams", 1}}
+	a.lastNameStats.set("1:stats:lastname", counts, time.Minute)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		route(a).ServeHTTP(w, httptest.NewRequest("GET", "/users/stats/lastname"+query, nil))
+		return w
+	}
+
+	for query, want := range map[string]int{"": 3, "?limit=2": 2, "?limit=500": 3} {
+		w := get(query)
+		var got []lastNameCount
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%q: got %d %s", query, w.Code, w.Body)
+		}
+		if len(got) != want || got[0] != counts[0] {
+			t.Errorf("%q: got %v, want the first %d of %v", query, got, want, counts)
+		}
+	}
+	for _, query := range []string{"?limit=0", "?pretty=maybe"} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, w.Code)
+		}
+	}
+
+	a.pii = testPIICipher(t)
+	if w := get(""); w.Code != http.StatusNotImplemented {
+		t.Errorf("with PII encryption: got %d, want 501", w.Code)
+	}
+}
+
+func TestFillDays(t *testing.T) {
+	first := time.Date(2024, 2, 27, 0, 0, 0, 0, time.UTC)
+	got := fillDays(map[string]int64{"2024-02-28": 5, "2024-03-01": 2, "2024-01-01": 9}, first, first.AddDate(0, 0, 3))
+	want := []dayCount{{"2024-02-27", 0}, {"2024-02-28", 5}, {"2024-02-29", 0}, {"2024-03-01", 2}}
+	if !slices.Equal(got, want) {
+		t.Errorf("fillDays = %v, want %v (every day, zeros for gaps, nothing outside the range)", got, want)
+	}
+}
+
+func TestDailyStatsHandlerFromCache(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+	// a cached result means no DB is needed
+	first := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	counts := fillDays(map[string]int64{"2023-12-30": 4}, first, first.AddDate(0, 0, maxStatsDays-1))
+	a.dailyStats.set("1:stats:daily", counts, time.Minute)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		route(a).ServeHTTP(w, httptest.NewRequest("GET", "/users/stats/daily"+query, nil))
+		return w
+	}
+
+	for query, want := range map[string]int{"": defaultStatsDays, "?days=2": 2, "?days=1000": maxStatsDays} {
+		w := get(query)
+		var got []dayCount
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%q: got %d %s", query, w.Code, w.Body)
+		}
+		// the most recent days, oldest first
+		if len(got) != want || got[len(got)-1] != counts[len(counts)-1] {
+			t.Errorf("%q: got %d days ending %v, want the last %d", query, len(got), got[len(got)-1], want)
+		}
+	}
+	if w := get("?days=2"); !strings.Contains(w.Body.String(), `[{"day":"2023-12-30","count":4},{"day":"2023-12-31","count":0}]`) {
+		t.Errorf("days=2: got %s", w.Body)
+	}
+	for _, query := range []string{"?days=0", "?days=-1", "?days=week", "?pretty=maybe"} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, w.Code)
+		}
+	}
+}
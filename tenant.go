@@ -0,0 +1,65 @@
+// tenant.go scopes every request to the tenant named in the X-Tenant-ID header.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const tenantIDKey ctxKey = "tenant_id"
+
+// tenantHeader carries the caller's tenant id
+const tenantHeader = "X-Tenant-ID"
+
+// defaultTenantID owns every row that existed before tenants, and requests without the header
+const defaultTenantID int64 = 1
+
+// withTenantID returns ctx scoped to tenant id
+func withTenantID(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, tenantIDKey, id)
+}
+
+// GetTenantID extracts the tenant from context.
+// Returns defaultTenantID if missing (e.g. the -seed command, which runs outside a request).
+func GetTenantID(ctx context.Context) int64 {
+	if id, ok := ctx.Value(tenantIDKey).(int64); ok {
+		return id
+	}
+	return defaultTenantID
+}
+
+// tenantKey namespaces a key (cache entry, in-flight fetch) by the tenant in ctx,
+// so two tenants never share a cached or deduped result.
+func tenantKey(ctx context.Context, key string) string {
+	return fmt.Sprintf("%d:%s", GetTenantID(ctx), key)
+}
+
+// requestTenant is the tenant r's X-Tenant-ID names, the default tenant without one.
+// Middleware outside tenantMiddleware can use it before the tenant is in the context.
+func requestTenant(r *http.Request) (int64, error) {
+	v := r.Header.Get(tenantHeader)
+	if v == "" {
+		return defaultTenantID, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, invalidParam(tenantHeader)
+	}
+	return id, nil
+}
+
+// tenantMiddleware reads X-Tenant-ID into the context. A missing header means the default tenant,
+// anything that isn't a positive integer is rejected with 400.
+func tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := requestTenant(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withTenantID(r.Context(), tenant)))
+	})
+}
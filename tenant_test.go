@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenantMiddleware(t *testing.T) {
+	var got int64
+	h := tenantMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = GetTenantID(r.Context())
+	}))
+
+	tests := []struct {
+		header     string
+		wantStatus int
+		wantTenant int64
+	}{
+		{"", http.StatusOK, defaultTenantID},
+		{"42", http.StatusOK, 42},
+		{"0", http.StatusBadRequest, 0},
+		{"-3", http.StatusBadRequest, 0},
+		{"acme", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		got = 0
+		r := httptest.NewRequest("GET", "/users", nil)
+		if tt.header != "" {
+			r.Header.Set(tenantHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("header %q: expected status %d, got %d", tt.header, tt.wantStatus, w.Code)
+		}
+		if got != tt.wantTenant {
+			t.Errorf("header %q: expected tenant %d, got %d", tt.header, tt.wantTenant, got)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// timeout.go lets clients tune the per-request deadline via the X-Request-Timeout header.
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// requestTimeout returns the timeout asked for in X-Request-Timeout (milliseconds), clamped to max.
+// A missing or unparsable header falls back to def.
+func requestTimeout(r *http.Request, def, max time.Duration) time.Duration {
+	ms, err := strconv.Atoi(r.Header.Get(requestTimeoutHeader))
+	if err != nil || ms <= 0 {
+		return min(def, max)
+	}
+	// clamped before converting, a huge value would overflow the Duration into a negative one
+	if int64(ms) > max.Milliseconds() {
+		return max
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// requestContext derives the handler's context from the effective timeout and echoes that timeout
+// back in X-Request-Timeout so the client knows when the server will give up.
+// The context only gets cfg.workBudget of it: once that's spent the DB call is abandoned and the
+// remainder is enough to send a 503 before the client's own deadline.
+func (a *api) requestContext(w http.ResponseWriter, r *http.Request) (context.Context, context.CancelFunc) {
+	d := requestTimeout(r, a.cfg.requestTimeout, a.cfg.maxRequestTimeout)
+	w.Header().Set(requestTimeoutHeader, strconv.FormatInt(d.Milliseconds(), 10))
+	return context.WithTimeout(r.Context(), workBudget(d, a.cfg.workBudget))
+}
+
+// workBudget is the share of the request timeout d that handlers get for their work
+func workBudget(d time.Duration, fraction float64) time.Duration {
+	return time.Duration(float64(d) * fraction)
+}
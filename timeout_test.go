@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	const def, max = 500 * time.Millisecond, 5 * time.Second
+
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", def},
+		{"abc", def},
+		{"-1", def},
+		{"0", def},
+		{"2000", 2 * time.Second},
+		{"60000", max},
+		// past what a Duration holds in nanoseconds
+		{"9999999999999", max},
+		{"9223372036854775807", max},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/users", nil)
+		if tt.header != "" {
+			r.Header.Set(requestTimeoutHeader, tt.header)
+		}
+		if got := requestTimeout(r, def, max); got != tt.want {
+			t.Errorf("requestTimeout(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRequestContextWorkBudget(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.requestTimeout, cfg.workBudget = time.Second, 0.8
+	a := newAPI(cfg, nil, newMemoryCache())
+
+	w := httptest.NewRecorder()
+	ctx, cancel := a.requestContext(w, httptest.NewRequest("GET", "/users", nil))
+	defer cancel()
+
+	// the client is told the full timeout, the work gets 80% of it
+	if got := w.Header().Get(requestTimeoutHeader); got != "1000" {
+		t.Errorf("%s = %q, want 1000", requestTimeoutHeader, got)
+	}
+	deadline, ok := ctx.Deadline()
+	if left := time.Until(deadline); !ok || left > 800*time.Millisecond || left < 700*time.Millisecond {
+		t.Errorf("deadline in %v, want about 800ms", left)
+	}
+}
+
+func TestStatementTimeoutConfig(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://localhost/test")
+	t.Setenv("MAX_REQUEST_TIMEOUT", "2s")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.statementTimeout != 3*time.Second {
+		t.Errorf("default statementTimeout = %v, want MAX_REQUEST_TIMEOUT + 1s", cfg.statementTimeout)
+	}
+
+	t.Setenv("DB_STATEMENT_TIMEOUT", "0")
+	if cfg, err = loadConfig(); err != nil || cfg.statementTimeout != 0 {
+		t.Errorf("DB_STATEMENT_TIMEOUT=0: got %v, %v", cfg.statementTimeout, err)
+	}
+
+	t.Setenv("DB_STATEMENT_TIMEOUT", "-1s")
+	if _, err := loadConfig(); err == nil {
+		t.Error("negative DB_STATEMENT_TIMEOUT accepted")
+	}
+}
@@ -0,0 +1,54 @@
+// tracing.go sets up OpenTelemetry tracing: W3C trace context propagation plus an OTLP exporter.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is used for the manual spans around SQL calls.
+// It's safe to grab before initTracing runs, the global provider delegates once set.
+var tracer = otel.Tracer("github/abel123code/backend")
+
+// initTracing installs the W3C traceparent/baggage propagators and, when
+// OTEL_EXPORTER_OTLP_ENDPOINT (or the traces-specific variant) is set, an OTLP/HTTP exporter.
+// The exporter reads the rest of its config (headers, insecure, ...) from the standard OTEL_* env vars.
+// The returned func flushes buffered spans and must be called on shutdown.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		// No collector configured: incoming trace context is still propagated, spans just aren't exported.
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// finishSpan records err on span (not-found isn't treated as a failure) and ends it.
+func finishSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -2,34 +2,159 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
-// User represents a user in the system
+// User represents a user in the system as it's stored: scanned from the DB, and its json tags are the
+// Redis cache's format (see storedUser). What clients see is userResponse, built in MarshalJSON, so
+// columns can be added here without showing up in the API.
 type User struct {
-	ID        string    `json:"id"`
+	ID        string `json:"id"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	// FullName is "FirstName LastName", a generated column so it can never disagree with the parts
+	FullName string `json:"fullName"`
+	// Phone is stored in E.164 (+14155552671), nil when the user has none
+	Phone *string `json:"phone"`
+	// IsActive is false for deactivated users, they're kept (and still readable) instead of deleted
+	IsActive  bool      `json:"isActive"`
+	CreatedAt time.Time `json:"createdAt"`
+	// UpdatedAt is bumped on every PATCH, equal to CreatedAt until then
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// userResponse is a user on the wire, every field a client can see (and ask for in ?fields=).
+// Renaming a JSON key or exposing a new field is a change here, not to User.
+type userResponse struct {
+	// ID is a string, or a json.Number with ID_FORMAT=number
+	ID        any       `json:"id"`
 	FirstName string    `json:"firstName"`
 	LastName  string    `json:"lastName"`
+	FullName  string    `json:"fullName"`
+	Phone     *string   `json:"phone"`
+	IsActive  bool      `json:"isActive"`
 	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// numericIDs makes User marshal its id as a JSON number instead of a string (ID_FORMAT=number).
+// It's set once in main before serving, since MarshalJSON has no way to reach the config.
+var numericIDs bool
+
+// newUserResponse maps u to what the API exposes
+func newUserResponse(u User) userResponse {
+	var id any = u.ID
+	if numericIDs {
+		id = json.Number(u.ID)
+	}
+	return userResponse{
+		ID:        id,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		FullName:  u.FullName,
+		Phone:     u.Phone,
+		IsActive:  u.IsActive,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+	}
+}
+
+// storedUser is User without MarshalJSON, for storage (the Redis cache) that keeps the storage format
+type storedUser User
+
+// MarshalJSON writes u as its userResponse, so every handler that encodes a User sends the API shape
+func (u User) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newUserResponse(u))
+}
+
+// createUserResponse is the POST /users body when softValidateUser flagged the input: the user plus its warnings
+type createUserResponse struct {
+	userResponse
+	Warnings []string `json:"warnings"`
+}
+
+// createUserRequest is the POST /users payload, validation rules live in the struct tags
+type createUserRequest struct {
+	FirstName string `json:"firstName" validate:"required,max=100"`
+	LastName  string `json:"lastName" validate:"required,max=100"`
+	// Phone can be in any common format, it's normalized to E.164 before storing
+	Phone *string `json:"phone"`
+}
+
+// patchResponse is the PATCH /users/{id} body: the user after the update and which fields it actually changed
+type patchResponse struct {
+	User    User     `json:"user"`
+	Changed []string `json:"changed"`
 }
 
 // cacheEntry represents a user in the cache
 type cacheEntry struct {
-	user      User
+	user User
+	// cachedAt is when the entry was written. Only Set stamps it, so it's also the entry's absolute age
+	// that CACHE_MAX_AGE bounds, however often the key is read.
+	cachedAt  time.Time
+	expiresAt time.Time
+}
+
+// tooOld reports whether the entry is past maxAge (0 means no limit) and must not be served, not even stale
+func (e cacheEntry) tooOld(maxAge time.Duration, now time.Time) bool {
+	return maxAge > 0 && now.Sub(e.cachedAt) > maxAge
+}
+
+// userLookup is what getUserByIdDedupe found and where it came from
+type userLookup struct {
+	user User
+	// source is "cache", "shared" (joined another request's fetch), "db" or "stale" (expired entry served after a DB error)
+	source string
+	// cachedAt/expiresAt describe the cache entry backing this user
+	cachedAt  time.Time
 	expiresAt time.Time
 }
 
 // api represents the API server with database and cache
 type api struct {
-	addr    string
-	db      *sql.DB
-	cacheMu sync.RWMutex
-	cache   map[string]cacheEntry
+	addr string
+	cfg  config
+	db   *sql.DB
+	// readDB serves listUsers/getUserById, it's a replica when READ_DATABASE_URL is set and db otherwise
+	readDB *sql.DB
+	// shards splits users across databases by id when SHARD_2_DATABASE_URL is set, db is then the first
+	// shard. Nil otherwise, see shard.go
+	shards shardMap
+	cache  Cache
+	// invalidations batches cache evictions, see invalidate.go
+	invalidations *invalidator
 	// inflight dedupe helps to prevent duplicate requests for the same resource
 	inflightMu sync.Mutex
 	inflight   map[string]chan fetchResult
+	// draining is closed by drainInflight on shutdown: no new leaders, waiting followers get errShuttingDown
+	draining  chan struct{}
+	drainOnce sync.Once
+	// listGroup does the same for list queries, keyed by listParams.key()
+	listGroup singleflight.Group
+	// recent caches GET /users/recent per tenant, see recent.go
+	recent ttlCache[[]User]
+	// lastNameStats caches GET /users/stats/lastname per tenant, see stats.go
+	lastNameStats ttlCache[[]lastNameCount]
+	// dailyStats caches GET /users/stats/daily per tenant, see stats.go
+	dailyStats ttlCache[[]dayCount]
+	// events carries created/updated/deleted notifications to SSE subscribers
+	events *eventBus
+	// pii seals names at rest, nil when PII_ENCRYPTION_KEY isn't set
+	pii *piiCipher
+	// instanceID tags this process's NOTIFYs so the listener can skip changes it already applied
+	instanceID string
+	// onPanic is called for every recovered panic, nil unless PANIC_WEBHOOK_URL is set
+	onPanic func(panicAlert)
+	// maintenance refuses writes with a 503 while set, see maintenance.go. Starts as MAINTENANCE_MODE,
+	// flipped at runtime by POST /admin/maintenance
+	maintenance atomic.Bool
 }
 
 type fetchResult struct {
@@ -37,6 +162,14 @@ type fetchResult struct {
 	err  error
 }
 
+// writeOptions tweaks how a mutation in sql.go runs
+type writeOptions struct {
+	// dryRun runs the mutation in a transaction that is always rolled back
+	dryRun bool
+	// unmodifiedSince is the If-Unmodified-Since precondition, zero means none
+	unmodifiedSince time.Time
+}
+
 // ctxKey is used for context keys to avoid collisions
 type ctxKey string
 
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestUserMarshalIDFormat(t *testing.T) {
+	u := User{ID: "42", FirstName: "Ada", LastName: "Lovelace"}
+
+	b, _ := json.Marshal(u)
+	if !strings.HasPrefix(string(b), `{"id":"42","firstName":"Ada"`) {
+		t.Errorf("default should keep string ids, got %s", b)
+	}
+
+	numericIDs = true
+	defer func() { numericIDs = false }()
+
+	b, _ = json.Marshal(u)
+	if !strings.HasPrefix(string(b), `{"id":42,"firstName":"Ada"`) || strings.Count(string(b), `"id"`) != 1 {
+		t.Errorf("numeric ids: got %s", b)
+	}
+
+	// the score survives User having its own MarshalJSON
+	b, _ = json.Marshal(similarUser{User: u, Score: 0.5})
+	if !strings.HasPrefix(string(b), `{"id":42,`) || !strings.HasSuffix(string(b), `,"score":0.5}`) {
+		t.Errorf("similar user: got %s", b)
+	}
+
+	// what the Redis cache stores never changes with the format
+	b, _ = json.Marshal(redisEntry{User: storedUser(u)})
+	if !strings.Contains(string(b), `"id":"42"`) {
+		t.Errorf("cache entry: got %s", b)
+	}
+}
+
+func TestUserMarshalsAsResponse(t *testing.T) {
+	b, err := json.Marshal(User{ID: "7", FirstName: "Ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]json.RawMessage
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	// exactly userResponse's fields, which is also what ?fields= accepts
+	if len(got) != len(userFields) {
+		t.Errorf("got keys %s, want the %d userResponse fields", b, len(userFields))
+	}
+	for k := range got {
+		if !userFields[k] {
+			t.Errorf("%q isn't a userResponse field", k)
+		}
+	}
+}
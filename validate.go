@@ -0,0 +1,146 @@
+// validate.go contains the request validation layer used by the handlers.
+package main
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/text/unicode/norm"
+)
+
+// validate checks request DTOs against the rules in their `validate` struct tags
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+
+	// Report fields by their json name so clients can map errors back to their payload.
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}
+
+// validationErrors turns a validator error into a field -> rule map,
+// e.g. {"firstName":"required","lastName":"max 100"}.
+// Returns nil if err isn't a validation error.
+func validationErrors(err error) map[string]string {
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return nil
+	}
+
+	out := make(map[string]string, len(verrs))
+	for _, fe := range verrs {
+		msg := fe.Tag()
+		if fe.Param() != "" {
+			msg += " " + fe.Param()
+		}
+		out[fe.Field()] = msg
+	}
+	return out
+}
+
+// formatValidationErrors flattens validationErrors into one line, e.g. "firstName: required; lastName: max 100"
+func formatValidationErrors(errs map[string]string) string {
+	parts := make([]string, 0, len(errs))
+	for field, msg := range errs {
+		parts = append(parts, field+": "+msg)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "; ")
+}
+
+// normalizeName returns s in Unicode NFC, so "é" typed as one code point and as "e" plus a combining
+// accent is stored (and hits the unique index) the same way. ok is false if s isn't valid UTF-8,
+// including U+FFFD: encoding/json decodes invalid bytes (e.g. a latin-1 name sent as JSON) to it.
+func normalizeName(s string) (_ string, ok bool) {
+	if !utf8.ValidString(s) || strings.ContainsRune(s, utf8.RuneError) {
+		return "", false
+	}
+	return norm.NFC.String(s), true
+}
+
+// normalizeNames runs normalizeName over a request's names, before validate.Struct so the
+// length limits count the normalized form
+func (req *createUserRequest) normalizeNames() error {
+	var ok bool
+	if req.FirstName, ok = normalizeName(req.FirstName); !ok {
+		return &ValidationError{Field: "firstName", Message: "firstName must be valid UTF-8"}
+	}
+	if req.LastName, ok = normalizeName(req.LastName); !ok {
+		return &ValidationError{Field: "lastName", Message: "lastName must be valid UTF-8"}
+	}
+	return nil
+}
+
+// namePattern is NAME_FORMAT=letters: letters in any script (with their combining marks), spaces,
+// hyphens and apostrophes, typed or typographic, so "O'Brien", "Jean-Luc" and "Mary Ann" pass and "User123" doesn't
+var namePattern = regexp.MustCompile(`^[\p{L}\p{M} '’-]+$`)
+
+// copySuffix is the " (copy)" / " (copy 2)" copyLastName appends. Names the service made itself
+// have to pass the check too, or a copy couldn't be PATCHed back, re-imported or looked up.
+var copySuffix = regexp.MustCompile(` \(copy( [0-9]+)?\)$`)
+
+// validateName applies the NAME_FORMAT policy to an already normalized name, field is its JSON name
+func (a *api) validateName(field, s string) error {
+	if a.cfg.nameFormat == "letters" && !namePattern.MatchString(copySuffix.ReplaceAllString(s, "")) {
+		return &ValidationError{Field: field, Message: field + " may only contain letters, spaces, hyphens and apostrophes"}
+	}
+	return nil
+}
+
+// validateNames is validateName over both names of a create request, after validate.Struct
+func (a *api) validateNames(req createUserRequest) error {
+	if err := a.validateName("firstName", req.FirstName); err != nil {
+		return err
+	}
+	return a.validateName("lastName", req.LastName)
+}
+
+// validatePatchNames is validateName over whichever names a patch sets
+func (a *api) validatePatchNames(p userPatch) error {
+	if p.FirstName != nil {
+		if err := a.validateName("firstName", *p.FirstName); err != nil {
+			return err
+		}
+	}
+	if p.LastName != nil {
+		return a.validateName("lastName", *p.LastName)
+	}
+	return nil
+}
+
+// softValidateUser returns warnings for input that passes validation but looks like a typo or a placeholder,
+// e.g. "aaaa" or a one-letter name. The create still happens, the client decides whether to ask the user.
+func softValidateUser(req createUserRequest) []string {
+	var warnings []string
+	for _, f := range []struct{ field, value string }{{"firstName", req.FirstName}, {"lastName", req.LastName}} {
+		switch {
+		case utf8.RuneCountInString(f.value) < 2:
+			warnings = append(warnings, f.field+" is very short")
+		case repeatedRune(f.value):
+			warnings = append(warnings, f.field+" is one character repeated")
+		}
+	}
+	if strings.EqualFold(req.FirstName, req.LastName) {
+		warnings = append(warnings, "firstName and lastName are the same")
+	}
+	return warnings
+}
+
+// repeatedRune reports whether s is a single character repeated, ignoring case
+func repeatedRune(s string) bool {
+	s = strings.ToLower(s)
+	first, _ := utf8.DecodeRuneInString(s)
+	return strings.Trim(s, string(first)) == ""
+}
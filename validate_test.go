@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		want   string
+		wantOK bool
+	}{
+		{"ascii", "Bond", "Bond", true},
+		{"composed stays", "Ren\u00e9e", "Ren\u00e9e", true},
+		{"decomposed is composed", "Rene\u0301e", "Ren\u00e9e", true},
+		{"hangul jamo", "\u1100\u1161", "\uac00", true},
+		{"no composed form", "Z\u0327", "Z\u0327", true},
+		{"latin-1 bytes", "Ren\xe9e", "", false},
+		{"truncated sequence", "Bon\xc3", "", false},
+		{"replacement char from json", "Ren\ufffde", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := normalizeName(tt.in)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("normalizeName(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCreateUserRejectsNonUTF8(t *testing.T) {
+	a := newAPI(defaultConfig(), nil, newMemoryCache())
+
+	// a latin-1 "é" sent as JSON, encoding/json turns it into U+FFFD. Rejected before any DB access.
+	body := "{\"firstName\":\"Ren\xe9e\",\"lastName\":\"Bond\"}"
+	w := httptest.NewRecorder()
+	route(a).ServeHTTP(w, httptest.NewRequest("POST", "/users", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "firstName") {
+		t.Errorf("got %d %s, want 400 naming firstName", w.Code, w.Body)
+	}
+
+	// PATCH normalizes the same way
+	p, err := patchFromJSON(map[string]json.RawMessage{"lastName": json.RawMessage(`"Rene\u0301e"`)})
+	if err != nil || *p.LastName != "Ren\u00e9e" {
+		t.Errorf("patch lastName = %q, %v; want it in NFC", *p.LastName, err)
+	}
+	if _, err := patchFromJSON(map[string]json.RawMessage{"lastName": json.RawMessage(`"Ren\ufffde"`)}); err == nil {
+		t.Error("patch with U+FFFD accepted")
+	}
+}
+
+func TestUTF8Body(t *testing.T) {
+	for ct, want := range map[string]bool{
+		"":                                  true,
+		"application/json":                  true,
+		"application/json; charset=UTF-8":   true,
+		"application/json; charset=utf8":    true,
+		"application/json; charset=latin1":  false,
+		"text/plain; charset=ISO-8859-1":    false,
+		"application/x-www-form-urlencoded": true,
+	} {
+		r := httptest.NewRequest("POST", "/users", nil)
+		r.Header.Set("Content-Type", ct)
+		if got := utf8Body(r); got != want {
+			t.Errorf("utf8Body(%q) = %v, want %v", ct, got, want)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.nameFormat = "letters"
+	a := newAPI(cfg, nil, newMemoryCache())
+	for _, name := range []string{"O'Brien", "O’Brien", "Jean-Luc", "Mary Ann", "Renée", "Бонд", copyLastName("Bond", 1), copyLastName("Bond", 2)} {
+		if err := a.validateName("firstName", name); err != nil {
+			t.Errorf("%q rejected: %v", name, err)
+		}
+	}
+	for _, name := range []string{"User123", "Bond!", "a_b", "j@mes", "(copy)", "Bond (copy x)", "Bond (copy 2) x"} {
+		if err := a.validateName("firstName", name); err == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+
+	// rejected with a 400 on create and update, before any DB access
+	for method, path := range map[string]string{"POST": "/users", "PATCH": "/users/1"} {
+		w := httptest.NewRecorder()
+		body := `{"firstName":"User123","lastName":"Bond"}`
+		route(a).ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "may only contain letters") {
+			t.Errorf("%s %s: got %d %s, want 400", method, path, w.Code, w.Body)
+		}
+	}
+
+	// any is the default
+	if err := newAPI(defaultConfig(), nil, newMemoryCache()).validateName("firstName", "User123"); err != nil {
+		t.Errorf("NAME_FORMAT=any: %v", err)
+	}
+}
+
+func TestSoftValidateUser(t *testing.T) {
+	tests := []struct {
+		first, last string
+		want        []string
+	}{
+		{"James", "Bond", nil},
+		{"Al", "Li", nil},
+		{"J", "Bond", []string{"firstName is very short"}},
+		{"James", "BbBb", []string{"lastName is one character repeated"}},
+		{"Bond", "bond", []string{"firstName and lastName are the same"}},
+	}
+	for _, tc := range tests {
+		got := softValidateUser(createUserRequest{FirstName: tc.first, LastName: tc.last})
+		if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("%s %s: got %q, want %q", tc.first, tc.last, got, tc.want)
+		}
+	}
+
+	b, _ := json.Marshal(createUserResponse{userResponse: newUserResponse(User{ID: "7"}), Warnings: []string{"w"}})
+	if !strings.HasPrefix(string(b), `{"id":"7",`) || !strings.HasSuffix(string(b), `"warnings":["w"]}`) {
+		t.Errorf("response: got %s, want the user's fields then warnings", b)
+	}
+}
@@ -0,0 +1,69 @@
+// ws.go serves the user change feed over WebSocket at GET /users/ws, same messages as the SSE stream.
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// wsPingInterval is how often we ping the client to detect dead sockets
+const wsPingInterval = 30 * time.Second
+
+// wsWriteTimeout bounds a single message or ping so a stuck client can't hold the goroutine
+const wsWriteTimeout = 5 * time.Second
+
+// userEventsWSHandler pushes every userEvent to the client as a JSON text message until either side goes away
+func (a *api) userEventsWSHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allowedParams(w, r) {
+		return
+	}
+
+	c, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		// Accept already wrote the error response
+		log.Printf("ws: accept: %v", err)
+		return
+	}
+	defer c.CloseNow()
+
+	events, unsubscribe := a.events.subscribe(GetTenantID(r.Context()))
+	defer unsubscribe()
+
+	// Clients don't send anything yet. CloseRead still reads so pongs and close frames are handled,
+	// and cancels ctx once the peer disconnects.
+	ctx := c.CloseRead(r.Context())
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				c.Close(websocket.StatusGoingAway, "server shutting down")
+				return
+			}
+			if err := wsWrite(ctx, func(ctx context.Context) error { return wsjson.Write(ctx, c, e) }); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := wsWrite(ctx, c.Ping); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsWrite runs a write (message or ping) with wsWriteTimeout
+func wsWrite(ctx context.Context, write func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, wsWriteTimeout)
+	defer cancel()
+	return write(ctx)
+}